@@ -2,6 +2,7 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"log"
@@ -11,48 +12,122 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/charlesgreen/gsm/internal/api/grpcapi"
 	"github.com/charlesgreen/gsm/internal/api/routes"
+	"github.com/charlesgreen/gsm/internal/kms"
+	"github.com/charlesgreen/gsm/internal/notify"
+	"github.com/charlesgreen/gsm/internal/scheduler"
 	"github.com/charlesgreen/gsm/internal/storage"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rekey" {
+		if err := rekey(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to rekey storage: %v", err)
+		}
+		fmt.Println("Storage rekeyed")
+		return
+	}
+
 	port := getEnvOrDefault("GSM_PORT", "8085")
 	host := getEnvOrDefault("GSM_HOST", "0.0.0.0")
 	storageFile := os.Getenv("GSM_STORAGE_FILE")
+	storageBackend := getEnvOrDefault("GSM_STORAGE_BACKEND", "file")
 	logLevel := getEnvOrDefault("GSM_LOG_LEVEL", "info")
+	schedulerInterval, err := time.ParseDuration(getEnvOrDefault("GSM_SCHEDULER_INTERVAL", scheduler.DefaultInterval.String()))
+	if err != nil {
+		log.Fatalf("Invalid GSM_SCHEDULER_INTERVAL: %v", err)
+	}
+	flushDelay, err := time.ParseDuration(getEnvOrDefault("GSM_FLUSH_DELAY", "0"))
+	if err != nil {
+		log.Fatalf("Invalid GSM_FLUSH_DELAY: %v", err)
+	}
 
 	fmt.Printf("Starting Google Secret Manager Emulator\n")
 	fmt.Printf("Port: %s\n", port)
 	fmt.Printf("Host: %s\n", host)
 	fmt.Printf("Log Level: %s\n", logLevel)
 	if storageFile != "" {
-		fmt.Printf("Storage File: %s\n", storageFile)
+		fmt.Printf("Storage File: %s (%s)\n", storageFile, storageBackend)
+	}
+
+	keys, err := keyRegistry()
+	if err != nil {
+		log.Fatalf("Invalid KMS keys: %v", err)
+	}
+	storageKey, err := storageKeyConfig().Key(keys)
+	if err != nil {
+		log.Fatalf("Invalid storage encryption key: %v", err)
 	}
 
 	var store storage.Storage
-	if storageFile != "" {
+	switch {
+	case storageFile != "" && storageBackend == "journal":
+		journalStore, err := storage.NewJournalStorage(storageFile)
+		if err != nil {
+			log.Fatalf("Failed to create journal storage: %v", err)
+		}
+		journalStore.SetKeyRegistry(keys)
+		journalStore.SetEncryptionKey(storageKey)
+		store = journalStore
+
+		// Appending to a journal that could not be replayed would bury the
+		// records that failed, so refuse to start instead.
+		if err := journalStore.Load(); err != nil {
+			log.Fatalf("Failed to load journal storage: %v", err)
+		}
+	case storageFile != "" && storageBackend == "file":
 		persistentStore, err := storage.NewPersistentStorage(storageFile)
 		if err != nil {
 			log.Fatalf("Failed to create persistent storage: %v", err)
 		}
+		persistentStore.SetKeyRegistry(keys)
+		persistentStore.SetFlushDelay(flushDelay)
+		persistentStore.SetEncryptionKey(storageKey)
 		store = persistentStore
 
 		if err := persistentStore.Load(); err != nil {
+			if storage.IsFatalLoadError(err, storageKey) {
+				log.Fatalf("Failed to load storage: %v", err)
+			}
 			log.Printf("Warning: Failed to load existing storage: %v", err)
 		}
-	} else {
-		store = storage.NewMemoryStorage()
+	case storageFile != "":
+		log.Fatalf("Invalid GSM_STORAGE_BACKEND: %q is neither file nor journal", storageBackend)
+	default:
+		memoryStore := storage.NewMemoryStorage()
+		memoryStore.SetKeyRegistry(keys)
+		store = memoryStore
 	}
 
-	router := routes.SetupRoutes(store)
+	notifier := notify.Discard
+	if pubsubHost := cmp.Or(os.Getenv("GSM_PUBSUB_HOST"), os.Getenv("PUBSUB_EMULATOR_HOST")); pubsubHost != "" {
+		fmt.Printf("Pub/Sub Host: %s\n", pubsubHost)
+		notifier = notify.Topics(notify.NewRESTPublisher(pubsubHost, nil))
+	}
+	if logLevel == "debug" {
+		notifier = notify.Multi(notify.Logger(nil), notifier)
+	}
+
+	opts := []routes.Option{routes.Notifier(notifier), routes.KeyRegistry(keys)}
+	router := routes.SetupRoutes(store, opts...)
 
+	schedulerCtx, stopScheduler := context.WithCancel(context.Background())
+	sched := scheduler.New(schedulerInterval)
+	sched.Add("expire secrets", scheduler.ExpireSecrets(store, notifier))
+	sched.Add("rotate secrets", scheduler.RotateSecrets(store, notifier))
+	sched.Add("destroy versions", scheduler.DestroyScheduledVersions(store, notifier))
+	go sched.Run(schedulerCtx)
+
+	// REST and gRPC clients share the port, gRPC over unencrypted HTTP/2
 	server := &http.Server{
-		Addr:    fmt.Sprintf("%s:%s", host, port),
-		Handler: router,
+		Addr:      fmt.Sprintf("%s:%s", host, port),
+		Handler:   grpcapi.Handler(router, routes.SetupGRPC(store, opts...)),
+		Protocols: grpcapi.Protocols(),
 	}
 
 	go func() {
-		fmt.Printf("Server starting on http://%s:%s\n", host, port)
+		fmt.Printf("Server starting on http://%s:%s (REST and gRPC)\n", host, port)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server failed to start: %v", err)
 		}
@@ -63,6 +138,7 @@ func main() {
 	<-quit
 
 	fmt.Println("Shutting down server...")
+	stopScheduler()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -78,6 +154,31 @@ func main() {
 	fmt.Println("Server gracefully stopped")
 }
 
+// keyRegistry creates the simulated Cloud KMS, kept in GSM_KMS_FILE when it is
+// set, with the keys listed in GSM_KMS_KEYS.
+func keyRegistry() (*kms.Registry, error) {
+	keys := kms.NewRegistry()
+	if path := os.Getenv("GSM_KMS_FILE"); path != "" {
+		var err error
+		if keys, err = kms.Open(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := keys.Register(os.Getenv("GSM_KMS_KEYS")); err != nil {
+		return nil, fmt.Errorf("invalid GSM_KMS_KEYS: %w", err)
+	}
+	return keys, nil
+}
+
+// storageKeyConfig selects the key that encrypts the storage file at rest.
+func storageKeyConfig() storage.KeyConfig {
+	return storage.KeyConfig{
+		KeyFile:    os.Getenv("GSM_STORAGE_KEY_FILE"),
+		Passphrase: os.Getenv("GSM_STORAGE_PASSPHRASE"),
+		KMSKey:     os.Getenv("GSM_STORAGE_KMS_KEY"),
+	}
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/charlesgreen/gsm/internal/storage"
+)
+
+// rekey re-encrypts GSM_STORAGE_FILE, and its journal, from the key the
+// GSM_STORAGE_* environment variables select to the key given by flags. The
+// emulator must be stopped while it runs.
+func rekey(args []string) error {
+	flags := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	keyFile := flags.String("key-file", "", "file holding the new 32 byte key, raw or base64-encoded")
+	passphraseEnv := flags.String("passphrase-env", "", "environment variable holding the new passphrase")
+	kmsKey := flags.String("kms-key", "", "simulated Cloud KMS crypto key that wraps the new data keys")
+	decrypt := flags.Bool("decrypt", false, "store the data unencrypted")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	storageFile := os.Getenv("GSM_STORAGE_FILE")
+	if storageFile == "" {
+		return errors.New("GSM_STORAGE_FILE is not set")
+	}
+	keys, err := keyRegistry()
+	if err != nil {
+		return err
+	}
+	from, err := storageKeyConfig().Key(keys)
+	if err != nil {
+		return fmt.Errorf("invalid current key: %w", err)
+	}
+
+	var passphrase string
+	if *passphraseEnv != "" {
+		if passphrase = os.Getenv(*passphraseEnv); passphrase == "" {
+			return fmt.Errorf("%s is not set", *passphraseEnv)
+		}
+	}
+	to, err := storage.KeyConfig{KeyFile: *keyFile, Passphrase: passphrase, KMSKey: *kmsKey}.Key(keys)
+	if err != nil {
+		return fmt.Errorf("invalid new key: %w", err)
+	}
+	switch {
+	case to == nil && !*decrypt:
+		return errors.New("give the new key with -key-file, -passphrase-env or -kms-key, or -decrypt to remove encryption")
+	case to != nil && *decrypt:
+		return errors.New("-decrypt cannot be combined with a new key")
+	}
+
+	return storage.Rekey(storageFile, from, to)
+}
@@ -1,14 +1,37 @@
 package gsmtest_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/iam/apiv1/iampb"
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 	"github.com/charlesgreen/gsm/gsmtest"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	locationpb "google.golang.org/genproto/googleapis/cloud/location"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestTCP(t *testing.T) {
@@ -16,7 +39,7 @@ func TestTCP(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	testFlow(t, gsm)
+	testFlow(t, gsm, gsm.Client)
 }
 
 func TestMem(t *testing.T) {
@@ -24,7 +47,272 @@ func TestMem(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	testFlow(t, gsm)
+	testFlow(t, gsm, gsm.Client)
+}
+
+func TestRestart(t *testing.T) {
+	testRestart(t, gsmtest.StorageFile)
+}
+
+func TestRestartJournal(t *testing.T) {
+	testRestart(t, gsmtest.StorageJournal)
+}
+
+func TestRestartEncrypted(t *testing.T) {
+	testRestart(t, gsmtest.StorageJournal, gsmtest.StorageEncryption(gsmtest.StorageKey{Passphrase: "correct horse battery staple"}))
+}
+
+func TestStorageKey(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "storage.json")
+	writeKey := func(name string, b byte) string {
+		keyFile := filepath.Join(dir, name)
+		key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+		if err := os.WriteFile(keyFile, []byte(key+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return keyFile
+	}
+	key := gsmtest.StorageKey{KeyFile: writeKey("storage.key", 1)}
+
+	gsm, err := gsmtest.New(t, gsmtest.InMemory(), gsmtest.StorageFile(path), gsmtest.StorageEncryption(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- gsm.Start(ctx) }()
+	client, err := gsm.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/foo",
+		SecretId: "database-password",
+		Secret:   &secretmanagerpb.Secret{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent:  secret.Name,
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte("hunter2")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither names nor payloads are readable at rest
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintext := range []string{"database-password", "hunter2", base64.StdEncoding.EncodeToString([]byte("hunter2"))} {
+		if bytes.Contains(data, []byte(plaintext)) {
+			t.Errorf("expected %q to be encrypted", plaintext)
+		}
+	}
+
+	// The file only loads with the key it was written with
+	for name, opts := range map[string][]gsmtest.Option{
+		"no key":      nil,
+		"other key":   {gsmtest.StorageEncryption(gsmtest.StorageKey{KeyFile: writeKey("other.key", 2)})},
+		"passphrase":  {gsmtest.StorageEncryption(gsmtest.StorageKey{Passphrase: "hunter2"})},
+		"zero key":    {gsmtest.StorageEncryption(gsmtest.StorageKey{})},
+		"correct key": {gsmtest.StorageEncryption(key)},
+	} {
+		_, err := gsmtest.New(t, append([]gsmtest.Option{gsmtest.InMemory(), gsmtest.StorageFile(path)}, opts...)...)
+		if name == "correct key" {
+			if err != nil {
+				t.Errorf("%s: expected the file to load, got %v", name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected loading to fail", name)
+		}
+	}
+}
+
+// testRestart checks that everything stored survives restarting an emulator on
+// the storage the option enables.
+func testRestart(t *testing.T, storage func(path string) gsmtest.Option, opts ...gsmtest.Option) {
+	const keyName = "projects/foo/locations/global/keyRings/ring/cryptoKeys/key"
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	// start runs an emulator on the storage file until the returned func stops it
+	start := func() (*secretmanager.Client, func()) {
+		t.Helper()
+		gsm, err := gsmtest.New(t, append([]gsmtest.Option{gsmtest.InMemory(), storage(path), gsmtest.KMSKeys(keyName)}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- gsm.Start(ctx) }()
+
+		client, err := gsm.Client(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, func() {
+			_ = client.Close()
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	ctx := context.Background()
+	client, stop := start()
+
+	secret, err := client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/foo",
+		SecretId: "bar",
+		Secret: &secretmanagerpb.Secret{
+			Labels:      map[string]string{"env": "test"},
+			Annotations: map[string]string{"owner": "payments"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []*secretmanagerpb.SecretVersion
+	for _, data := range []string{"one", "two", "three"} {
+		version, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+			Parent:  secret.Name,
+			Payload: &secretmanagerpb.SecretPayload{Data: []byte(data)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	if versions[1], err = client.DisableSecretVersion(ctx, &secretmanagerpb.DisableSecretVersionRequest{Name: versions[1].Name}); err != nil {
+		t.Fatal(err)
+	}
+	if versions[2], err = client.DestroySecretVersion(ctx, &secretmanagerpb.DestroySecretVersionRequest{Name: versions[2].Name}); err != nil {
+		t.Fatal(err)
+	}
+	secret, err = client.UpdateSecret(ctx, &secretmanagerpb.UpdateSecretRequest{
+		Secret:     &secretmanagerpb.Secret{Name: secret.Name, VersionAliases: map[string]int64{"current": 1}},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"version_aliases"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := client.SetIamPolicy(ctx, &iampb.SetIamPolicyRequest{
+		Resource: secret.Name,
+		Policy: &iampb.Policy{Bindings: []*iampb.Binding{{
+			Role:    "roles/secretmanager.secretAccessor",
+			Members: []string{"user:dev@example.com"},
+		}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/foo",
+		SecretId: "encrypted",
+		Secret: &secretmanagerpb.Secret{
+			Replication: &secretmanagerpb.Replication{
+				Replication: &secretmanagerpb.Replication_UserManaged_{
+					UserManaged: &secretmanagerpb.Replication_UserManaged{
+						Replicas: []*secretmanagerpb.Replication_UserManaged_Replica{{
+							Location:                  "us-east1",
+							CustomerManagedEncryption: &secretmanagerpb.CustomerManagedEncryption{KmsKeyName: keyName},
+						}},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent:  encrypted.Name,
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte("sealed")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	client, stop = start()
+	defer stop()
+
+	// Everything reads back exactly as it was before the restart
+	got, err := client.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{Name: secret.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, secret) {
+		t.Fatalf("expected %v, got %v", secret, got)
+	}
+	for _, version := range versions {
+		got, err := client.GetSecretVersion(ctx, &secretmanagerpb.GetSecretVersionRequest{Name: version.Name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(got, version) {
+			t.Fatalf("expected %v, got %v", version, got)
+		}
+	}
+	gotPolicy, err := client.GetIamPolicy(ctx, &iampb.GetIamPolicyRequest{Resource: secret.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(gotPolicy, policy) {
+		t.Fatalf("expected %v, got %v", policy, gotPolicy)
+	}
+
+	// Payloads survive, including encrypted ones and access through aliases
+	for name, want := range map[string]string{
+		secret.Name + "/versions/current":   "one",
+		encrypted.Name + "/versions/latest": "sealed",
+	} {
+		resp, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Payload.Data) != want {
+			t.Fatalf("expected %s from %s, got %s", want, name, resp.Payload.Data)
+		}
+	}
+
+	// The version counter carries on where it left off
+	next, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent:  secret.Name,
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte("four")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(next.Name, "/versions/4") {
+		t.Fatalf("expected version 4, got %s", next.Name)
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	gsm, err := gsmtest.New(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFlow(t, gsm, gsm.GRPCClient)
+}
+
+func TestGRPCMem(t *testing.T) {
+	gsm, err := gsmtest.New(t, gsmtest.InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFlow(t, gsm, gsm.GRPCClient)
 }
 
 func TestPersistent(t *testing.T) {
@@ -33,7 +321,7 @@ func TestPersistent(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	testFlow(t, gsm)
+	testFlow(t, gsm, gsm.Client)
 
 	b, err := os.ReadFile(path)
 	if err != nil {
@@ -44,15 +332,91 @@ func TestPersistent(t *testing.T) {
 	}
 }
 
-func testFlow(t testing.TB, gsm *gsmtest.SecretManager) {
+func TestNewFailureReleasesAddr(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	_ = lis.Close()
+
+	// Encryption without persistent storage fails after the options are read
+	if _, err := gsmtest.New(t, gsmtest.Addr(addr), gsmtest.StorageEncryption(gsmtest.StorageKey{Passphrase: "hunter2"})); err == nil {
+		t.Fatal("expected New to fail")
+	}
+	lis, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("expected %s to be free after New failed: %v", addr, err)
+	}
+	_ = lis.Close()
+}
+
+func TestParallel(t *testing.T) {
+	gsm, err := gsmtest.New(t, gsmtest.InMemory(), gsmtest.StorageFile(filepath.Join(t.TempDir(), "storage.json")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	t.Cleanup(cancel)
 	go func() { _ = gsm.Start(ctx) }()
 
 	client, err := gsm.Client(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	// Subtests share the emulator and its storage, as parallel suites do
+	for _, id := range []string{"a", "b", "c", "d"} {
+		t.Run(id, func(t *testing.T) {
+			t.Parallel()
+
+			secret, err := client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+				Parent:   "projects/foo",
+				SecretId: id,
+				Secret:   &secretmanagerpb.Secret{Labels: map[string]string{"suite": id}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for range 3 {
+				version, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+					Parent:  secret.Name,
+					Payload: &secretmanagerpb.SecretPayload{Data: []byte(id)},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: version.Name})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(resp.Payload.Data) != id {
+					t.Fatalf("expected %s, got %s", id, resp.Payload.Data)
+				}
+			}
+			it := client.ListSecrets(ctx, &secretmanagerpb.ListSecretsRequest{Parent: "projects/foo"})
+			for {
+				if _, err := it.Next(); errors.Is(err, iterator.Done) {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func testFlow(t testing.TB, gsm *gsmtest.SecretManager, connect func(context.Context) (*secretmanager.Client, error)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = gsm.Start(ctx) }()
+
+	client, err := connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer func() { _ = client.Close() }()
 
 	// Create an initial secret
@@ -67,13 +431,17 @@ func testFlow(t testing.TB, gsm *gsmtest.SecretManager) {
 
 	// Append a new version
 	data := []byte("shhhh")
+	crc := int64(crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
 	version, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
 		Parent:  secret.Name,
-		Payload: &secretmanagerpb.SecretPayload{Data: data},
+		Payload: &secretmanagerpb.SecretPayload{Data: data, DataCrc32C: &crc},
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !version.ClientSpecifiedPayloadChecksum {
+		t.Fatal("expected the version to record the client-specified checksum")
+	}
 
 	// Confirm we receive the same version out
 	resp, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
@@ -86,4 +454,615 @@ func testFlow(t testing.TB, gsm *gsmtest.SecretManager) {
 	if !slices.Equal(data, resp.Payload.Data) {
 		t.Fatalf("expected %s, got %s", data, resp.Payload.Data)
 	}
+	if resp.Payload.GetDataCrc32C() != crc {
+		t.Fatalf("expected dataCrc32c %d, got %d", crc, resp.Payload.GetDataCrc32C())
+	}
+
+	// The latest alias resolves to the version we just added
+	latest, err := client.GetSecretVersion(ctx, &secretmanagerpb.GetSecretVersionRequest{
+		Name: secret.Name + "/versions/latest",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Name != version.Name || latest.State != secretmanagerpb.SecretVersion_ENABLED {
+		t.Fatalf("expected enabled %s, got %s in state %s", version.Name, latest.Name, latest.State)
+	}
+
+	// Relabel the secret through an update mask
+	updated, err := client.UpdateSecret(ctx, &secretmanagerpb.UpdateSecretRequest{
+		Secret: &secretmanagerpb.Secret{
+			Name:   secret.Name,
+			Labels: map[string]string{"env": "test"},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"labels"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Labels["env"] != "test" {
+		t.Fatalf("expected label env=test, got %v", updated.Labels)
+	}
+
+	// Updating with the etag from before the relabel must lose the race
+	_, err = client.UpdateSecret(ctx, &secretmanagerpb.UpdateSecretRequest{
+		Secret: &secretmanagerpb.Secret{
+			Name:   secret.Name,
+			Labels: map[string]string{"env": "stale"},
+			Etag:   secret.Etag,
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"labels"}},
+	})
+	// REST reports the failed precondition as a 400
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if apiErr.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for a stale etag, got %v", err)
+		}
+	} else if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition for a stale etag, got %v", err)
+	}
+
+	// Pin an alias to the version and access it by name
+	updated, err = client.UpdateSecret(ctx, &secretmanagerpb.UpdateSecretRequest{
+		Secret: &secretmanagerpb.Secret{
+			Name:           secret.Name,
+			VersionAliases: map[string]int64{"current": 1},
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"version_aliases"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.VersionAliases["current"] != 1 {
+		t.Fatalf("expected alias current=1, got %v", updated.VersionAliases)
+	}
+	aliased, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{
+		Name: secret.Name + "/versions/current",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(aliased.Name, "/versions/1") {
+		t.Fatalf("expected alias to resolve to version 1, got %s", aliased.Name)
+	}
+}
+
+func TestLocations(t *testing.T) {
+	gsm, err := gsmtest.New(t, gsmtest.InMemory(), gsmtest.Locations("us-east1", "europe-west1", "asia-east1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testLocations(t, gsm, gsm.Client)
+}
+
+func TestGRPCLocations(t *testing.T) {
+	gsm, err := gsmtest.New(t, gsmtest.InMemory(), gsmtest.Locations("us-east1", "europe-west1", "asia-east1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testLocations(t, gsm, gsm.GRPCClient)
+}
+
+func testLocations(t *testing.T, gsm *gsmtest.SecretManager, connect func(context.Context) (*secretmanager.Client, error)) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = gsm.Start(ctx) }()
+
+	client, err := connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	var ids []string
+	it := client.ListLocations(ctx, &locationpb.ListLocationsRequest{Name: "projects/foo", PageSize: 2})
+	for {
+		loc, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, loc.LocationId)
+	}
+	if expected := []string{"asia-east1", "europe-west1", "us-east1"}; !slices.Equal(ids, expected) {
+		t.Fatalf("expected %v, got %v", expected, ids)
+	}
+
+	loc, err := client.GetLocation(ctx, &locationpb.GetLocationRequest{Name: "projects/foo/locations/us-east1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.DisplayName != "South Carolina" {
+		t.Fatalf("expected display name South Carolina, got %q", loc.DisplayName)
+	}
+
+	if _, err := client.GetLocation(ctx, &locationpb.GetLocationRequest{Name: "projects/foo/locations/us-west1"}); err == nil {
+		t.Fatal("expected locations outside the catalog to be unknown")
+	}
+
+	_, err = client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/foo/locations/us-west1",
+		SecretId: "bar",
+		Secret:   &secretmanagerpb.Secret{},
+	})
+	if err == nil {
+		t.Fatal("expected regional secret outside the catalog to be rejected")
+	}
+}
+
+func TestIamPolicy(t *testing.T) {
+	gsm, err := gsmtest.New(t, gsmtest.InMemory(), gsmtest.EnforceIAM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testIamPolicy(t, gsm, gsm.ClientAs)
+}
+
+func TestGRPCIamPolicy(t *testing.T) {
+	gsm, err := gsmtest.New(t, gsmtest.InMemory(), gsmtest.EnforceIAM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testIamPolicy(t, gsm, gsm.GRPCClientAs)
+}
+
+func testIamPolicy(t *testing.T, gsm *gsmtest.SecretManager, connectAs func(context.Context, string) (*secretmanager.Client, error)) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = gsm.Start(ctx) }()
+
+	client, err := connectAs(ctx, gsmtest.Admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	secret, err := client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/foo",
+		SecretId: "bar",
+		Secret:   &secretmanagerpb.Secret{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	empty, err := client.GetIamPolicy(ctx, &iampb.GetIamPolicyRequest{Resource: secret.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const member = "serviceAccount:app@foo.iam.gserviceaccount.com"
+	policy, err := client.SetIamPolicy(ctx, &iampb.SetIamPolicyRequest{
+		Resource: secret.Name,
+		Policy: &iampb.Policy{
+			Etag: empty.Etag,
+			Bindings: []*iampb.Binding{{
+				Role:    "roles/secretmanager.secretAccessor",
+				Members: []string{member},
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Equal(policy.Etag, empty.Etag) {
+		t.Fatal("expected setting a policy to change its etag")
+	}
+
+	// Writing with the stale etag loses the race
+	_, err = client.SetIamPolicy(ctx, &iampb.SetIamPolicyRequest{
+		Resource: secret.Name,
+		Policy:   &iampb.Policy{Etag: empty.Etag},
+	})
+	if err == nil {
+		t.Fatal("expected a stale etag to be rejected")
+	}
+
+	got, err := client.GetIamPolicy(ctx, &iampb.GetIamPolicyRequest{Resource: secret.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Bindings) != 1 || !slices.Equal(got.Bindings[0].Members, []string{member}) {
+		t.Fatalf("expected binding for %s, got %v", member, got.Bindings)
+	}
+
+	if _, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent:  secret.Name,
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte("baz")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	app, err := connectAs(ctx, member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = app.Close() }()
+	if _, err := app.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: secret.Name + "/versions/latest"}); err != nil {
+		t.Fatalf("expected the accessor to read the payload, got %v", err)
+	}
+	if _, err := app.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{Name: secret.Name}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied beyond the accessor role, got %v", err)
+	}
+
+	// Forgetting to identify the caller does not bypass enforcement
+	anonymous, err := connectAs(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = anonymous.Close() }()
+	if _, err := anonymous.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: secret.Name + "/versions/latest"}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Unauthenticated, got %v", err)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	// Stand in for the Pub/Sub emulator to check the REST protocol
+	var mu sync.Mutex
+	var published []string
+	pubsub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Messages []struct {
+				Data       []byte            `json:"data"`
+				Attributes map[string]string `json:"attributes"`
+			} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, msg := range req.Messages {
+			published = append(published, r.URL.Path+" "+msg.Attributes["eventType"])
+		}
+		_, _ = w.Write([]byte(`{"messageIds": ["1"]}`))
+	}))
+	defer pubsub.Close()
+
+	gsm, err := gsmtest.New(t, gsmtest.InMemory(), gsmtest.PubSubHost(pubsub.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = gsm.Start(ctx) }()
+
+	client, err := gsm.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	secret, err := client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/foo",
+		SecretId: "bar",
+		Secret: &secretmanagerpb.Secret{
+			Topics: []*secretmanagerpb.Topic{{Name: "projects/foo/topics/secrets"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent:  secret.Name,
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte("shhhh")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.DisableSecretVersion(ctx, &secretmanagerpb.DisableSecretVersionRequest{Name: version.Name}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DeleteSecret(ctx, &secretmanagerpb.DeleteSecretRequest{Name: secret.Name}); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := gsm.Messages()
+	var types []string
+	for _, msg := range messages {
+		types = append(types, msg.Attributes["eventType"])
+	}
+	want := []string{"SECRET_CREATE", "SECRET_VERSION_ADD", "SECRET_VERSION_DISABLE", "SECRET_DELETE"}
+	if !slices.Equal(types, want) {
+		t.Fatalf("expected events %v, got %v", want, types)
+	}
+
+	added := messages[1]
+	if added.Topic != "projects/foo/topics/secrets" || added.Attributes["secretId"] != secret.Name ||
+		added.Attributes["versionId"] != version.Name || added.Attributes["dataFormat"] != "JSON" {
+		t.Fatalf("unexpected SECRET_VERSION_ADD message: %+v", added)
+	}
+	var data map[string]any
+	if err := json.Unmarshal(added.Data, &data); err != nil || data["name"] != version.Name {
+		t.Fatalf("expected version JSON as message data, got %s", added.Data)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(published) != len(want) || published[0] != "/v1/projects/foo/topics/secrets:publish SECRET_CREATE" {
+		t.Fatalf("expected every message to reach the Pub/Sub host, got %v", published)
+	}
+}
+
+func TestCustomerManagedEncryption(t *testing.T) {
+	const keyName = "projects/foo/locations/global/keyRings/ring/cryptoKeys/key"
+
+	gsm, err := gsmtest.New(t, gsmtest.InMemory(), gsmtest.KMSKeys(keyName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = gsm.Start(ctx) }()
+
+	client, err := gsm.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	secret, err := client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/foo",
+		SecretId: "bar",
+		Secret: &secretmanagerpb.Secret{
+			Replication: &secretmanagerpb.Replication{
+				Replication: &secretmanagerpb.Replication_Automatic_{
+					Automatic: &secretmanagerpb.Replication_Automatic{
+						CustomerManagedEncryption: &secretmanagerpb.CustomerManagedEncryption{KmsKeyName: keyName},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+		Parent:  secret.Name,
+		Payload: &secretmanagerpb.SecretPayload{Data: []byte("shhhh")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyVersion := keyName + "/cryptoKeyVersions/1"
+	if got := version.GetCustomerManagedEncryption().GetKmsKeyVersionName(); got != keyVersion {
+		t.Fatalf("expected key version %s, got %q", keyVersion, got)
+	}
+
+	// Revoking the key makes the version unreadable
+	if err := gsm.SetKeyVersionState(keyVersion, gsmtest.KeyDisabled); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: version.Name})
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a disabled key, got %v", err)
+	}
+
+	if err := gsm.SetKeyVersionState(keyVersion, gsmtest.KeyEnabled); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: version.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Payload.Data) != "shhhh" {
+		t.Fatalf("expected shhhh, got %s", resp.Payload.Data)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	gsm, err := gsmtest.New(t, gsmtest.InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = gsm.Start(ctx) }()
+
+	client, err := gsm.Client(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	_, err = client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{
+		Parent:   "projects/foo",
+		SecretId: "bar",
+		Secret:   &secretmanagerpb.Secret{Labels: map[string]string{"Env": "prod"}},
+	})
+	var apiErr *apierror.APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an API error, got %v", err)
+	}
+	violations := apiErr.Details().BadRequest.GetFieldViolations()
+	if len(violations) != 1 || violations[0].GetField() != "secret.labels[Env]" {
+		t.Fatalf("expected a violation for secret.labels[Env], got %v", violations)
+	}
+}
+
+func TestGRPCErrorCodes(t *testing.T) {
+	const keyName = "projects/foo/locations/global/keyRings/ring/cryptoKeys/key"
+
+	gsm, err := gsmtest.New(t, gsmtest.InMemory(), gsmtest.KMSKeys(keyName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = gsm.Start(ctx) }()
+
+	client, err := gsm.GRPCClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+
+	createSecret := func(id string, secret *secretmanagerpb.Secret) *secretmanagerpb.Secret {
+		t.Helper()
+		created, err := client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{Parent: "projects/foo", SecretId: id, Secret: secret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return created
+	}
+	addVersion := func(parent string) *secretmanagerpb.SecretVersion {
+		t.Helper()
+		version, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+			Parent:  parent,
+			Payload: &secretmanagerpb.SecretPayload{Data: []byte("shhhh")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return version
+	}
+
+	secret := createSecret("bar", &secretmanagerpb.Secret{})
+	disabled := addVersion(secret.Name)
+	if _, err := client.DisableSecretVersion(ctx, &secretmanagerpb.DisableSecretVersionRequest{Name: disabled.Name}); err != nil {
+		t.Fatal(err)
+	}
+	destroyed := addVersion(secret.Name)
+	if _, err := client.DestroySecretVersion(ctx, &secretmanagerpb.DestroySecretVersionRequest{Name: destroyed.Name}); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := createSecret("encrypted", &secretmanagerpb.Secret{
+		Replication: &secretmanagerpb.Replication{
+			Replication: &secretmanagerpb.Replication_Automatic_{
+				Automatic: &secretmanagerpb.Replication_Automatic{
+					CustomerManagedEncryption: &secretmanagerpb.CustomerManagedEncryption{KmsKeyName: keyName},
+				},
+			},
+		},
+	})
+	if err := gsm.SetKeyVersionState(keyName+"/cryptoKeyVersions/1", gsmtest.KeyDisabled); err != nil {
+		t.Fatal(err)
+	}
+	unknownKey := createSecret("unknown-key", &secretmanagerpb.Secret{
+		Replication: &secretmanagerpb.Replication{
+			Replication: &secretmanagerpb.Replication_Automatic_{
+				Automatic: &secretmanagerpb.Replication_Automatic{
+					CustomerManagedEncryption: &secretmanagerpb.CustomerManagedEncryption{KmsKeyName: "projects/foo/locations/global/keyRings/ring/cryptoKeys/missing"},
+				},
+			},
+		},
+	})
+	topics := createSecret("topics", &secretmanagerpb.Secret{
+		Topics: []*secretmanagerpb.Topic{{Name: "projects/foo/topics/rotations"}},
+	})
+
+	badCrc := int64(1)
+	tests := []struct {
+		name string
+		call func() error
+		want codes.Code
+	}{
+		{"ErrSecretNotFound", func() error {
+			_, err := client.GetSecret(ctx, &secretmanagerpb.GetSecretRequest{Name: "projects/foo/secrets/missing"})
+			return err
+		}, codes.NotFound},
+		{"ErrVersionNotFound", func() error {
+			_, err := client.GetSecretVersion(ctx, &secretmanagerpb.GetSecretVersionRequest{Name: secret.Name + "/versions/9"})
+			return err
+		}, codes.NotFound},
+		{"ErrSecretExists", func() error {
+			_, err := client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{Parent: "projects/foo", SecretId: "bar", Secret: &secretmanagerpb.Secret{}})
+			return err
+		}, codes.AlreadyExists},
+		{"ErrVersionDisabled", func() error {
+			_, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: disabled.Name})
+			return err
+		}, codes.FailedPrecondition},
+		{"ErrVersionDestroyed", func() error {
+			_, err := client.EnableSecretVersion(ctx, &secretmanagerpb.EnableSecretVersionRequest{Name: destroyed.Name})
+			return err
+		}, codes.FailedPrecondition},
+		{"ErrInvalidPageToken", func() error {
+			_, err := client.ListSecrets(ctx, &secretmanagerpb.ListSecretsRequest{Parent: "projects/foo", PageToken: "bogus"}).Next()
+			return err
+		}, codes.InvalidArgument},
+		{"ErrEtagMismatch", func() error {
+			return client.DeleteSecret(ctx, &secretmanagerpb.DeleteSecretRequest{Name: secret.Name, Etag: `"stale"`})
+		}, codes.FailedPrecondition},
+		{"ErrRotationWithoutTopics", func() error {
+			_, err := client.UpdateSecret(ctx, &secretmanagerpb.UpdateSecretRequest{
+				Secret: &secretmanagerpb.Secret{
+					Name:     secret.Name,
+					Rotation: &secretmanagerpb.Rotation{NextRotationTime: timestamppb.New(time.Now().Add(time.Hour))},
+				},
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"rotation"}},
+			})
+			return err
+		}, codes.InvalidArgument},
+		{"ErrRotationWithoutTime", func() error {
+			_, err := client.UpdateSecret(ctx, &secretmanagerpb.UpdateSecretRequest{
+				Secret: &secretmanagerpb.Secret{
+					Name:     topics.Name,
+					Rotation: &secretmanagerpb.Rotation{RotationPeriod: durationpb.New(2 * time.Hour)},
+				},
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"rotation"}},
+			})
+			return err
+		}, codes.InvalidArgument},
+		{"ErrChecksumMismatch", func() error {
+			_, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+				Parent:  secret.Name,
+				Payload: &secretmanagerpb.SecretPayload{Data: []byte("shhhh"), DataCrc32C: &badCrc},
+			})
+			return err
+		}, codes.InvalidArgument},
+		{"VersionAliasError", func() error {
+			_, err := client.UpdateSecret(ctx, &secretmanagerpb.UpdateSecretRequest{
+				Secret:     &secretmanagerpb.Secret{Name: secret.Name, VersionAliases: map[string]int64{"current": 9}},
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"version_aliases"}},
+			})
+			return err
+		}, codes.InvalidArgument},
+		{"kms.NotFoundError", func() error {
+			_, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+				Parent:  unknownKey.Name,
+				Payload: &secretmanagerpb.SecretPayload{Data: []byte("shhhh")},
+			})
+			return err
+		}, codes.FailedPrecondition},
+		{"kms.StateError", func() error {
+			_, err := client.AddSecretVersion(ctx, &secretmanagerpb.AddSecretVersionRequest{
+				Parent:  encrypted.Name,
+				Payload: &secretmanagerpb.SecretPayload{Data: []byte("shhhh")},
+			})
+			return err
+		}, codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := status.Code(tt.call()); got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	// Field violations arrive as status details
+	_, err = client.CreateSecret(ctx, &secretmanagerpb.CreateSecretRequest{Parent: "projects/foo", SecretId: "bad id", Secret: &secretmanagerpb.Secret{}})
+	var apiErr *apierror.APIError
+	if !errors.As(err, &apiErr) || apiErr.GRPCStatus().Code() != codes.InvalidArgument {
+		t.Fatalf("expected an InvalidArgument API error, got %v", err)
+	}
+	if violations := apiErr.Details().BadRequest.GetFieldViolations(); len(violations) != 1 || violations[0].GetField() != "secret_id" {
+		t.Fatalf("expected a violation for secret_id, got %v", violations)
+	}
 }
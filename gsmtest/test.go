@@ -18,15 +18,24 @@ import (
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"github.com/akutz/memconn"
+	"github.com/charlesgreen/gsm/internal/api/grpcapi"
+	"github.com/charlesgreen/gsm/internal/api/handlers"
 	"github.com/charlesgreen/gsm/internal/api/routes"
+	"github.com/charlesgreen/gsm/internal/kms"
+	"github.com/charlesgreen/gsm/internal/locations"
+	"github.com/charlesgreen/gsm/internal/notify"
+	"github.com/charlesgreen/gsm/internal/scheduler"
 	"github.com/charlesgreen/gsm/internal/storage"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 )
 
 // Option configures the emulator created by New.
 type Option func(*options)
 
-// StorageFile enables persistent secret storage using a file path
+// StorageFile enables persistent secret storage using a file path.
 //
 // Previous values are consumed from the file if they exist.
 func StorageFile(path string) Option {
@@ -35,6 +44,105 @@ func StorageFile(path string) Option {
 	}
 }
 
+// StorageJournal enables persistent secret storage that appends each change to
+// a journal at path with a .journal suffix, compacted into a snapshot at path.
+//
+// Previous values are replayed from the snapshot and journal if they exist.
+func StorageJournal(path string) Option {
+	return func(o *options) {
+		o.storageFile = path
+		o.journal = true
+	}
+}
+
+// StorageKey selects the key a [StorageFile] or [StorageJournal] is encrypted
+// with: a key file, a passphrase, or a simulated Cloud KMS key, as with the
+// emulator's GSM_STORAGE_KEY_FILE, GSM_STORAGE_PASSPHRASE and
+// GSM_STORAGE_KMS_KEY settings. Loading a file with the wrong key fails [New].
+// A KMS key needs the keys kept in a [KMSFile].
+type StorageKey = storage.KeyConfig
+
+// StorageEncryption encrypts the [StorageFile] or [StorageJournal] at rest with
+// key. [New] fails if key selects no key, or if storage is not persistent.
+func StorageEncryption(key StorageKey) Option {
+	return func(o *options) {
+		o.storageKey = &key
+	}
+}
+
+// FlushDelay batches changes to the [StorageFile] into background writes made
+// at most dur after the first change, instead of writing before each request
+// returns. Pending changes are written when the server stops.
+//
+// Defaults to 0, writing every change before responding
+func FlushDelay(dur time.Duration) Option {
+	return func(o *options) {
+		o.flushDelay = dur
+	}
+}
+
+// Locations limits the locations the emulator offers through the Locations API
+// and accepts for regional secrets and user-managed replicas.
+//
+// Defaults to the standard Google Cloud regions
+func Locations(ids ...string) Option {
+	return func(o *options) {
+		o.locations = ids
+	}
+}
+
+// Admin is the principal the clients from Client and GRPCClient act as. It
+// holds every permission regardless of policy, so tests can create fixtures and
+// grant roles before acting as another principal through ClientAs.
+const Admin = "user:admin@gsmtest.local"
+
+// EnforceIAM requires callers to hold the IAM permission each method needs.
+// Anonymous requests are rejected as UNAUTHENTICATED.
+func EnforceIAM() Option {
+	return func(o *options) {
+		o.enforceIAM = true
+	}
+}
+
+// SchedulerInterval sets how often background work, such as deleting expired
+// secrets and firing rotations, runs while the server is started.
+//
+// Defaults to 1s
+func SchedulerInterval(dur time.Duration) Option {
+	return func(o *options) {
+		o.schedulerInterval = dur
+	}
+}
+
+// PubSubHost publishes notifications for secrets with topics to the Pub/Sub
+// REST API at host, such as the official Pub/Sub emulator, in addition to
+// recording them for [SecretManager.Messages].
+func PubSubHost(host string) Option {
+	return func(o *options) {
+		o.pubsubHost = host
+	}
+}
+
+// KMSKeys registers simulated Cloud KMS keys, given as crypto key resource
+// names, that secrets can use for customer-managed encryption. Each key starts
+// with one enabled version. Use [SecretManager.SetKeyVersionState] or the
+// /kms/v1/ admin endpoints to revoke them.
+func KMSKeys(names ...string) Option {
+	return func(o *options) {
+		o.kmsKeys = append(o.kmsKeys, names...)
+	}
+}
+
+// KMSFile keeps the simulated Cloud KMS keys, and their random material, in a
+// file at path, as the emulator's GSM_KMS_FILE setting does. Keys already saved
+// there are loaded, so a [StorageKey] with a KMS key can be read back by a
+// later instance.
+func KMSFile(path string) Option {
+	return func(o *options) {
+		o.kmsFile = path
+	}
+}
+
 // Listener overrides where requests are served from.
 func Listener(lis net.Listener) Option {
 	return func(o *options) {
@@ -76,25 +184,58 @@ func New(t testing.TB, opts ...Option) (*SecretManager, error) {
 		o(&options)
 	}
 
+	keys := kms.NewRegistry()
+	if options.kmsFile != "" {
+		var err error
+		if keys, err = kms.Open(options.kmsFile); err != nil {
+			return nil, fmt.Errorf("opening KMS keys: %w", err)
+		}
+	}
+	for _, name := range options.kmsKeys {
+		if _, err := keys.CreateKey(name); err != nil && err != kms.ErrKeyExists {
+			return nil, fmt.Errorf("creating key %s: %w", name, err)
+		}
+	}
+
+	store, err := options.createStore(t, keys)
+	if err != nil {
+		return nil, fmt.Errorf("creating store: %w", err)
+	}
+
+	// The listener comes last, so that nothing else can fail and leave it open
 	lis, err := options.createListener()
 	if err != nil {
+		_ = store.Close()
 		return nil, fmt.Errorf("creating listener: %w", err)
 	}
 
-	store, err := options.createStore(t)
-	if err != nil {
-		return nil, fmt.Errorf("creating store: %w", err)
+	// Every notification is recorded for Messages, and also published to a real
+	// Pub/Sub emulator when one is configured.
+	recorder := &notify.Recorder{}
+	notifier := notify.Topics(recorder)
+	if options.pubsubHost != "" {
+		notifier = notify.Multi(notifier, notify.Topics(notify.NewRESTPublisher(options.pubsubHost, nil)))
 	}
 
+	routeOptions := append(options.routeOptions(), routes.Notifier(notifier), routes.KeyRegistry(keys))
+	router := routes.SetupRoutes(store, routeOptions...)
 	srv := &http.Server{
-		Handler:           routes.SetupRoutes(store),
+		Handler:           grpcapi.Handler(router, routes.SetupGRPC(store, routeOptions...)),
+		Protocols:         grpcapi.Protocols(),
 		ReadHeaderTimeout: 10 * time.Second,
 	}
+	sched := scheduler.New(options.schedulerInterval)
+	sched.Add("expire secrets", scheduler.ExpireSecrets(store, notifier))
+	sched.Add("rotate secrets", scheduler.RotateSecrets(store, notifier))
+	sched.Add("destroy versions", scheduler.DestroyScheduledVersions(store, notifier))
 	return &SecretManager{
 		tb:              t,
 		srv:             srv,
 		lis:             lis,
 		store:           store,
+		keys:            keys,
+		scheduler:       sched,
+		recorder:        recorder,
 		shutdownTimeout: cmp.Or(options.shutdownTimeout, time.Second),
 	}, nil
 }
@@ -106,11 +247,47 @@ type SecretManager struct {
 	srv             *http.Server
 	lis             net.Listener
 	store           storage.Storage
+	keys            *kms.Registry
+	scheduler       *scheduler.Scheduler
+	recorder        *notify.Recorder
 	shutdownTimeout time.Duration
 }
 
+// Message is a Pub/Sub notification the emulator published to one of a
+// secret's topics.
+type Message = notify.Message
+
+// Messages returns the notifications published so far, in order. Secrets only
+// produce notifications when they list topics.
+func (s *SecretManager) Messages() []Message {
+	return s.recorder.Messages()
+}
+
+// KeyState is the state of a simulated Cloud KMS key version.
+type KeyState = kms.State
+
+// Key version states accepted by [SecretManager.SetKeyVersionState].
+const (
+	KeyEnabled   = kms.Enabled
+	KeyDisabled  = kms.Disabled
+	KeyDestroyed = kms.Destroyed
+)
+
+// SetKeyVersionState enables, disables or destroys a version of a key
+// registered with [KMSKeys], given as a crypto key version resource name such
+// as ".../cryptoKeys/my-key/cryptoKeyVersions/1". Versions encrypted with a key
+// version that is not enabled fail to be added or accessed.
+func (s *SecretManager) SetKeyVersionState(name string, state KeyState) error {
+	_, err := s.keys.SetKeyVersionState(name, state)
+	return err
+}
+
 // Start the server and block until finished. The context is used for cancellation.
+// Once requests have drained, the store is closed so that pending changes are
+// written to the [StorageFile].
 func (s *SecretManager) Start(ctx context.Context) error {
+	go s.scheduler.Run(ctx)
+
 	// Shut the server down when the context is canceled. The channel is blocked until
 	// all in-flight requests have finished processing.
 	done := make(chan struct{})
@@ -136,7 +313,7 @@ func (s *SecretManager) Start(ctx context.Context) error {
 	// Wait until graceful shutdown is complete before exiting
 	if errors.Is(err, http.ErrServerClosed) {
 		<-done
-		return nil
+		return s.store.Close()
 	}
 	return err
 }
@@ -151,39 +328,100 @@ func (s *SecretManager) Endpoint() string {
 	return "http://" + s.Addr()
 }
 
-// Client connected to the local emulator
+// Client connected to the local emulator, acting as Admin
 func (s *SecretManager) Client(ctx context.Context) (*secretmanager.Client, error) {
+	return s.ClientAs(ctx, Admin)
+}
+
+// ClientAs connects to the local emulator as principal, a member string such
+// as "serviceAccount:app@project.iam.gserviceaccount.com", for testing IAM
+// policies under EnforceIAM. An empty principal makes anonymous requests.
+func (s *SecretManager) ClientAs(ctx context.Context, principal string) (*secretmanager.Client, error) {
+	transport := &http.Transport{}
 	if _, ok := s.lis.(*memconn.Listener); ok {
-		return s.memClient(ctx)
+		dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return memconn.DialContext(ctx, "memu", s.Addr())
+		}
+		// All other HTTP options are ignored when providing a custom client, so we
+		// need to ignore https ourselves.
+		transport.DialContext, transport.DialTLSContext = dial, dial
 	}
-	return secretmanager.NewRESTClient(
-		ctx,
-		option.WithoutAuthentication(),
-		option.WithEndpoint(s.Endpoint()),
-	)
+	client := &http.Client{Transport: principalTransport{principal: principal, next: transport}}
+	return secretmanager.NewRESTClient(ctx, option.WithHTTPClient(client), option.WithEndpoint(s.Endpoint()))
+}
+
+// principalTransport identifies requests as principal.
+type principalTransport struct {
+	principal string
+	next      http.RoundTripper
+}
+
+func (t principalTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.principal != "" {
+		r = r.Clone(r.Context())
+		r.Header.Set(handlers.PrincipalHeader, t.principal)
+	}
+	return t.next.RoundTrip(r)
+}
+
+// GRPCClient connected to the local emulator over gRPC, the transport the
+// official client libraries use by default, acting as Admin. It is served on
+// the same address as the REST API.
+func (s *SecretManager) GRPCClient(ctx context.Context) (*secretmanager.Client, error) {
+	return s.GRPCClientAs(ctx, Admin)
 }
 
-func (s *SecretManager) memClient(ctx context.Context) (*secretmanager.Client, error) {
-	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
-		return memconn.DialContext(ctx, "memu", s.Addr())
+// GRPCClientAs connects to the local emulator over gRPC as principal, like
+// [SecretManager.ClientAs]. An empty principal makes anonymous calls.
+func (s *SecretManager) GRPCClientAs(ctx context.Context, principal string) (*secretmanager.Client, error) {
+	opts := []option.ClientOption{
+		option.WithEndpoint("passthrough:///" + s.Addr()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	}
+	if principal != "" {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			return invoker(metadata.AppendToOutgoingContext(ctx, handlers.PrincipalHeader, principal), method, req, reply, cc, opts...)
+		})))
 	}
-	client := &http.Client{
-		Transport: &http.Transport{
-			DialContext: dial,
-			// All other HTTP options are ignored when providing a custom client, so we
-			// need to ignore https ourselves.
-			DialTLSContext: dial,
-		},
+	if _, ok := s.lis.(*memconn.Listener); ok {
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return memconn.DialContext(ctx, "memu", addr)
+		})))
 	}
-	return secretmanager.NewRESTClient(ctx, option.WithHTTPClient(client))
+	return secretmanager.NewClient(ctx, opts...)
 }
 
 type options struct {
-	addr            string
-	inMemory        bool
-	listener        net.Listener
-	storageFile     string
-	shutdownTimeout time.Duration
+	addr              string
+	inMemory          bool
+	listener          net.Listener
+	storageFile       string
+	storageKey        *StorageKey
+	journal           bool
+	flushDelay        time.Duration
+	locations         []string
+	enforceIAM        bool
+	schedulerInterval time.Duration
+	pubsubHost        string
+	kmsKeys           []string
+	kmsFile           string
+	shutdownTimeout   time.Duration
+}
+
+func (o options) routeOptions() []routes.Option {
+	var opts []routes.Option
+	if len(o.locations) > 0 {
+		catalog := make([]locations.Location, 0, len(o.locations))
+		for _, id := range o.locations {
+			catalog = append(catalog, locations.Location{ID: id})
+		}
+		opts = append(opts, routes.Locations(locations.NewCatalog(catalog...)))
+	}
+	if o.enforceIAM {
+		opts = append(opts, routes.EnforceIAM())
+	}
+	return append(opts, routes.IAMAdmins(Admin))
 }
 
 func (o options) createListener() (net.Listener, error) {
@@ -203,21 +441,64 @@ func (o options) createListener() (net.Listener, error) {
 	return net.Listen("tcp", "localhost:0")
 }
 
-func (o options) createStore(t testing.TB) (storage.Storage, error) {
+func (o options) createStore(t testing.TB, keys *kms.Registry) (storage.Storage, error) {
+	var storageKey storage.EncryptionKey
+	if o.storageKey != nil {
+		if o.storageFile == "" {
+			return nil, errors.New("storage encryption needs a StorageFile or StorageJournal")
+		}
+		key, err := o.storageKey.Key(keys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage key: %w", err)
+		}
+		if key == nil {
+			return nil, errors.New("invalid storage key: no key file, passphrase or KMS key set")
+		}
+		storageKey = key
+	}
+
+	if o.storageFile != "" && o.journal {
+		return journalStore(o.storageFile, keys, storageKey)
+	}
 	if o.storageFile != "" {
-		return persistentStore(t, o.storageFile)
+		store, err := persistentStore(t, o.storageFile, keys, storageKey)
+		if err != nil {
+			return nil, err
+		}
+		store.SetFlushDelay(o.flushDelay)
+		return store, nil
 	}
 
-	return storage.NewMemoryStorage(), nil
+	store := storage.NewMemoryStorage()
+	store.SetKeyRegistry(keys)
+	return store, nil
 }
 
-func persistentStore(t testing.TB, path string) (*storage.PersistentStorage, error) {
+func persistentStore(t testing.TB, path string, keys *kms.Registry, key storage.EncryptionKey) (*storage.PersistentStorage, error) {
 	store, err := storage.NewPersistentStorage(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create persistent storage: %w", err)
 	}
+	store.SetKeyRegistry(keys)
+	store.SetEncryptionKey(key)
 	if err := store.Load(); err != nil {
+		if storage.IsFatalLoadError(err, key) {
+			return nil, fmt.Errorf("failed to load storage: %w", err)
+		}
 		t.Logf("warning: failed loading existing storage: %v", err)
 	}
 	return store, nil
 }
+
+func journalStore(path string, keys *kms.Registry, key storage.EncryptionKey) (*storage.JournalStorage, error) {
+	store, err := storage.NewJournalStorage(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journal storage: %w", err)
+	}
+	store.SetKeyRegistry(keys)
+	store.SetEncryptionKey(key)
+	if err := store.Load(); err != nil {
+		return nil, fmt.Errorf("failed to load journal storage: %w", err)
+	}
+	return store, nil
+}
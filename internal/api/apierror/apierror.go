@@ -0,0 +1,73 @@
+// Package apierror maps storage errors onto the errors the REST and gRPC APIs
+// report for them, so both transports answer a failed call with the same
+// canonical status and message.
+package apierror
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/charlesgreen/gsm/internal/kms"
+	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/storage"
+	"github.com/charlesgreen/gsm/internal/validation"
+)
+
+// Storage returns the error to report for err, returned by storage for a
+// secret, or for one of its versions when versionID is set. It returns nil for
+// errors without a response of their own, which callers report as internal.
+func Storage(ctx context.Context, store storage.Storage, err error, projectID, secretID, versionID string) *models.ErrorDetail {
+	var notFound *kms.NotFoundError
+	var keyState *kms.StateError
+	switch {
+	case err == storage.ErrSecretNotFound:
+		return detail(http.StatusNotFound, models.FormatResourceNotFoundError("secret", projectID, secretID), "NOT_FOUND")
+	case err == storage.ErrVersionNotFound:
+		return detail(http.StatusNotFound, models.FormatResourceNotFoundError("version", projectID, secretID+"/"+versionID), "NOT_FOUND")
+	case err == storage.ErrSecretExists:
+		return detail(http.StatusConflict, models.FormatResourceExistsError("secret", projectID, secretID), "ALREADY_EXISTS")
+	case err == storage.ErrEtagMismatch && versionID == "":
+		return detail(http.StatusBadRequest, models.FormatEtagMismatchError(models.SecretName(projectID, secretID)), "FAILED_PRECONDITION")
+	case err == storage.ErrVersionDisabled, err == storage.ErrVersionDestroyed, err == storage.ErrEtagMismatch:
+		// The message names the version, which may have been given by alias
+		version, getErr := store.GetSecretVersion(ctx, projectID, secretID, versionID)
+		if getErr != nil {
+			return nil
+		}
+		if err == storage.ErrEtagMismatch {
+			return detail(http.StatusBadRequest, models.FormatEtagMismatchError(version.Name), "FAILED_PRECONDITION")
+		}
+		return detail(http.StatusBadRequest, models.FormatVersionStateError(version.Name, version.State), "FAILED_PRECONDITION")
+	case err == storage.ErrInvalidPageToken:
+		return detail(http.StatusBadRequest, "Invalid page token", "INVALID_ARGUMENT")
+	case err == storage.ErrChecksumMismatch:
+		return detail(http.StatusBadRequest, models.FormatChecksumMismatchError(models.SecretName(projectID, secretID)), "INVALID_ARGUMENT")
+	case errors.As(err, &notFound):
+		return detail(http.StatusBadRequest, models.FormatKeyNotFoundError(notFound.Name), "FAILED_PRECONDITION")
+	case errors.As(err, &keyState):
+		return detail(http.StatusBadRequest, models.FormatKeyStateError(keyState.Name, string(keyState.State)), "FAILED_PRECONDITION")
+	}
+	if message, ok := validation.InvariantMessage(err); ok {
+		return detail(http.StatusBadRequest, message, "INVALID_ARGUMENT")
+	}
+	return nil
+}
+
+// Policy returns the error to report for err, returned by storage for the
+// policy of a project or secret, or nil if it is internal. A stale etag means
+// the policy changed since it was read, so the whole read-modify-write is
+// aborted.
+func Policy(err error, projectID, secretID string) *models.ErrorDetail {
+	switch err {
+	case storage.ErrSecretNotFound:
+		return detail(http.StatusNotFound, models.FormatResourceNotFoundError("secret", projectID, secretID), "NOT_FOUND")
+	case storage.ErrEtagMismatch:
+		return detail(http.StatusConflict, models.PolicyConflictMessage, "ABORTED")
+	}
+	return nil
+}
+
+func detail(code int, message, status string) *models.ErrorDetail {
+	return &models.ErrorDetail{Code: code, Message: message, Status: status}
+}
@@ -0,0 +1,70 @@
+package grpcapi
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/charlesgreen/gsm/internal/api/apierror"
+	"github.com/charlesgreen/gsm/internal/models"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// invalidArgument returns an InvalidArgument status with message.
+func invalidArgument(message string) error {
+	return status.Error(codes.InvalidArgument, message)
+}
+
+// invalidName returns the status for a malformed resource name.
+func invalidName(name string) error {
+	return status.Errorf(codes.InvalidArgument, "Invalid resource name [%s].", name)
+}
+
+// badRequest returns an InvalidArgument status that carries the field
+// violations as google.rpc.BadRequest details next to the ErrorInfo, like
+// models.NewBadRequestResponse does for REST.
+func badRequest(violations []models.FieldViolation) error {
+	details := &errdetails.BadRequest{}
+	for _, violation := range violations {
+		details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       violation.Field,
+			Description: violation.Description,
+		})
+	}
+
+	st, err := status.New(codes.InvalidArgument, violations[0].Description).WithDetails(
+		&errdetails.ErrorInfo{Reason: "FIELD_VIOLATION", Domain: "secretmanager.googleapis.com"},
+		details,
+	)
+	if err != nil {
+		return invalidArgument(violations[0].Description)
+	}
+	return st.Err()
+}
+
+// storageError maps an error from storage for a secret, or for one of its
+// versions when versionID is set, onto a status with the message the REST API
+// reports for it.
+func (s *service) storageError(ctx context.Context, err error, projectID, secretID, versionID string) error {
+	return statusOf(apierror.Storage(ctx, s.Storage, err, projectID, secretID, versionID), err)
+}
+
+// policyError maps an error from storage for the policy of a project or secret
+// onto a status.
+func policyError(err error, projectID, secretID string) error {
+	return statusOf(apierror.Policy(err, projectID, secretID), err)
+}
+
+// statusOf converts detail to a status with the same canonical code, or to an
+// Internal status for err when detail is nil.
+func statusOf(detail *models.ErrorDetail, err error) error {
+	if detail == nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	var code codes.Code
+	if codeErr := code.UnmarshalJSON([]byte(strconv.Quote(detail.Status))); codeErr != nil {
+		code = codes.Unknown
+	}
+	return status.Error(code, detail.Message)
+}
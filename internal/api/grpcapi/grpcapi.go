@@ -0,0 +1,234 @@
+// Package grpcapi serves the Secret Manager and Locations gRPC services that
+// the official client libraries use by default.
+//
+// The services work on storage directly and share validation, IAM enforcement
+// and notifications with the REST API, so both transports accept, authorise and
+// report the same calls with the same messages. Storage errors map onto
+// canonical codes: missing secrets and versions are NotFound, duplicate secrets
+// AlreadyExists, disabled or destroyed versions, stale etags and unusable keys
+// FailedPrecondition, concurrent policy changes Aborted, and bad page tokens,
+// checksums, aliases and rotations InvalidArgument.
+package grpcapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/charlesgreen/gsm/internal/api/handlers"
+	"github.com/charlesgreen/gsm/internal/iam"
+	"github.com/charlesgreen/gsm/internal/locations"
+	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/notify"
+	"github.com/charlesgreen/gsm/internal/storage"
+	locationpb "google.golang.org/genproto/googleapis/cloud/location"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Config holds what the services are backed by.
+type Config struct {
+	// Storage holds the secrets, versions and policies.
+	Storage storage.Storage
+	// Catalog lists the locations served by the Locations service and allowed
+	// for regional secrets and replicas. Defaults to the standard Google Cloud
+	// regions.
+	Catalog *locations.Catalog
+	// Notifier receives an event for every change to a secret or version.
+	// Defaults to discarding events.
+	Notifier notify.Notifier
+	// IAM authorises calls. Defaults to allowing every call.
+	IAM *iam.Enforcer
+	// RequireAuth rejects calls without a bearer token, as the REST API does
+	// when GSM_ENABLE_AUTH is set.
+	RequireAuth bool
+}
+
+// NewServer returns a gRPC server with the Secret Manager and Locations
+// services registered.
+func NewServer(config Config) *grpc.Server {
+	if config.Catalog == nil {
+		config.Catalog = locations.Default()
+	}
+	if config.Notifier == nil {
+		config.Notifier = notify.Discard
+	}
+	if config.IAM == nil {
+		config.IAM = iam.NewEnforcer(config.Storage, false)
+	}
+
+	interceptors := []grpc.UnaryServerInterceptor{logging}
+	if config.RequireAuth {
+		interceptors = append(interceptors, requireAuth)
+	}
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(interceptors...))
+
+	s := &service{Config: config}
+	secretmanagerpb.RegisterSecretManagerServiceServer(server, &secretManagerServer{service: s})
+	locationpb.RegisterLocationsServer(server, &locationsServer{service: s})
+	return server
+}
+
+// Handler serves gRPC requests with server and passes every other request to
+// rest, so both APIs share one port. gRPC needs HTTP/2, which plain-text
+// servers only speak when configured with [Protocols].
+func Handler(rest http.Handler, server *grpc.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			server.ServeHTTP(w, r)
+			return
+		}
+		rest.ServeHTTP(w, r)
+	})
+}
+
+// Protocols returns the protocols a plain-text server needs to offer for
+// [Handler]: HTTP/1 for REST clients and unencrypted HTTP/2 (h2c) for gRPC.
+func Protocols() *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return protocols
+}
+
+// service holds what the Secret Manager and Locations servers share.
+type service struct {
+	Config
+}
+
+// authorize checks, when IAM is enforced, that the caller is identified and
+// holds permission on the project or secret named by name.
+func (s *service) authorize(ctx context.Context, permission, name, projectID, secretID string) error {
+	if !s.IAM.Enforced() {
+		return nil
+	}
+
+	principal := callerPrincipal(ctx)
+	if principal == "" {
+		return status.Error(codes.Unauthenticated, models.UnauthenticatedMessage)
+	}
+	if !s.IAM.Allowed(ctx, principal, permission, projectID, secretID) {
+		return status.Error(codes.PermissionDenied, models.FormatPermissionDeniedError(permission, name))
+	}
+	return nil
+}
+
+// callerPrincipal identifies the caller from the principal or the bearer token
+// in the request metadata, returning an empty string for anonymous calls.
+func callerPrincipal(ctx context.Context) string {
+	if values := metadata.ValueFromIncomingContext(ctx, handlers.PrincipalHeader); len(values) > 0 {
+		if principal := iam.Principal(values[0]); principal != "" {
+			return principal
+		}
+	}
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		if token, ok := strings.CutPrefix(values[0], "Bearer "); ok {
+			return iam.Principal(token)
+		}
+	}
+	return ""
+}
+
+// requireAuth rejects calls without a bearer token, with the messages of
+// middleware.MockAuth.
+func requireAuth(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	values := metadata.ValueFromIncomingContext(ctx, "authorization")
+	switch {
+	case len(values) == 0 || values[0] == "":
+		return nil, status.Error(codes.Unauthenticated, "Request is missing required authentication credential")
+	case !strings.HasPrefix(values[0], "Bearer "):
+		return nil, status.Error(codes.Unauthenticated, "Invalid authentication credentials")
+	case strings.TrimPrefix(values[0], "Bearer ") == "":
+		return nil, status.Error(codes.Unauthenticated, "Invalid authentication token")
+	}
+	return handler(ctx, req)
+}
+
+// logging logs the method, status code and duration of each call, as
+// middleware.Logging does for REST requests.
+func logging(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+
+	resp, err := handler(ctx, req)
+
+	fmt.Printf("[%s] %s %s %v\n",
+		start.Format("2006-01-02 15:04:05"),
+		info.FullMethod,
+		status.Code(err),
+		time.Since(start),
+	)
+	return resp, err
+}
+
+// parseName splits a resource name into its project ID and the IDs of the
+// given collections, such as "secrets" and "versions". A location segment
+// after the project qualifies the project ID as {project}/locations/{location},
+// which is how storage keeps regional secrets apart from global ones.
+func parseName(name string, collections ...string) (projectID string, ids []string, err error) {
+	if name == "" {
+		return "", nil, status.Error(codes.InvalidArgument, "A resource name is required.")
+	}
+	invalid := invalidName(name)
+
+	parts := strings.Split(name, "/")
+	if len(parts) < 2 || parts[0] != "projects" || parts[1] == "" {
+		return "", nil, invalid
+	}
+	projectID, parts = parts[1], parts[2:]
+
+	if len(parts) >= 2 && parts[0] == "locations" {
+		if parts[1] == "" {
+			return "", nil, invalid
+		}
+		projectID += "/locations/" + parts[1]
+		parts = parts[2:]
+	}
+
+	for _, collection := range collections {
+		if len(parts) < 2 || parts[0] != collection || parts[1] == "" {
+			return "", nil, invalid
+		}
+		ids, parts = append(ids, parts[1]), parts[2:]
+	}
+	if len(parts) > 0 {
+		return "", nil, invalid
+	}
+	return projectID, ids, nil
+}
+
+// Requests and responses are converted to and from the models through JSON.
+// The models encode fields the way protojson does, with camelCase names,
+// int64s as strings, durations in seconds and RFC 3339 timestamps.
+var unmarshalOptions = protojson.UnmarshalOptions{DiscardUnknown: true}
+
+// fromProto copies the message src into the model dst.
+func fromProto(src proto.Message, dst any) error {
+	data, err := protojson.Marshal(src)
+	if err == nil {
+		err = json.Unmarshal(data, dst)
+	}
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Invalid request: %v", err)
+	}
+	return nil
+}
+
+// toProto copies the model src into the message dst.
+func toProto(src any, dst proto.Message) error {
+	data, err := json.Marshal(src)
+	if err == nil {
+		err = unmarshalOptions.Unmarshal(data, dst)
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "Invalid response: %v", err)
+	}
+	return nil
+}
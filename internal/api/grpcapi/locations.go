@@ -0,0 +1,75 @@
+package grpcapi
+
+import (
+	"context"
+	"strings"
+
+	"github.com/charlesgreen/gsm/internal/iam"
+	"github.com/charlesgreen/gsm/internal/locations"
+	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/pagination"
+	locationpb "google.golang.org/genproto/googleapis/cloud/location"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// locationsServer implements the google.cloud.location mixin.
+type locationsServer struct {
+	locationpb.UnimplementedLocationsServer
+	*service
+}
+
+func (s *locationsServer) ListLocations(ctx context.Context, req *locationpb.ListLocationsRequest) (*locationpb.ListLocationsResponse, error) {
+	projectID, _, err := parseName(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(projectID, "/locations/") {
+		return nil, invalidName(req.GetName())
+	}
+	if err := s.authorize(ctx, iam.LocationsList, req.GetName()+"/locations", projectID, ""); err != nil {
+		return nil, err
+	}
+
+	page, next, err := pagination.Paginate(s.Catalog.List(), pagination.PageSize(int(req.GetPageSize())), req.GetPageToken(), pagination.Query(projectID),
+		func(loc locations.Location) string { return loc.ID },
+		func(loc locations.Location, last string) bool { return loc.ID > last },
+	)
+	if err != nil {
+		return nil, invalidArgument("Invalid page token")
+	}
+
+	response := models.ListLocationsResponse{
+		Locations:     make([]*models.Location, 0, len(page)),
+		NextPageToken: next,
+	}
+	for _, loc := range page {
+		response.Locations = append(response.Locations, models.NewLocation(projectID, loc.ID, loc.DisplayName))
+	}
+
+	resp := new(locationpb.ListLocationsResponse)
+	return resp, toProto(response, resp)
+}
+
+func (s *locationsServer) GetLocation(ctx context.Context, req *locationpb.GetLocationRequest) (*locationpb.Location, error) {
+	qualified, _, err := parseName(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+	projectID, locationID, ok := strings.Cut(qualified, "/locations/")
+	if !ok {
+		return nil, invalidName(req.GetName())
+	}
+	if err := s.authorize(ctx, iam.LocationsGet, req.GetName(), projectID, ""); err != nil {
+		return nil, err
+	}
+
+	loc, ok := s.Catalog.Get(locationID)
+	if !ok {
+		message := models.FormatResourceNotFoundError("location", projectID, "locations/"+locationID)
+		return nil, status.Error(codes.NotFound, message)
+	}
+
+	resp := new(locationpb.Location)
+	return resp, toProto(models.NewLocation(projectID, loc.ID, loc.DisplayName), resp)
+}
@@ -0,0 +1,392 @@
+package grpcapi
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/iam/apiv1/iampb"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"github.com/charlesgreen/gsm/internal/filter"
+	"github.com/charlesgreen/gsm/internal/iam"
+	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/notify"
+	"github.com/charlesgreen/gsm/internal/pagination"
+	"github.com/charlesgreen/gsm/internal/validation"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// secretManagerServer implements the Secret Manager service.
+type secretManagerServer struct {
+	secretmanagerpb.UnimplementedSecretManagerServiceServer
+	*service
+}
+
+func (s *secretManagerServer) ListSecrets(ctx context.Context, req *secretmanagerpb.ListSecretsRequest) (*secretmanagerpb.ListSecretsResponse, error) {
+	projectID, _, err := parseName(req.GetParent())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, iam.SecretsList, req.GetParent()+"/secrets", projectID, ""); err != nil {
+		return nil, err
+	}
+
+	match, err := filter.Parse(req.GetFilter(), models.SecretFilterFields)
+	if err != nil {
+		return nil, invalidArgument(models.FormatInvalidFilterError(err))
+	}
+
+	secrets, nextPageToken, totalSize, err := s.Storage.ListSecrets(ctx, projectID, match, pagination.PageSize(int(req.GetPageSize())), req.GetPageToken())
+	if err != nil {
+		return nil, s.storageError(ctx, err, projectID, "", "")
+	}
+
+	resp := new(secretmanagerpb.ListSecretsResponse)
+	return resp, toProto(models.ListSecretsResponse{
+		Secrets:       secrets,
+		NextPageToken: nextPageToken,
+		TotalSize:     totalSize,
+	}, resp)
+}
+
+func (s *secretManagerServer) CreateSecret(ctx context.Context, req *secretmanagerpb.CreateSecretRequest) (*secretmanagerpb.Secret, error) {
+	projectID, _, err := parseName(req.GetParent())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, iam.SecretsCreate, req.GetParent()+"/secrets", projectID, ""); err != nil {
+		return nil, err
+	}
+
+	var data models.CreateSecretData
+	if req.GetSecret() != nil {
+		if err := fromProto(req.GetSecret(), &data); err != nil {
+			return nil, err
+		}
+	}
+
+	secret, violations := validation.Secret(projectID, req.GetSecretId(), &data, s.Catalog, time.Now())
+	if len(violations) > 0 {
+		return nil, badRequest(violations)
+	}
+
+	if err := s.Storage.CreateSecret(ctx, projectID, req.GetSecretId(), secret); err != nil {
+		return nil, s.storageError(ctx, err, projectID, req.GetSecretId(), "")
+	}
+
+	notify.Publish(ctx, s.Notifier, notify.SecretCreate, secret, nil)
+
+	resp := new(secretmanagerpb.Secret)
+	return resp, toProto(secret, resp)
+}
+
+func (s *secretManagerServer) GetSecret(ctx context.Context, req *secretmanagerpb.GetSecretRequest) (*secretmanagerpb.Secret, error) {
+	projectID, ids, err := parseName(req.GetName(), "secrets")
+	if err != nil {
+		return nil, err
+	}
+	secretID := ids[0]
+	if err := s.authorize(ctx, iam.SecretsGet, req.GetName(), projectID, secretID); err != nil {
+		return nil, err
+	}
+
+	secret, err := s.Storage.GetSecret(ctx, projectID, secretID)
+	if err != nil {
+		return nil, s.storageError(ctx, err, projectID, secretID, "")
+	}
+
+	resp := new(secretmanagerpb.Secret)
+	return resp, toProto(secret, resp)
+}
+
+func (s *secretManagerServer) UpdateSecret(ctx context.Context, req *secretmanagerpb.UpdateSecretRequest) (*secretmanagerpb.Secret, error) {
+	projectID, ids, err := parseName(req.GetSecret().GetName(), "secrets")
+	if err != nil {
+		return nil, err
+	}
+	secretID := ids[0]
+	if err := s.authorize(ctx, iam.SecretsUpdate, req.GetSecret().GetName(), projectID, secretID); err != nil {
+		return nil, err
+	}
+
+	updateMask, err := validation.UpdateMask(req.GetUpdateMask().GetPaths())
+	if err != nil {
+		return nil, invalidArgument(err.Error())
+	}
+
+	var secret models.Secret
+	if err := fromProto(req.GetSecret(), &secret); err != nil {
+		return nil, err
+	}
+	if violations := validation.SecretUpdate(updateMask, &secret, time.Now()); len(violations) > 0 {
+		return nil, badRequest(violations)
+	}
+
+	updated, err := s.Storage.UpdateSecret(ctx, projectID, secretID, &secret, updateMask)
+	if err != nil {
+		return nil, s.storageError(ctx, err, projectID, secretID, "")
+	}
+
+	notify.Publish(ctx, s.Notifier, notify.SecretUpdate, updated, nil)
+
+	resp := new(secretmanagerpb.Secret)
+	return resp, toProto(updated, resp)
+}
+
+func (s *secretManagerServer) DeleteSecret(ctx context.Context, req *secretmanagerpb.DeleteSecretRequest) (*emptypb.Empty, error) {
+	projectID, ids, err := parseName(req.GetName(), "secrets")
+	if err != nil {
+		return nil, err
+	}
+	secretID := ids[0]
+	if err := s.authorize(ctx, iam.SecretsDelete, req.GetName(), projectID, secretID); err != nil {
+		return nil, err
+	}
+
+	// The notification carries the secret as it was before deletion
+	secret, err := s.Storage.GetSecret(ctx, projectID, secretID)
+	if err == nil {
+		err = s.Storage.DeleteSecret(ctx, projectID, secretID, req.GetEtag())
+	}
+	if err != nil {
+		return nil, s.storageError(ctx, err, projectID, secretID, "")
+	}
+
+	notify.Publish(ctx, s.Notifier, notify.SecretDelete, secret, nil)
+
+	return new(emptypb.Empty), nil
+}
+
+func (s *secretManagerServer) AddSecretVersion(ctx context.Context, req *secretmanagerpb.AddSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	projectID, ids, err := parseName(req.GetParent(), "secrets")
+	if err != nil {
+		return nil, err
+	}
+	secretID := ids[0]
+	if err := s.authorize(ctx, iam.VersionsAdd, req.GetParent(), projectID, secretID); err != nil {
+		return nil, err
+	}
+
+	if len(req.GetPayload().GetData()) == 0 {
+		return nil, invalidArgument("Payload data is required")
+	}
+	var payload models.SecretPayload
+	if err := fromProto(req.GetPayload(), &payload); err != nil {
+		return nil, err
+	}
+	if violations := validation.Payload("payload", &payload); len(violations) > 0 {
+		return nil, badRequest(violations)
+	}
+
+	version, err := s.Storage.AddSecretVersion(ctx, projectID, secretID, &payload)
+	if err != nil {
+		return nil, s.storageError(ctx, err, projectID, secretID, "")
+	}
+
+	notify.PublishVersion(ctx, s.Notifier, s.Storage, notify.SecretVersionAdd, projectID, secretID, version)
+
+	resp := new(secretmanagerpb.SecretVersion)
+	return resp, toProto(version, resp)
+}
+
+func (s *secretManagerServer) ListSecretVersions(ctx context.Context, req *secretmanagerpb.ListSecretVersionsRequest) (*secretmanagerpb.ListSecretVersionsResponse, error) {
+	projectID, ids, err := parseName(req.GetParent(), "secrets")
+	if err != nil {
+		return nil, err
+	}
+	secretID := ids[0]
+	if err := s.authorize(ctx, iam.VersionsList, req.GetParent()+"/versions", projectID, secretID); err != nil {
+		return nil, err
+	}
+
+	match, err := filter.Parse(req.GetFilter(), models.VersionFilterFields)
+	if err != nil {
+		return nil, invalidArgument(models.FormatInvalidFilterError(err))
+	}
+
+	versions, nextPageToken, totalSize, err := s.Storage.ListSecretVersions(ctx, projectID, secretID, match, pagination.PageSize(int(req.GetPageSize())), req.GetPageToken())
+	if err != nil {
+		return nil, s.storageError(ctx, err, projectID, secretID, "")
+	}
+
+	resp := new(secretmanagerpb.ListSecretVersionsResponse)
+	return resp, toProto(models.ListSecretVersionsResponse{
+		Versions:      versions,
+		NextPageToken: nextPageToken,
+		TotalSize:     totalSize,
+	}, resp)
+}
+
+func (s *secretManagerServer) GetSecretVersion(ctx context.Context, req *secretmanagerpb.GetSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	projectID, ids, err := parseName(req.GetName(), "secrets", "versions")
+	if err != nil {
+		return nil, err
+	}
+	secretID, versionID := ids[0], ids[1]
+	if err := s.authorize(ctx, iam.VersionsGet, req.GetName(), projectID, secretID); err != nil {
+		return nil, err
+	}
+
+	version, err := s.Storage.GetSecretVersion(ctx, projectID, secretID, versionID)
+	if err != nil {
+		return nil, s.storageError(ctx, err, projectID, secretID, versionID)
+	}
+
+	resp := new(secretmanagerpb.SecretVersion)
+	return resp, toProto(version, resp)
+}
+
+func (s *secretManagerServer) AccessSecretVersion(ctx context.Context, req *secretmanagerpb.AccessSecretVersionRequest) (*secretmanagerpb.AccessSecretVersionResponse, error) {
+	projectID, ids, err := parseName(req.GetName(), "secrets", "versions")
+	if err != nil {
+		return nil, err
+	}
+	secretID, versionID := ids[0], ids[1]
+	if err := s.authorize(ctx, iam.VersionsAccess, req.GetName(), projectID, secretID); err != nil {
+		return nil, err
+	}
+
+	version, data, err := s.Storage.AccessSecretVersion(ctx, projectID, secretID, versionID)
+	if err != nil {
+		return nil, s.storageError(ctx, err, projectID, secretID, versionID)
+	}
+
+	resp := new(secretmanagerpb.AccessSecretVersionResponse)
+	return resp, toProto(models.NewAccessSecretVersionResponse(version, data), resp)
+}
+
+func (s *secretManagerServer) DisableSecretVersion(ctx context.Context, req *secretmanagerpb.DisableSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	return s.setSecretVersionState(ctx, req.GetName(), req.GetEtag(), iam.VersionsDisable, models.StateDisabled, notify.SecretVersionDisable)
+}
+
+func (s *secretManagerServer) EnableSecretVersion(ctx context.Context, req *secretmanagerpb.EnableSecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	return s.setSecretVersionState(ctx, req.GetName(), req.GetEtag(), iam.VersionsEnable, models.StateEnabled, notify.SecretVersionEnable)
+}
+
+func (s *secretManagerServer) DestroySecretVersion(ctx context.Context, req *secretmanagerpb.DestroySecretVersionRequest) (*secretmanagerpb.SecretVersion, error) {
+	return s.setSecretVersionState(ctx, req.GetName(), req.GetEtag(), iam.VersionsDestroy, models.StateDestroyed, notify.SecretVersionDestroy)
+}
+
+func (s *secretManagerServer) setSecretVersionState(ctx context.Context, name, etag, permission string, state models.SecretVersionState, eventType notify.EventType) (*secretmanagerpb.SecretVersion, error) {
+	projectID, ids, err := parseName(name, "secrets", "versions")
+	if err != nil {
+		return nil, err
+	}
+	secretID, versionID := ids[0], ids[1]
+	if err := s.authorize(ctx, permission, name, projectID, secretID); err != nil {
+		return nil, err
+	}
+
+	version, err := s.Storage.SetSecretVersionState(ctx, projectID, secretID, versionID, state, etag)
+	if err != nil {
+		return nil, s.storageError(ctx, err, projectID, secretID, versionID)
+	}
+
+	// A destroy delayed by the secret's versionDestroyTtl only schedules it
+	if state == models.StateDestroyed && version.ScheduledDestroyTime != nil {
+		eventType = notify.SecretVersionDestroyScheduled
+	}
+	notify.PublishVersion(ctx, s.Notifier, s.Storage, eventType, projectID, secretID, version)
+
+	resp := new(secretmanagerpb.SecretVersion)
+	return resp, toProto(version, resp)
+}
+
+func (s *secretManagerServer) GetIamPolicy(ctx context.Context, req *iampb.GetIamPolicyRequest) (*iampb.Policy, error) {
+	projectID, secretID, err := parseResource(req.GetResource())
+	if err != nil {
+		return nil, err
+	}
+	permission := iam.ProjectsGetIam
+	if secretID != "" {
+		permission = iam.SecretsGetIamPolicy
+	}
+	if err := s.authorize(ctx, permission, req.GetResource(), projectID, secretID); err != nil {
+		return nil, err
+	}
+
+	policy, err := s.Storage.GetIamPolicy(ctx, projectID, secretID)
+	if err != nil {
+		return nil, policyError(err, projectID, secretID)
+	}
+
+	resp := new(iampb.Policy)
+	return resp, toProto(policy, resp)
+}
+
+func (s *secretManagerServer) SetIamPolicy(ctx context.Context, req *iampb.SetIamPolicyRequest) (*iampb.Policy, error) {
+	projectID, secretID, err := parseResource(req.GetResource())
+	if err != nil {
+		return nil, err
+	}
+	permission := iam.ProjectsSetIam
+	if secretID != "" {
+		permission = iam.SecretsSetIamPolicy
+	}
+	if err := s.authorize(ctx, permission, req.GetResource(), projectID, secretID); err != nil {
+		return nil, err
+	}
+
+	if req.GetPolicy() == nil {
+		return nil, invalidArgument("policy is required")
+	}
+	var policy models.Policy
+	if err := fromProto(req.GetPolicy(), &policy); err != nil {
+		return nil, err
+	}
+
+	updated, err := s.Storage.SetIamPolicy(ctx, projectID, secretID, &policy)
+	if err != nil {
+		return nil, policyError(err, projectID, secretID)
+	}
+
+	resp := new(iampb.Policy)
+	return resp, toProto(updated, resp)
+}
+
+func (s *secretManagerServer) TestIamPermissions(ctx context.Context, req *iampb.TestIamPermissionsRequest) (*iampb.TestIamPermissionsResponse, error) {
+	projectID, secretID, err := parseResource(req.GetResource())
+	if err != nil {
+		return nil, err
+	}
+
+	if secretID != "" {
+		if _, err := s.Storage.GetSecret(ctx, projectID, secretID); err != nil {
+			return nil, policyError(err, projectID, secretID)
+		}
+	}
+
+	principal := callerPrincipal(ctx)
+	if principal == "" && s.IAM.Enforced() {
+		return nil, status.Error(codes.Unauthenticated, models.UnauthenticatedMessage)
+	}
+
+	// Without enforcement anonymous callers may do anything, so they hold
+	// every permission
+	var response models.TestIamPermissionsResponse
+	for _, permission := range req.GetPermissions() {
+		if principal == "" || s.IAM.Allowed(ctx, principal, permission, projectID, secretID) {
+			response.Permissions = append(response.Permissions, permission)
+		}
+	}
+
+	resp := new(iampb.TestIamPermissionsResponse)
+	return resp, toProto(response, resp)
+}
+
+// parseResource parses the resource of an IAM request, which is a secret or a
+// project. Project policies apply to every location, so project resources
+// cannot name one.
+func parseResource(resource string) (projectID, secretID string, err error) {
+	if projectID, ids, err := parseName(resource, "secrets"); err == nil {
+		return projectID, ids[0], nil
+	}
+
+	projectID, _, err = parseName(resource)
+	if err == nil && strings.Contains(projectID, "/locations/") {
+		err = invalidName(resource)
+	}
+	return projectID, "", err
+}
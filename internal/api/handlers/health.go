@@ -7,17 +7,29 @@ import (
 	"time"
 
 	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/storage"
 )
 
 // Version represents the current version of the GSM emulator.
 const Version = "1.0.0"
 
 // HealthHandler handles health check and readiness probe endpoints.
-type HealthHandler struct{}
+type HealthHandler struct {
+	storage storage.Storage
+}
+
+// flushReporter is implemented by storage backends that write changes to disk
+// in the background, such as storage.PersistentStorage.
+type flushReporter interface {
+	FlushError() error
+}
 
-// NewHealthHandler creates a new health handler instance.
-func NewHealthHandler() *HealthHandler {
-	return &HealthHandler{}
+// NewHealthHandler creates a new health handler instance. Readiness reflects
+// whether storage is still able to write its changes.
+func NewHealthHandler(storage storage.Storage) *HealthHandler {
+	return &HealthHandler{
+		storage: storage,
+	}
 }
 
 // Health responds with the current health status of the emulator.
@@ -32,7 +44,9 @@ func (h *HealthHandler) Health(w http.ResponseWriter, _ *http.Request) {
 	_ = json.NewEncoder(w).Encode(response)
 }
 
-// Ready responds with the readiness status of the emulator.
+// Ready responds with the readiness status of the emulator. It reports
+// NOT_READY with a 503, and the error, while the last flush of persistent
+// storage failed.
 func (h *HealthHandler) Ready(w http.ResponseWriter, _ *http.Request) {
 	response := models.HealthResponse{
 		Status:    "READY",
@@ -40,6 +54,16 @@ func (h *HealthHandler) Ready(w http.ResponseWriter, _ *http.Request) {
 		Version:   Version,
 	}
 
+	statusCode := http.StatusOK
+	if reporter, ok := h.storage.(flushReporter); ok {
+		if err := reporter.FlushError(); err != nil {
+			response.Status = "NOT_READY"
+			response.Error = err.Error()
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
 	_ = json.NewEncoder(w).Encode(response)
 }
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/charlesgreen/gsm/internal/api/apierror"
+	"github.com/charlesgreen/gsm/internal/iam"
+	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/storage"
+)
+
+// PrincipalHeader names the request header that identifies the caller when IAM
+// is enforced, such as "serviceAccount:app@project.iam.gserviceaccount.com".
+// A bearer token holding a member string or an email is accepted as well.
+const PrincipalHeader = "X-GSM-Principal"
+
+// IAMHandler handles HTTP requests for IAM policies on projects and secrets,
+// and optionally enforces those policies on every other API method.
+type IAMHandler struct {
+	storage  storage.Storage
+	enforcer *iam.Enforcer
+}
+
+// NewIAMHandler creates a new IAMHandler. When enforcer enforces policies, Require
+// rejects anonymous callers and callers that lack the permission a method needs.
+func NewIAMHandler(storage storage.Storage, enforcer *iam.Enforcer) *IAMHandler {
+	return &IAMHandler{
+		storage:  storage,
+		enforcer: enforcer,
+	}
+}
+
+// Require wraps next so that, when enforcement is enabled, the caller must be
+// identified and hold permission on the targeted project or secret.
+func (h *IAMHandler) Require(permission string, next http.Handler) http.Handler {
+	if !h.enforcer.Enforced() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := callerPrincipal(r)
+		if principal == "" {
+			writeErrorResponse(w, http.StatusUnauthorized, models.UnauthenticatedMessage, "UNAUTHENTICATED")
+			return
+		}
+
+		path := trimCustomMethod(r.URL.Path)
+		projectID, secretID, _ := splitResourcePath(path)
+		if !h.enforcer.Allowed(r.Context(), principal, permission, projectID, secretID) {
+			message := models.FormatPermissionDeniedError(permission, strings.TrimPrefix(path, "/v1/"))
+			writeErrorResponse(w, http.StatusForbidden, message, "PERMISSION_DENIED")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GetIamPolicy handles requests to retrieve the IAM policy of a project or secret.
+func (h *IAMHandler) GetIamPolicy(w http.ResponseWriter, r *http.Request) {
+	projectID, secretID, _ := splitResourcePath(trimCustomMethod(r.URL.Path))
+	if projectID == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid resource path", "INVALID_ARGUMENT")
+		return
+	}
+
+	policy, err := h.storage.GetIamPolicy(r.Context(), policyProject(projectID, secretID), secretID)
+	if err != nil {
+		writePolicyError(w, err, projectID, secretID, "Failed to get IAM policy")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(policy)
+}
+
+// SetIamPolicy handles POST requests to replace the IAM policy of a project or secret.
+func (h *IAMHandler) SetIamPolicy(w http.ResponseWriter, r *http.Request) {
+	projectID, secretID, _ := splitResourcePath(trimCustomMethod(r.URL.Path))
+	if projectID == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid resource path", "INVALID_ARGUMENT")
+		return
+	}
+
+	var req models.SetIamPolicyRequest
+	if err := decodeJSON(r.Body, &req); err != nil && !errors.Is(err, io.EOF) {
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_ARGUMENT")
+		return
+	}
+	if req.Policy == nil {
+		writeErrorResponse(w, http.StatusBadRequest, "policy is required", "INVALID_ARGUMENT")
+		return
+	}
+
+	policy, err := h.storage.SetIamPolicy(r.Context(), policyProject(projectID, secretID), secretID, req.Policy)
+	if err != nil {
+		writePolicyError(w, err, projectID, secretID, "Failed to set IAM policy")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(policy)
+}
+
+// TestIamPermissions handles POST requests reporting which of the requested
+// permissions the caller holds on a project or secret.
+func (h *IAMHandler) TestIamPermissions(w http.ResponseWriter, r *http.Request) {
+	projectID, secretID, _ := splitResourcePath(trimCustomMethod(r.URL.Path))
+	if projectID == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid resource path", "INVALID_ARGUMENT")
+		return
+	}
+
+	var req models.TestIamPermissionsRequest
+	if err := decodeJSON(r.Body, &req); err != nil && !errors.Is(err, io.EOF) {
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_ARGUMENT")
+		return
+	}
+
+	if secretID != "" {
+		if _, err := h.storage.GetSecret(r.Context(), projectID, secretID); err != nil {
+			writePolicyError(w, err, projectID, secretID, "Failed to test IAM permissions")
+			return
+		}
+	}
+
+	principal := callerPrincipal(r)
+	if principal == "" && h.enforcer.Enforced() {
+		writeErrorResponse(w, http.StatusUnauthorized, models.UnauthenticatedMessage, "UNAUTHENTICATED")
+		return
+	}
+
+	// Without enforcement anonymous callers may do anything, so they hold
+	// every permission
+	response := models.TestIamPermissionsResponse{}
+	for _, permission := range req.Permissions {
+		if principal == "" || h.enforcer.Allowed(r.Context(), principal, permission, projectID, secretID) {
+			response.Permissions = append(response.Permissions, permission)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func writePolicyError(w http.ResponseWriter, err error, projectID, secretID, internalMessage string) {
+	if detail := apierror.Policy(err, projectID, secretID); detail != nil {
+		writeErrorResponse(w, detail.Code, detail.Message, detail.Status)
+		return
+	}
+	writeErrorResponse(w, http.StatusInternalServerError, internalMessage, "INTERNAL")
+}
+
+// callerPrincipal identifies the caller from the principal header or the bearer
+// token, returning an empty string for anonymous requests.
+func callerPrincipal(r *http.Request) string {
+	if principal := iam.Principal(r.Header.Get(PrincipalHeader)); principal != "" {
+		return principal
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return iam.Principal(token)
+	}
+	return ""
+}
+
+// policyProject returns the project ID that owns a policy. Project level
+// policies apply to every location, so the location qualifier is dropped.
+func policyProject(projectID, secretID string) string {
+	if secretID == "" {
+		return baseProjectID(projectID)
+	}
+	return projectID
+}
+
+// baseProjectID strips the location qualifier from a regional project ID.
+func baseProjectID(projectID string) string {
+	projectID, _, _ = strings.Cut(projectID, "/locations/")
+	return projectID
+}
+
+// trimCustomMethod removes a trailing custom method such as ":access" from a path.
+func trimCustomMethod(path string) string {
+	if i := strings.LastIndex(path, ":"); i > strings.LastIndex(path, "/") {
+		return path[:i]
+	}
+	return path
+}
@@ -4,7 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"strings"
+
+	"github.com/charlesgreen/gsm/internal/jsonname"
 )
 
 var skipNormalizationFor = map[string]struct{}{
@@ -35,7 +36,7 @@ func decodeJSON[T any](r io.Reader, dst *T) error {
 func normalizeKeys(src map[string]any) map[string]any {
 	dst := make(map[string]any, len(src))
 	for k, v := range src {
-		camelCase := toCamelCase(k)
+		camelCase := jsonname.FromProto(k)
 		if _, ok := skipNormalizationFor[camelCase]; ok {
 			dst[camelCase] = v
 			continue
@@ -58,25 +59,3 @@ func normalizeKeys(src map[string]any) map[string]any {
 	}
 	return dst
 }
-
-func toCamelCase(s string) string {
-	parts := strings.Split(s, "_")
-	if len(parts) < 2 {
-		return s
-	}
-
-	var camelCase string
-	for _, p := range parts {
-		if len(p) == 0 {
-			continue
-		}
-
-		// The first segment written should stay naturally cased
-		if camelCase == "" {
-			camelCase += p
-		} else {
-			camelCase += strings.ToUpper(p[:1]) + p[1:]
-		}
-	}
-	return camelCase
-}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/charlesgreen/gsm/internal/kms"
+	"github.com/charlesgreen/gsm/internal/models"
+)
+
+// kmsPrefix is where the key registry's admin endpoints are served. The rest
+// of each path is the Cloud KMS resource name.
+const kmsPrefix = "/kms/v1/"
+
+// KMSHandler handles the admin endpoints that manage the simulated Cloud KMS
+// keys used for customer-managed encryption. Paths and bodies follow the
+// Cloud KMS REST API under the /kms prefix.
+type KMSHandler struct {
+	keys *kms.Registry
+}
+
+// NewKMSHandler creates a new KMSHandler managing keys.
+func NewKMSHandler(keys *kms.Registry) *KMSHandler {
+	return &KMSHandler{
+		keys: keys,
+	}
+}
+
+// CreateCryptoKey handles POST requests to register a key with one enabled version.
+func (h *KMSHandler) CreateCryptoKey(w http.ResponseWriter, r *http.Request) {
+	keyID := r.URL.Query().Get("cryptoKeyId")
+	if keyID == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "cryptoKeyId is required", "INVALID_ARGUMENT")
+		return
+	}
+
+	key, err := h.keys.CreateKey(kmsResourceName(r.URL.Path) + "/" + keyID)
+	if err != nil {
+		writeKMSError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(key)
+}
+
+// GetCryptoKey handles GET requests to retrieve a key and its primary version.
+func (h *KMSHandler) GetCryptoKey(w http.ResponseWriter, r *http.Request) {
+	key, err := h.keys.GetKey(kmsResourceName(r.URL.Path))
+	if err != nil {
+		writeKMSError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(key)
+}
+
+// CreateCryptoKeyVersion handles POST requests to add a version to a key. The
+// new version becomes the primary.
+func (h *KMSHandler) CreateCryptoKeyVersion(w http.ResponseWriter, r *http.Request) {
+	keyName := strings.TrimSuffix(kmsResourceName(r.URL.Path), "/cryptoKeyVersions")
+	version, err := h.keys.CreateKeyVersion(keyName)
+	if err != nil {
+		writeKMSError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(version)
+}
+
+// GetCryptoKeyVersion handles GET requests to retrieve a key version.
+func (h *KMSHandler) GetCryptoKeyVersion(w http.ResponseWriter, r *http.Request) {
+	version, err := h.keys.GetKeyVersion(kmsResourceName(r.URL.Path))
+	if err != nil {
+		writeKMSError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(version)
+}
+
+// UpdateCryptoKeyVersion handles PATCH requests that enable or disable a key version.
+func (h *KMSHandler) UpdateCryptoKeyVersion(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		State kms.State `json:"state"`
+	}
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_ARGUMENT")
+		return
+	}
+	if req.State != kms.Enabled && req.State != kms.Disabled {
+		writeErrorResponse(w, http.StatusBadRequest, "The state must be ENABLED or DISABLED.", "INVALID_ARGUMENT")
+		return
+	}
+
+	h.setKeyVersionState(w, kmsResourceName(r.URL.Path), req.State)
+}
+
+// DestroyCryptoKeyVersion handles POST requests to destroy a key version.
+// Payloads encrypted with it can no longer be read.
+func (h *KMSHandler) DestroyCryptoKeyVersion(w http.ResponseWriter, r *http.Request) {
+	h.setKeyVersionState(w, strings.TrimSuffix(kmsResourceName(r.URL.Path), ":destroy"), kms.Destroyed)
+}
+
+func (h *KMSHandler) setKeyVersionState(w http.ResponseWriter, name string, state kms.State) {
+	version, err := h.keys.SetKeyVersionState(name, state)
+	if err != nil {
+		writeKMSError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(version)
+}
+
+// writeKMSError maps key registry errors onto API error responses.
+func writeKMSError(w http.ResponseWriter, err error) {
+	var notFound *kms.NotFoundError
+	var state *kms.StateError
+	switch {
+	case errors.As(err, &notFound):
+		writeErrorResponse(w, http.StatusNotFound, fmt.Sprintf("Resource [%s] not found.", notFound.Name), "NOT_FOUND")
+	case errors.As(err, &state):
+		writeErrorResponse(w, http.StatusBadRequest, models.FormatKeyStateError(state.Name, string(state.State)), "FAILED_PRECONDITION")
+	case err == kms.ErrKeyExists:
+		writeErrorResponse(w, http.StatusConflict, "CryptoKey already exists.", "ALREADY_EXISTS")
+	case err == kms.ErrInvalidName:
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid crypto key name", "INVALID_ARGUMENT")
+	default:
+		writeErrorResponse(w, http.StatusInternalServerError, "Failed to update crypto key", "INTERNAL")
+	}
+}
+
+// kmsResourceName returns the Cloud KMS resource name an admin path refers to.
+func kmsResourceName(path string) string {
+	return strings.TrimPrefix(path, kmsPrefix)
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/charlesgreen/gsm/internal/locations"
+	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/pagination"
+)
+
+// LocationsHandler handles HTTP requests for the google.cloud.location mixin.
+type LocationsHandler struct {
+	catalog *locations.Catalog
+}
+
+// NewLocationsHandler creates a new LocationsHandler serving the given catalog.
+func NewLocationsHandler(catalog *locations.Catalog) *LocationsHandler {
+	return &LocationsHandler{
+		catalog: catalog,
+	}
+}
+
+// ListLocations handles GET requests to list the locations available to a project.
+func (h *LocationsHandler) ListLocations(w http.ResponseWriter, r *http.Request) {
+	projectID, _ := extractProjectAndLocationID(r.URL.Path)
+	if projectID == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid project path", "INVALID_ARGUMENT")
+		return
+	}
+
+	requested, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	pageSize := pagination.PageSize(requested)
+
+	page, next, err := pagination.Paginate(h.catalog.List(), pageSize, r.URL.Query().Get("pageToken"), pagination.Query(projectID),
+		func(loc locations.Location) string { return loc.ID },
+		func(loc locations.Location, last string) bool { return loc.ID > last },
+	)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid page token", "INVALID_ARGUMENT")
+		return
+	}
+
+	response := models.ListLocationsResponse{
+		Locations:     make([]*models.Location, 0, len(page)),
+		NextPageToken: next,
+	}
+	for _, loc := range page {
+		response.Locations = append(response.Locations, models.NewLocation(projectID, loc.ID, loc.DisplayName))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// GetLocation handles GET requests to retrieve a single location.
+func (h *LocationsHandler) GetLocation(w http.ResponseWriter, r *http.Request) {
+	projectID, locationID := extractProjectAndLocationID(r.URL.Path)
+	if projectID == "" || locationID == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid location path", "INVALID_ARGUMENT")
+		return
+	}
+
+	loc, ok := h.catalog.Get(locationID)
+	if !ok {
+		message := models.FormatResourceNotFoundError("location", projectID, "locations/"+locationID)
+		writeErrorResponse(w, http.StatusNotFound, message, "NOT_FOUND")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(models.NewLocation(projectID, loc.ID, loc.DisplayName))
+}
+
+// extractProjectAndLocationID splits the project and location IDs out of a
+// /v1/projects/{project}/locations/{location} path.
+func extractProjectAndLocationID(path string) (string, string) {
+	projectID, _, _ := splitResourcePath(path)
+	projectID, locationID, _ := strings.Cut(projectID, "/locations/")
+	return projectID, locationID
+}
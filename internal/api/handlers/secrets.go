@@ -8,20 +8,33 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/charlesgreen/gsm/internal/api/apierror"
+	"github.com/charlesgreen/gsm/internal/filter"
+	"github.com/charlesgreen/gsm/internal/locations"
 	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/notify"
+	"github.com/charlesgreen/gsm/internal/pagination"
 	"github.com/charlesgreen/gsm/internal/storage"
+	"github.com/charlesgreen/gsm/internal/validation"
 )
 
 // SecretsHandler handles HTTP requests for secret operations.
 type SecretsHandler struct {
-	storage storage.Storage
+	storage  storage.Storage
+	catalog  *locations.Catalog
+	notifier notify.Notifier
 }
 
 // NewSecretsHandler creates a new SecretsHandler with the provided storage backend.
-func NewSecretsHandler(storage storage.Storage) *SecretsHandler {
+// Regional secrets and user-managed replicas must use a location from catalog,
+// and changes to secrets are reported to notifier.
+func NewSecretsHandler(storage storage.Storage, catalog *locations.Catalog, notifier notify.Notifier) *SecretsHandler {
 	return &SecretsHandler{
-		storage: storage,
+		storage:  storage,
+		catalog:  catalog,
+		notifier: notifier,
 	}
 }
 
@@ -40,27 +53,19 @@ func (h *SecretsHandler) CreateSecret(w http.ResponseWriter, r *http.Request) {
 	}
 
 	req.SecretID = cmp.Or(req.SecretID, r.FormValue("secretId"))
-	if req.SecretID == "" {
-		writeErrorResponse(w, http.StatusBadRequest, "secretId is required", "INVALID_ARGUMENT")
+	secret, violations := validation.Secret(projectID, req.SecretID, cmp.Or(req.Secret, &req.CreateSecretData), h.catalog, time.Now())
+	if len(violations) > 0 {
+		writeBadRequest(w, violations)
 		return
 	}
 
-	req.Secret = cmp.Or(req.Secret, new(models.CreateSecretData))
-	secret := models.NewSecret(projectID, req.SecretID, req.Secret.Labels)
-	if req.Secret.Replication != nil {
-		secret.Replication = *req.Secret.Replication
-	}
-
 	if err := h.storage.CreateSecret(r.Context(), projectID, req.SecretID, secret); err != nil {
-		if err == storage.ErrSecretExists {
-			message := models.FormatResourceExistsError("secret", projectID, req.SecretID)
-			writeErrorResponse(w, http.StatusConflict, message, "ALREADY_EXISTS")
-			return
-		}
-		writeErrorResponse(w, http.StatusInternalServerError, "Failed to create secret", "INTERNAL")
+		writeStorageError(w, r, h.storage, err, projectID, req.SecretID, "", "Failed to create secret")
 		return
 	}
 
+	notify.Publish(r.Context(), h.notifier, notify.SecretCreate, secret, nil)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	_ = json.NewEncoder(w).Encode(secret)
@@ -76,12 +81,7 @@ func (h *SecretsHandler) GetSecret(w http.ResponseWriter, r *http.Request) {
 
 	secret, err := h.storage.GetSecret(r.Context(), projectID, secretID)
 	if err != nil {
-		if err == storage.ErrSecretNotFound {
-			message := models.FormatResourceNotFoundError("secret", projectID, secretID)
-			writeErrorResponse(w, http.StatusNotFound, message, "NOT_FOUND")
-			return
-		}
-		writeErrorResponse(w, http.StatusInternalServerError, "Failed to get secret", "INTERNAL")
+		writeStorageError(w, r, h.storage, err, projectID, secretID, "", "Failed to get secret")
 		return
 	}
 
@@ -97,34 +97,75 @@ func (h *SecretsHandler) ListSecrets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pageSize := 100
-	if pageSizeStr := r.URL.Query().Get("pageSize"); pageSizeStr != "" {
-		if ps, err := strconv.Atoi(pageSizeStr); err == nil && ps > 0 && ps <= 1000 {
-			pageSize = ps
-		}
-	}
+	requested, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	pageSize := pagination.PageSize(requested)
 
 	pageToken := r.URL.Query().Get("pageToken")
 
-	secrets, nextPageToken, err := h.storage.ListSecrets(r.Context(), projectID, pageSize, pageToken)
+	match, err := filter.Parse(r.URL.Query().Get("filter"), models.SecretFilterFields)
 	if err != nil {
-		writeErrorResponse(w, http.StatusInternalServerError, "Failed to list secrets", "INTERNAL")
+		writeErrorResponse(w, http.StatusBadRequest, models.FormatInvalidFilterError(err), "INVALID_ARGUMENT")
+		return
+	}
+
+	secrets, nextPageToken, totalSize, err := h.storage.ListSecrets(r.Context(), projectID, match, pageSize, pageToken)
+	if err != nil {
+		writeStorageError(w, r, h.storage, err, projectID, "", "", "Failed to list secrets")
 		return
 	}
 
 	response := models.ListSecretsResponse{
 		Secrets:       secrets,
 		NextPageToken: nextPageToken,
-		TotalSize:     len(secrets),
+		TotalSize:     totalSize,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(response)
 }
 
-// DeleteSecret handles DELETE requests to remove a secret.
-//
-// TODO: Support ?etag
+// UpdateSecret handles PATCH requests to update the metadata of a secret.
+func (h *SecretsHandler) UpdateSecret(w http.ResponseWriter, r *http.Request) {
+	projectID, secretID := extractProjectAndSecretID(r.URL.Path)
+	if projectID == "" || secretID == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid secret path", "INVALID_ARGUMENT")
+		return
+	}
+
+	var paths []string
+	if raw := cmp.Or(r.URL.Query().Get("updateMask"), r.URL.Query().Get("update_mask")); strings.TrimSpace(raw) != "" {
+		paths = strings.Split(raw, ",")
+	}
+	updateMask, err := validation.UpdateMask(paths)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, err.Error(), "INVALID_ARGUMENT")
+		return
+	}
+
+	var secret models.Secret
+	if err := decodeJSON(r.Body, &secret); err != nil && !errors.Is(err, io.EOF) {
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_ARGUMENT")
+		return
+	}
+	if violations := validation.SecretUpdate(updateMask, &secret, time.Now()); len(violations) > 0 {
+		writeBadRequest(w, violations)
+		return
+	}
+
+	updated, err := h.storage.UpdateSecret(r.Context(), projectID, secretID, &secret, updateMask)
+	if err != nil {
+		writeStorageError(w, r, h.storage, err, projectID, secretID, "", "Failed to update secret")
+		return
+	}
+
+	notify.Publish(r.Context(), h.notifier, notify.SecretUpdate, updated, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(updated)
+}
+
+// DeleteSecret handles DELETE requests to remove a secret. An etag query
+// parameter must match the secret's current etag.
 func (h *SecretsHandler) DeleteSecret(w http.ResponseWriter, r *http.Request) {
 	projectID, secretID := extractProjectAndSecretID(r.URL.Path)
 	if projectID == "" || secretID == "" {
@@ -132,59 +173,64 @@ func (h *SecretsHandler) DeleteSecret(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.storage.DeleteSecret(r.Context(), projectID, secretID); err != nil {
-		if err == storage.ErrSecretNotFound {
-			message := models.FormatResourceNotFoundError("secret", projectID, secretID)
-			writeErrorResponse(w, http.StatusNotFound, message, "NOT_FOUND")
-			return
-		}
-		writeErrorResponse(w, http.StatusInternalServerError, "Failed to delete secret", "INTERNAL")
+	// The notification carries the secret as it was before deletion
+	secret, err := h.storage.GetSecret(r.Context(), projectID, secretID)
+	if err == nil {
+		err = h.storage.DeleteSecret(r.Context(), projectID, secretID, r.URL.Query().Get("etag"))
+	}
+	if err != nil {
+		writeStorageError(w, r, h.storage, err, projectID, secretID, "", "Failed to delete secret")
 		return
 	}
 
+	notify.Publish(r.Context(), h.notifier, notify.SecretDelete, secret, nil)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func extractProjectID(path string) string {
-	parts := strings.Split(strings.Trim(path, "/"), "/")
-	for i, part := range parts {
-		if part == "projects" && i+1 < len(parts) {
-			return parts[i+1]
-		}
-	}
-	return ""
+	projectID, _, _ := splitResourcePath(path)
+	return projectID
 }
 
 func extractProjectAndSecretID(path string) (string, string) {
-	parts := strings.Split(strings.Trim(path, "/"), "/")
-	var projectID, secretID string
-
-	for i, part := range parts {
-		if part == "projects" && i+1 < len(parts) {
-			projectID = parts[i+1]
-		}
-		if part == "secrets" && i+1 < len(parts) {
-			secretID = parts[i+1]
-		}
-	}
-
+	projectID, secretID, _ := splitResourcePath(path)
 	return projectID, secretID
 }
 
 func extractProjectSecretAndVersionID(path string) (string, string, string) {
+	return splitResourcePath(path)
+}
+
+// splitResourcePath parses a /v1/projects/{project}[/locations/{location}]/secrets/{secret}/versions/{version}
+// path into its identifiers, stopping at whichever segment the path ends on. For
+// regional resources the project ID is qualified as {project}/locations/{location},
+// which is how storage keeps them apart from global secrets with the same ID.
+func splitResourcePath(path string) (projectID, secretID, versionID string) {
 	parts := strings.Split(strings.Trim(path, "/"), "/")
-	var projectID, secretID, versionID string
+	if len(parts) > 0 && parts[0] == "v1" {
+		parts = parts[1:]
+	}
 
-	for i, part := range parts {
-		if part == "projects" && i+1 < len(parts) {
-			projectID = parts[i+1]
-		}
-		if part == "secrets" && i+1 < len(parts) {
-			secretID = parts[i+1]
-		}
-		if part == "versions" && i+1 < len(parts) {
-			versionID = parts[i+1]
+	if len(parts) < 2 || parts[0] != "projects" || parts[1] == "" {
+		return "", "", ""
+	}
+	projectID, parts = parts[1], parts[2:]
+
+	if len(parts) >= 2 && parts[0] == "locations" {
+		if parts[1] == "" {
+			return "", "", ""
 		}
+		projectID += "/locations/" + parts[1]
+		parts = parts[2:]
+	}
+
+	if len(parts) >= 2 && parts[0] == "secrets" {
+		secretID, parts = parts[1], parts[2:]
+	}
+
+	if len(parts) >= 2 && parts[0] == "versions" {
+		versionID = parts[1]
 	}
 
 	return projectID, secretID, versionID
@@ -197,3 +243,21 @@ func writeErrorResponse(w http.ResponseWriter, statusCode int, message, status s
 	errorResp := models.NewErrorResponse(statusCode, message, status)
 	_ = json.NewEncoder(w).Encode(errorResp)
 }
+
+// writeStorageError writes the response apierror.Storage maps err onto, or an
+// INTERNAL response with internalMessage when err has none.
+func writeStorageError(w http.ResponseWriter, r *http.Request, store storage.Storage, err error, projectID, secretID, versionID, internalMessage string) {
+	if detail := apierror.Storage(r.Context(), store, err, projectID, secretID, versionID); detail != nil {
+		writeErrorResponse(w, detail.Code, detail.Message, detail.Status)
+		return
+	}
+	writeErrorResponse(w, http.StatusInternalServerError, internalMessage, "INTERNAL")
+}
+
+// writeBadRequest writes an INVALID_ARGUMENT response listing every field
+// violation found by the validation package.
+func writeBadRequest(w http.ResponseWriter, violations []models.FieldViolation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(models.NewBadRequestResponse(violations))
+}
@@ -2,23 +2,32 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"github.com/charlesgreen/gsm/internal/filter"
 	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/notify"
+	"github.com/charlesgreen/gsm/internal/pagination"
 	"github.com/charlesgreen/gsm/internal/storage"
+	"github.com/charlesgreen/gsm/internal/validation"
 )
 
 // VersionsHandler handles HTTP requests for secret version operations.
 type VersionsHandler struct {
-	storage storage.Storage
+	storage  storage.Storage
+	notifier notify.Notifier
 }
 
-// NewVersionsHandler creates a new VersionsHandler with the provided storage backend.
-func NewVersionsHandler(storage storage.Storage) *VersionsHandler {
+// NewVersionsHandler creates a new VersionsHandler with the provided storage
+// backend. Changes to versions are reported to notifier.
+func NewVersionsHandler(storage storage.Storage, notifier notify.Notifier) *VersionsHandler {
 	return &VersionsHandler{
-		storage: storage,
+		storage:  storage,
+		notifier: notifier,
 	}
 }
 
@@ -40,60 +49,56 @@ func (h *VersionsHandler) AddSecretVersion(w http.ResponseWriter, r *http.Reques
 		writeErrorResponse(w, http.StatusBadRequest, "Payload data is required", "INVALID_ARGUMENT")
 		return
 	}
+	if violations := validation.Payload("payload", req.Payload); len(violations) > 0 {
+		writeBadRequest(w, violations)
+		return
+	}
 
-	version, err := h.storage.AddSecretVersion(r.Context(), projectID, secretID, req.Payload.Data)
+	version, err := h.storage.AddSecretVersion(r.Context(), projectID, secretID, req.Payload)
 	if err != nil {
-		if err == storage.ErrSecretNotFound {
-			message := models.FormatResourceNotFoundError("secret", projectID, secretID)
-			writeErrorResponse(w, http.StatusNotFound, message, "NOT_FOUND")
-			return
-		}
-		writeErrorResponse(w, http.StatusInternalServerError, "Failed to add secret version", "INTERNAL")
+		writeStorageError(w, r, h.storage, err, projectID, secretID, "", "Failed to add secret version")
 		return
 	}
 
+	notify.PublishVersion(r.Context(), h.notifier, h.storage, notify.SecretVersionAdd, projectID, secretID, version)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	_ = json.NewEncoder(w).Encode(version)
 }
 
-// AccessSecretVersion handles POST requests to access the data of a specific secret version.
-func (h *VersionsHandler) AccessSecretVersion(w http.ResponseWriter, r *http.Request) {
-	projectID, secretID, versionID := extractProjectSecretAndVersionFromAccessPath(r.URL.Path)
+// GetSecretVersion handles GET requests to retrieve the metadata of a specific secret version.
+func (h *VersionsHandler) GetSecretVersion(w http.ResponseWriter, r *http.Request) {
+	projectID, secretID, versionID := extractProjectSecretAndVersionID(r.URL.Path)
 	if projectID == "" || secretID == "" || versionID == "" {
 		writeErrorResponse(w, http.StatusBadRequest, "Invalid version path", "INVALID_ARGUMENT")
 		return
 	}
 
-	data, err := h.storage.AccessSecretVersion(r.Context(), projectID, secretID, versionID)
+	version, err := h.storage.GetSecretVersion(r.Context(), projectID, secretID, versionID)
 	if err != nil {
-		if err == storage.ErrSecretNotFound {
-			message := models.FormatResourceNotFoundError("secret", projectID, secretID)
-			writeErrorResponse(w, http.StatusNotFound, message, "NOT_FOUND")
-			return
-		}
-		if err == storage.ErrVersionNotFound {
-			message := models.FormatResourceNotFoundError("version", projectID, secretID+"/"+versionID)
-			writeErrorResponse(w, http.StatusNotFound, message, "NOT_FOUND")
-			return
-		}
-		writeErrorResponse(w, http.StatusInternalServerError, "Failed to access secret version", "INTERNAL")
+		writeStorageError(w, r, h.storage, err, projectID, secretID, versionID, "Failed to get secret version")
 		return
 	}
 
-	version, err := h.storage.GetSecretVersion(r.Context(), projectID, secretID, versionID)
-	if err != nil {
-		writeErrorResponse(w, http.StatusInternalServerError, "Failed to get version metadata", "INTERNAL")
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(version)
+}
+
+// AccessSecretVersion handles POST requests to access the data of a specific secret version.
+func (h *VersionsHandler) AccessSecretVersion(w http.ResponseWriter, r *http.Request) {
+	projectID, secretID, versionID := extractProjectSecretAndVersionFromAccessPath(r.URL.Path)
+	if projectID == "" || secretID == "" || versionID == "" {
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid version path", "INVALID_ARGUMENT")
 		return
 	}
 
-	response := models.AccessSecretVersionResponse{
-		Name: version.Name,
-		Payload: &models.SecretPayload{
-			Data:     data,
-			Checksum: version.Checksum,
-		},
+	version, data, err := h.storage.AccessSecretVersion(r.Context(), projectID, secretID, versionID)
+	if err != nil {
+		writeStorageError(w, r, h.storage, err, projectID, secretID, versionID, "Failed to access secret version")
+		return
 	}
+	response := models.NewAccessSecretVersionResponse(version, data)
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(response)
@@ -107,60 +112,75 @@ func (h *VersionsHandler) ListSecretVersions(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	pageSize := 100
-	if pageSizeStr := r.URL.Query().Get("pageSize"); pageSizeStr != "" {
-		if ps, err := strconv.Atoi(pageSizeStr); err == nil && ps > 0 && ps <= 1000 {
-			pageSize = ps
-		}
-	}
+	requested, _ := strconv.Atoi(r.URL.Query().Get("pageSize"))
+	pageSize := pagination.PageSize(requested)
 
 	pageToken := r.URL.Query().Get("pageToken")
 
-	versions, nextPageToken, err := h.storage.ListSecretVersions(r.Context(), projectID, secretID, pageSize, pageToken)
+	match, err := filter.Parse(r.URL.Query().Get("filter"), models.VersionFilterFields)
+	if err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, models.FormatInvalidFilterError(err), "INVALID_ARGUMENT")
+		return
+	}
+
+	versions, nextPageToken, totalSize, err := h.storage.ListSecretVersions(r.Context(), projectID, secretID, match, pageSize, pageToken)
 	if err != nil {
-		if err == storage.ErrSecretNotFound {
-			message := models.FormatResourceNotFoundError("secret", projectID, secretID)
-			writeErrorResponse(w, http.StatusNotFound, message, "NOT_FOUND")
-			return
-		}
-		writeErrorResponse(w, http.StatusInternalServerError, "Failed to list secret versions", "INTERNAL")
+		writeStorageError(w, r, h.storage, err, projectID, secretID, "", "Failed to list secret versions")
 		return
 	}
 
 	response := models.ListSecretVersionsResponse{
 		Versions:      versions,
 		NextPageToken: nextPageToken,
-		TotalSize:     len(versions),
+		TotalSize:     totalSize,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(response)
 }
 
-// DeleteSecretVersion handles DELETE requests to remove a specific secret version.
-func (h *VersionsHandler) DeleteSecretVersion(w http.ResponseWriter, r *http.Request) {
-	projectID, secretID, versionID := extractProjectSecretAndVersionID(r.URL.Path)
+// EnableSecretVersion handles POST requests to move a secret version to the ENABLED state.
+func (h *VersionsHandler) EnableSecretVersion(w http.ResponseWriter, r *http.Request) {
+	h.setSecretVersionState(w, r, ":enable", models.StateEnabled, notify.SecretVersionEnable)
+}
+
+// DisableSecretVersion handles POST requests to move a secret version to the DISABLED state.
+func (h *VersionsHandler) DisableSecretVersion(w http.ResponseWriter, r *http.Request) {
+	h.setSecretVersionState(w, r, ":disable", models.StateDisabled, notify.SecretVersionDisable)
+}
+
+// DestroySecretVersion handles POST requests to irreversibly destroy the data of a secret version.
+func (h *VersionsHandler) DestroySecretVersion(w http.ResponseWriter, r *http.Request) {
+	h.setSecretVersionState(w, r, ":destroy", models.StateDestroyed, notify.SecretVersionDestroy)
+}
+
+func (h *VersionsHandler) setSecretVersionState(w http.ResponseWriter, r *http.Request, verb string, state models.SecretVersionState, eventType notify.EventType) {
+	projectID, secretID, versionID := extractProjectSecretAndVersionID(strings.TrimSuffix(r.URL.Path, verb))
 	if projectID == "" || secretID == "" || versionID == "" {
 		writeErrorResponse(w, http.StatusBadRequest, "Invalid version path", "INVALID_ARGUMENT")
 		return
 	}
 
-	if err := h.storage.DeleteSecretVersion(r.Context(), projectID, secretID, versionID); err != nil {
-		if err == storage.ErrSecretNotFound {
-			message := models.FormatResourceNotFoundError("secret", projectID, secretID)
-			writeErrorResponse(w, http.StatusNotFound, message, "NOT_FOUND")
-			return
-		}
-		if err == storage.ErrVersionNotFound {
-			message := models.FormatResourceNotFoundError("version", projectID, secretID+"/"+versionID)
-			writeErrorResponse(w, http.StatusNotFound, message, "NOT_FOUND")
-			return
-		}
-		writeErrorResponse(w, http.StatusInternalServerError, "Failed to delete secret version", "INTERNAL")
+	var req models.SecretVersionStateRequest
+	if err := decodeJSON(r.Body, &req); err != nil && !errors.Is(err, io.EOF) {
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_ARGUMENT")
+		return
+	}
+
+	version, err := h.storage.SetSecretVersionState(r.Context(), projectID, secretID, versionID, state, req.Etag)
+	if err != nil {
+		writeStorageError(w, r, h.storage, err, projectID, secretID, versionID, "Failed to update secret version state")
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	// A destroy delayed by the secret's versionDestroyTtl only schedules it
+	if state == models.StateDestroyed && version.ScheduledDestroyTime != nil {
+		eventType = notify.SecretVersionDestroyScheduled
+	}
+	notify.PublishVersion(r.Context(), h.notifier, h.storage, eventType, projectID, secretID, version)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(version)
 }
 
 func extractProjectAndSecretFromAddVersionPath(path string) (string, string) {
@@ -6,18 +6,112 @@ import (
 	"os"
 	"strings"
 
+	"github.com/charlesgreen/gsm/internal/api/grpcapi"
 	"github.com/charlesgreen/gsm/internal/api/handlers"
 	"github.com/charlesgreen/gsm/internal/api/middleware"
+	"github.com/charlesgreen/gsm/internal/iam"
+	"github.com/charlesgreen/gsm/internal/kms"
+	"github.com/charlesgreen/gsm/internal/locations"
+	"github.com/charlesgreen/gsm/internal/notify"
 	"github.com/charlesgreen/gsm/internal/storage"
+	"google.golang.org/grpc"
 )
 
+// Option configures the router created by SetupRoutes and the gRPC server
+// created by SetupGRPC.
+type Option func(*options)
+
+// Locations overrides the catalog served by the Locations API and used to
+// validate regional secrets and replica locations.
+//
+// Defaults to the GSM_LOCATIONS environment variable, or the standard Google
+// Cloud regions when it is unset.
+func Locations(catalog *locations.Catalog) Option {
+	return func(o *options) {
+		o.catalog = catalog
+	}
+}
+
+// EnforceIAM rejects callers that lack the permission a method requires on the
+// targeted project or secret with PERMISSION_DENIED, and anonymous callers with
+// UNAUTHENTICATED.
+//
+// Defaults to the GSM_ENFORCE_IAM environment variable.
+func EnforceIAM() Option {
+	return func(o *options) {
+		o.enforceIAM = true
+	}
+}
+
+// IAMAdmins grants principals every permission regardless of policy, so they
+// can create fixtures and grant roles while IAM is enforced. Principals are
+// member strings or emails, as callers identify themselves.
+//
+// Defaults to the comma-separated GSM_IAM_ADMINS environment variable.
+func IAMAdmins(principals ...string) Option {
+	return func(o *options) {
+		o.iamAdmins = principals
+	}
+}
+
+// Notifier receives an event for every change to a secret or version, such as
+// SECRET_CREATE or SECRET_VERSION_ADD.
+//
+// Defaults to discarding events.
+func Notifier(notifier notify.Notifier) Option {
+	return func(o *options) {
+		o.notifier = notifier
+	}
+}
+
+// KeyRegistry serves admin endpoints under /kms/v1/ that create, disable and
+// destroy the simulated Cloud KMS keys in keys. It should be the registry the
+// storage encrypts payloads with.
+//
+// Defaults to not serving the admin endpoints.
+func KeyRegistry(keys *kms.Registry) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+type options struct {
+	catalog    *locations.Catalog
+	enforceIAM bool
+	iamAdmins  []string
+	notifier   notify.Notifier
+	keys       *kms.Registry
+}
+
+// newOptions applies opts over the defaults read from the environment.
+func newOptions(opts []Option) options {
+	options := options{
+		enforceIAM: os.Getenv("GSM_ENFORCE_IAM") == "true",
+		iamAdmins:  strings.Split(os.Getenv("GSM_IAM_ADMINS"), ","),
+	}
+	for _, o := range opts {
+		o(&options)
+	}
+	if options.catalog == nil {
+		options.catalog = locations.Parse(os.Getenv("GSM_LOCATIONS"))
+	}
+	if options.notifier == nil {
+		options.notifier = notify.Discard
+	}
+	return options
+}
+
 // SetupRoutes configures and returns an HTTP router with all API endpoints and middleware.
-func SetupRoutes(storage storage.Storage) *http.ServeMux {
+func SetupRoutes(storage storage.Storage, opts ...Option) *http.ServeMux {
+	options := newOptions(opts)
+
 	mux := http.NewServeMux()
 
-	secretsHandler := handlers.NewSecretsHandler(storage)
-	versionsHandler := handlers.NewVersionsHandler(storage)
-	healthHandler := handlers.NewHealthHandler()
+	secretsHandler := handlers.NewSecretsHandler(storage, options.catalog, options.notifier)
+	versionsHandler := handlers.NewVersionsHandler(storage, options.notifier)
+	locationsHandler := handlers.NewLocationsHandler(options.catalog)
+	iamHandler := handlers.NewIAMHandler(storage, iam.NewEnforcer(storage, options.enforceIAM, options.iamAdmins...))
+	healthHandler := handlers.NewHealthHandler(storage)
 
 	enableAuth := os.Getenv("GSM_ENABLE_AUTH") == "true"
 	enableCORS := os.Getenv("GSM_ENABLE_CORS") != "false"
@@ -41,34 +135,74 @@ func SetupRoutes(storage storage.Storage) *http.ServeMux {
 		return applyMiddleware(authMiddleware(handler))
 	}
 
+	secured := func(permission string, handler http.HandlerFunc) http.Handler {
+		return applyAuthMiddleware(iamHandler.Require(permission, handler))
+	}
+
 	mux.Handle("/health", applyMiddleware(http.HandlerFunc(healthHandler.Health)))
 	mux.Handle("/ready", applyMiddleware(http.HandlerFunc(healthHandler.Ready)))
 
 	mux.Handle("/v1/projects/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch {
-		case r.Method == http.MethodPost && matchesPattern(r.URL.Path, "/v1/projects/*/secrets"):
-			applyAuthMiddleware(http.HandlerFunc(secretsHandler.CreateSecret)).ServeHTTP(w, r)
+		case r.Method == http.MethodGet && matchesPattern(r.URL.Path, "/v1/projects/*/locations"):
+			secured(iam.LocationsList, locationsHandler.ListLocations).ServeHTTP(w, r)
+
+		case r.Method == http.MethodGet && matchesPattern(r.URL.Path, "/v1/projects/*/locations/*"):
+			secured(iam.LocationsGet, locationsHandler.GetLocation).ServeHTTP(w, r)
+
+		case r.Method == http.MethodPost && matchesSecretPattern(r.URL.Path, "/v1/projects/*/secrets"):
+			secured(iam.SecretsCreate, secretsHandler.CreateSecret).ServeHTTP(w, r)
 
-		case r.Method == http.MethodGet && matchesPattern(r.URL.Path, "/v1/projects/*/secrets"):
-			applyAuthMiddleware(http.HandlerFunc(secretsHandler.ListSecrets)).ServeHTTP(w, r)
+		case r.Method == http.MethodGet && matchesSecretPattern(r.URL.Path, "/v1/projects/*/secrets"):
+			secured(iam.SecretsList, secretsHandler.ListSecrets).ServeHTTP(w, r)
 
-		case r.Method == http.MethodGet && matchesPattern(r.URL.Path, "/v1/projects/*/secrets/*") && !containsVersions(r.URL.Path):
-			applyAuthMiddleware(http.HandlerFunc(secretsHandler.GetSecret)).ServeHTTP(w, r)
+		case r.Method == http.MethodGet && matchesSecretPattern(r.URL.Path, "/v1/projects/*/secrets/*") && !containsVersions(r.URL.Path) && !strings.Contains(r.URL.Path, ":"):
+			secured(iam.SecretsGet, secretsHandler.GetSecret).ServeHTTP(w, r)
 
-		case r.Method == http.MethodDelete && matchesPattern(r.URL.Path, "/v1/projects/*/secrets/*") && !containsVersions(r.URL.Path):
-			applyAuthMiddleware(http.HandlerFunc(secretsHandler.DeleteSecret)).ServeHTTP(w, r)
+		case r.Method == http.MethodPatch && matchesSecretPattern(r.URL.Path, "/v1/projects/*/secrets/*") && !containsVersions(r.URL.Path):
+			secured(iam.SecretsUpdate, secretsHandler.UpdateSecret).ServeHTTP(w, r)
 
-		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":addVersion") && matchesPattern(strings.TrimSuffix(r.URL.Path, ":addVersion"), "/v1/projects/*/secrets/*"):
-			applyAuthMiddleware(http.HandlerFunc(versionsHandler.AddSecretVersion)).ServeHTTP(w, r)
+		case r.Method == http.MethodDelete && matchesSecretPattern(r.URL.Path, "/v1/projects/*/secrets/*") && !containsVersions(r.URL.Path):
+			secured(iam.SecretsDelete, secretsHandler.DeleteSecret).ServeHTTP(w, r)
 
-		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, ":access") && matchesPattern(strings.TrimSuffix(r.URL.Path, ":access"), "/v1/projects/*/secrets/*/versions/*"):
-			applyAuthMiddleware(http.HandlerFunc(versionsHandler.AccessSecretVersion)).ServeHTTP(w, r)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":addVersion") && matchesSecretPattern(strings.TrimSuffix(r.URL.Path, ":addVersion"), "/v1/projects/*/secrets/*"):
+			secured(iam.VersionsAdd, versionsHandler.AddSecretVersion).ServeHTTP(w, r)
 
-		case r.Method == http.MethodGet && matchesPattern(r.URL.Path, "/v1/projects/*/secrets/*/versions"):
-			applyAuthMiddleware(http.HandlerFunc(versionsHandler.ListSecretVersions)).ServeHTTP(w, r)
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, ":access") && matchesSecretPattern(strings.TrimSuffix(r.URL.Path, ":access"), "/v1/projects/*/secrets/*/versions/*"):
+			secured(iam.VersionsAccess, versionsHandler.AccessSecretVersion).ServeHTTP(w, r)
 
-		case r.Method == http.MethodDelete && matchesPattern(r.URL.Path, "/v1/projects/*/secrets/*/versions/*") && !containsAccess(r.URL.Path):
-			applyAuthMiddleware(http.HandlerFunc(versionsHandler.DeleteSecretVersion)).ServeHTTP(w, r)
+		case r.Method == http.MethodGet && matchesSecretPattern(r.URL.Path, "/v1/projects/*/secrets/*/versions/*") && !strings.Contains(r.URL.Path, ":"):
+			secured(iam.VersionsGet, versionsHandler.GetSecretVersion).ServeHTTP(w, r)
+
+		case r.Method == http.MethodGet && matchesSecretPattern(r.URL.Path, "/v1/projects/*/secrets/*/versions"):
+			secured(iam.VersionsList, versionsHandler.ListSecretVersions).ServeHTTP(w, r)
+
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":enable") && matchesSecretPattern(strings.TrimSuffix(r.URL.Path, ":enable"), "/v1/projects/*/secrets/*/versions/*"):
+			secured(iam.VersionsEnable, versionsHandler.EnableSecretVersion).ServeHTTP(w, r)
+
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":disable") && matchesSecretPattern(strings.TrimSuffix(r.URL.Path, ":disable"), "/v1/projects/*/secrets/*/versions/*"):
+			secured(iam.VersionsDisable, versionsHandler.DisableSecretVersion).ServeHTTP(w, r)
+
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":destroy") && matchesSecretPattern(strings.TrimSuffix(r.URL.Path, ":destroy"), "/v1/projects/*/secrets/*/versions/*"):
+			secured(iam.VersionsDestroy, versionsHandler.DestroySecretVersion).ServeHTTP(w, r)
+
+		case (r.Method == http.MethodGet || r.Method == http.MethodPost) && strings.HasSuffix(r.URL.Path, ":getIamPolicy") && matchesSecretPattern(strings.TrimSuffix(r.URL.Path, ":getIamPolicy"), "/v1/projects/*/secrets/*"):
+			secured(iam.SecretsGetIamPolicy, iamHandler.GetIamPolicy).ServeHTTP(w, r)
+
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":setIamPolicy") && matchesSecretPattern(strings.TrimSuffix(r.URL.Path, ":setIamPolicy"), "/v1/projects/*/secrets/*"):
+			secured(iam.SecretsSetIamPolicy, iamHandler.SetIamPolicy).ServeHTTP(w, r)
+
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":testIamPermissions") && matchesSecretPattern(strings.TrimSuffix(r.URL.Path, ":testIamPermissions"), "/v1/projects/*/secrets/*"):
+			applyAuthMiddleware(http.HandlerFunc(iamHandler.TestIamPermissions)).ServeHTTP(w, r)
+
+		case (r.Method == http.MethodGet || r.Method == http.MethodPost) && strings.HasSuffix(r.URL.Path, ":getIamPolicy") && matchesPattern(strings.TrimSuffix(r.URL.Path, ":getIamPolicy"), "/v1/projects/*"):
+			secured(iam.ProjectsGetIam, iamHandler.GetIamPolicy).ServeHTTP(w, r)
+
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":setIamPolicy") && matchesPattern(strings.TrimSuffix(r.URL.Path, ":setIamPolicy"), "/v1/projects/*"):
+			secured(iam.ProjectsSetIam, iamHandler.SetIamPolicy).ServeHTTP(w, r)
+
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":testIamPermissions") && matchesPattern(strings.TrimSuffix(r.URL.Path, ":testIamPermissions"), "/v1/projects/*"):
+			applyAuthMiddleware(http.HandlerFunc(iamHandler.TestIamPermissions)).ServeHTTP(w, r)
 
 		default:
 			applyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
@@ -79,13 +213,66 @@ func SetupRoutes(storage storage.Storage) *http.ServeMux {
 		}
 	}))
 
+	if options.keys != nil {
+		kmsHandler := handlers.NewKMSHandler(options.keys)
+		mux.Handle("/kms/v1/projects/", applyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			const key = "/kms/v1/projects/*/locations/*/keyRings/*/cryptoKeys/*"
+			switch {
+			case r.Method == http.MethodPost && matchesPattern(r.URL.Path, "/kms/v1/projects/*/locations/*/keyRings/*/cryptoKeys"):
+				kmsHandler.CreateCryptoKey(w, r)
+
+			case r.Method == http.MethodGet && matchesPattern(r.URL.Path, key):
+				kmsHandler.GetCryptoKey(w, r)
+
+			case r.Method == http.MethodPost && matchesPattern(r.URL.Path, key+"/cryptoKeyVersions"):
+				kmsHandler.CreateCryptoKeyVersion(w, r)
+
+			case r.Method == http.MethodGet && matchesPattern(r.URL.Path, key+"/cryptoKeyVersions/*"):
+				kmsHandler.GetCryptoKeyVersion(w, r)
+
+			case r.Method == http.MethodPatch && matchesPattern(r.URL.Path, key+"/cryptoKeyVersions/*"):
+				kmsHandler.UpdateCryptoKeyVersion(w, r)
+
+			case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, ":destroy") && matchesPattern(strings.TrimSuffix(r.URL.Path, ":destroy"), key+"/cryptoKeyVersions/*"):
+				kmsHandler.DestroyCryptoKeyVersion(w, r)
+
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"error": {"code": 404, "message": "Not found", "status": "NOT_FOUND"}}`))
+			}
+		})))
+	}
+
 	return mux
 }
 
+// SetupGRPC configures and returns a gRPC server for the Secret Manager and
+// Locations services, backed by the same storage as SetupRoutes. Given the same
+// options, it validates, authorises and reports calls as the router does.
+func SetupGRPC(storage storage.Storage, opts ...Option) *grpc.Server {
+	options := newOptions(opts)
+
+	return grpcapi.NewServer(grpcapi.Config{
+		Storage:     storage,
+		Catalog:     options.catalog,
+		Notifier:    options.notifier,
+		IAM:         iam.NewEnforcer(storage, options.enforceIAM, options.iamAdmins...),
+		RequireAuth: os.Getenv("GSM_ENABLE_AUTH") == "true",
+	})
+}
+
 func matchesPattern(path, pattern string) bool {
 	return pathMatches(path, pattern)
 }
 
+// matchesSecretPattern matches a global /v1/projects/*/secrets pattern as well as
+// its regional /v1/projects/*/locations/*/secrets counterpart.
+func matchesSecretPattern(path, pattern string) bool {
+	regional := strings.Replace(pattern, "/projects/*/", "/projects/*/locations/*/", 1)
+	return matchesPattern(path, pattern) || matchesPattern(path, regional)
+}
+
 func pathMatches(path, pattern string) bool {
 	pathParts := splitPath(path)
 	patternParts := splitPath(pattern)
@@ -132,10 +319,6 @@ func containsVersions(path string) bool {
 	return contains(path, "/versions")
 }
 
-func containsAccess(path string) bool {
-	return contains(path, ":access")
-}
-
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && indexOf(s, substr) >= 0
 }
@@ -0,0 +1,166 @@
+// Package filter implements the list filter syntax Secret Manager accepts on
+// ListSecrets and ListSecretVersions, a subset of the AIP-160 grammar.
+//
+// A filter is made of restrictions such as labels.env=prod, name:db- or
+// create_time>"2024-01-01", combined with AND, OR, NOT (or a leading -) and
+// parentheses. As in AIP-160, OR binds tighter than AND, and restrictions
+// separated only by whitespace are joined with AND.
+package filter
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resource is something a filter can be matched against, such as a secret or a
+// secret version.
+type Resource interface {
+	// FilterValues returns the values of a field, given as a camelCase path
+	// such as "createTime" or "labels.env". The boolean reports whether the
+	// field is known at all. Map fields without a key return their keys.
+	FilterValues(field string) ([]string, bool)
+}
+
+// Filter is a parsed list filter.
+type Filter struct {
+	root node
+	src  string
+}
+
+// String returns the filter as it was written, or an empty string for a nil
+// filter.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.src
+}
+
+// Match reports whether r satisfies the filter. A nil filter matches every
+// resource.
+func (f *Filter) Match(r Resource) bool {
+	return f == nil || f.root.match(r)
+}
+
+type node interface {
+	match(r Resource) bool
+}
+
+type and struct{ left, right node }
+
+func (n and) match(r Resource) bool { return n.left.match(r) && n.right.match(r) }
+
+type or struct{ left, right node }
+
+func (n or) match(r Resource) bool { return n.left.match(r) || n.right.match(r) }
+
+type not struct{ operand node }
+
+func (n not) match(r Resource) bool { return !n.operand.match(r) }
+
+// restriction compares the values of a field against an argument.
+type restriction struct {
+	field      string
+	comparator string
+	arg        string
+}
+
+func (n restriction) match(r Resource) bool {
+	values, ok := r.FilterValues(n.field)
+	if !ok {
+		return false
+	}
+
+	if n.comparator == "!=" {
+		for _, v := range values {
+			if compare(v, "=", n.arg) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, v := range values {
+		if compare(v, n.comparator, n.arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// global is a bare value without a field, which matches resources whose name
+// contains it.
+type global struct{ arg string }
+
+func (n global) match(r Resource) bool {
+	return restriction{field: "name", comparator: ":", arg: n.arg}.match(r)
+}
+
+// compare applies comparator to a field value and an argument. Timestamps and
+// numbers are compared by value, everything else as strings. The has operator
+// (:) matches a case-insensitive substring, or any value at all for "*".
+func compare(value, comparator, arg string) bool {
+	if comparator == ":" {
+		return arg == "*" || strings.Contains(strings.ToLower(value), strings.ToLower(arg))
+	}
+
+	cmp := strings.Compare(value, arg)
+	if vt, at, ok := parseTimes(value, arg); ok {
+		cmp = vt.Compare(at)
+	} else if vn, an, ok := parseNumbers(value, arg); ok {
+		cmp = compareFloats(vn, an)
+	}
+
+	switch comparator {
+	case "=":
+		return cmp == 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// timeLayouts are the timestamp formats accepted in filter arguments.
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"}
+
+func parseTimes(value, arg string) (time.Time, time.Time, bool) {
+	vt, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	for _, layout := range timeLayouts {
+		if at, err := time.Parse(layout, arg); err == nil {
+			return vt, at, true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+func parseNumbers(value, arg string) (float64, float64, bool) {
+	vn, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	an, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return vn, an, true
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,334 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charlesgreen/gsm/internal/jsonname"
+)
+
+// SyntaxError reports a malformed filter and where parsing stopped.
+type SyntaxError struct {
+	// Column is the 1-based position of the offending token.
+	Column int
+	// Token is the offending token, or empty at the end of the filter.
+	Token string
+	// Expected describes what the parser was looking for.
+	Expected string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("unexpected end of filter, expected %s", e.Expected)
+	}
+	return fmt.Sprintf("unexpected %q at column %d, expected %s", e.Token, e.Column, e.Expected)
+}
+
+// FieldError reports a restriction on a field the resource does not have.
+type FieldError struct {
+	// Column is the 1-based position of the field.
+	Column int
+	// Field is the field as it was written.
+	Field string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("unknown field %q at column %d", e.Field, e.Column)
+}
+
+// Fields lists the fields a filter may restrict, as camelCase paths such as
+// "createTime" or "rotation.nextRotationTime". A path ending in ".*" is a map,
+// which may be restricted as a whole or by key, as in labels:env and
+// labels.env=prod.
+type Fields []string
+
+// has reports whether field, in camelCase, is one of the fields.
+func (f Fields) has(field string) bool {
+	for _, known := range f {
+		if known == field {
+			return true
+		}
+		if m, ok := strings.CutSuffix(known, ".*"); ok && (field == m || strings.HasPrefix(field, m+".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse parses a list filter restricting fields. An empty or blank filter
+// parses to nil, which matches everything.
+func Parse(src string, fields Fields) (*Filter, error) {
+	p := &parser{src: src, fields: fields}
+	p.skipSpace()
+	if p.atEnd() {
+		return nil, nil
+	}
+
+	root, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if !p.atEnd() {
+		return nil, p.errorf("AND, OR or the end of the filter")
+	}
+	return &Filter{root: root, src: src}, nil
+}
+
+// comparators in the order they are tried, so two character operators win.
+var comparators = []string{"<=", ">=", "!=", "=", "<", ">", ":"}
+
+type parser struct {
+	src    string
+	pos    int
+	fields Fields
+}
+
+// expression := sequence { AND sequence }
+func (p *parser) expression() (node, error) {
+	left, err := p.sequence()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.sequence()
+		if err != nil {
+			return nil, err
+		}
+		left = and{left, right}
+	}
+	return left, nil
+}
+
+// sequence := factor { factor }
+func (p *parser) sequence() (node, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if p.atEnd() || p.peek() == ')' || p.peekKeyword("AND") {
+			return left, nil
+		}
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = and{left, right}
+	}
+}
+
+// factor := term { OR term }
+func (p *parser) factor() (node, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = or{left, right}
+	}
+	return left, nil
+}
+
+// term := [ NOT | - ] simple
+func (p *parser) term() (node, error) {
+	p.skipSpace()
+	negate := p.keyword("NOT")
+	if !negate && p.peek() == '-' {
+		p.pos++
+		negate = true
+	}
+
+	operand, err := p.simple()
+	if err != nil {
+		return nil, err
+	}
+	if negate {
+		return not{operand}, nil
+	}
+	return operand, nil
+}
+
+// simple := restriction | "(" expression ")"
+func (p *parser) simple() (node, error) {
+	p.skipSpace()
+	if p.peek() != '(' {
+		return p.restriction()
+	}
+
+	p.pos++
+	inner, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.peek() != ')' {
+		return nil, p.errorf(`")"`)
+	}
+	p.pos++
+	return inner, nil
+}
+
+// restriction := comparable [ comparator arg ]
+func (p *parser) restriction() (node, error) {
+	if p.atEnd() || p.peek() == ')' || p.peekKeyword("AND") || p.peekKeyword("OR") || p.peekKeyword("NOT") {
+		return nil, p.errorf("a field or value")
+	}
+
+	start := p.pos
+	name, err := p.word(func(c byte) bool { return strings.IndexByte("<>=!:", c) >= 0 })
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	comparator := p.comparator()
+	if comparator == "" {
+		return global{arg: name}, nil
+	}
+
+	p.skipSpace()
+	if p.atEnd() || p.peek() == ')' || p.peekKeyword("AND") || p.peekKeyword("OR") {
+		return nil, p.errorf(fmt.Sprintf("a value after %q", name+comparator))
+	}
+	arg, err := p.word(nil)
+	if err != nil {
+		return nil, err
+	}
+	field := normalizeField(name)
+	if !p.fields.has(field) {
+		return nil, &FieldError{Column: start + 1, Field: name}
+	}
+	return restriction{field: field, comparator: comparator, arg: arg}, nil
+}
+
+// word reads a quoted string, or a run of characters up to whitespace, a
+// parenthesis or any character stop reports.
+func (p *parser) word(stop func(byte) bool) (string, error) {
+	if p.peek() == '"' {
+		return p.quoted()
+	}
+
+	start := p.pos
+	for !p.atEnd() {
+		c := p.src[p.pos]
+		if isSpace(c) || c == '(' || c == ')' || (stop != nil && stop(c)) {
+			break
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("a field or value")
+	}
+	return p.src[start:p.pos], nil
+}
+
+func (p *parser) quoted() (string, error) {
+	start := p.pos
+	p.pos++
+
+	var b strings.Builder
+	for !p.atEnd() {
+		c := p.src[p.pos]
+		p.pos++
+		switch {
+		case c == '\\' && !p.atEnd():
+			b.WriteByte(p.src[p.pos])
+			p.pos++
+		case c == '"':
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	p.pos = start
+	return "", &SyntaxError{Column: start + 1, Token: p.src[start:], Expected: "a closing quote"}
+}
+
+func (p *parser) comparator() string {
+	for _, c := range comparators {
+		if strings.HasPrefix(p.src[p.pos:], c) {
+			p.pos += len(c)
+			return c
+		}
+	}
+	return ""
+}
+
+// keyword consumes kw if it is the next token.
+func (p *parser) keyword(kw string) bool {
+	p.skipSpace()
+	if !p.peekKeyword(kw) {
+		return false
+	}
+	p.pos += len(kw)
+	return true
+}
+
+// peekKeyword reports whether kw is the next token, which requires it to end
+// at whitespace, a parenthesis or the end of the filter so fields such as ORDER
+// still parse.
+func (p *parser) peekKeyword(kw string) bool {
+	if !strings.HasPrefix(p.src[p.pos:], kw) {
+		return false
+	}
+	end := p.pos + len(kw)
+	return end == len(p.src) || isSpace(p.src[end]) || p.src[end] == '(' || p.src[end] == ')'
+}
+
+func (p *parser) peek() byte {
+	if p.atEnd() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *parser) atEnd() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *parser) skipSpace() {
+	for !p.atEnd() && isSpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+// errorf reports the token at the current position as unexpected.
+func (p *parser) errorf(expected string) error {
+	if p.atEnd() {
+		return &SyntaxError{Expected: expected}
+	}
+
+	end := p.pos + 1
+	if c := p.src[p.pos]; c != '(' && c != ')' {
+		for end < len(p.src) && !isSpace(p.src[end]) && p.src[end] != '(' && p.src[end] != ')' {
+			end++
+		}
+	}
+	return &SyntaxError{Column: p.pos + 1, Token: p.src[p.pos:end], Expected: expected}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// normalizeField converts the snake_case segments of a field path to camelCase,
+// leaving map keys such as the "my_key" in labels.my_key untouched.
+func normalizeField(field string) string {
+	head, rest, hasRest := strings.Cut(field, ".")
+	head = jsonname.FromProto(head)
+	if !hasRest {
+		return head
+	}
+	switch head {
+	case "labels", "annotations", "versionAliases":
+		return head + "." + rest
+	}
+	return head + "." + normalizeField(rest)
+}
@@ -0,0 +1,59 @@
+package iam
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/storage"
+)
+
+// Enforcer checks callers against the policies kept in storage. The REST and
+// gRPC APIs share one, so both grant and deny the same calls.
+type Enforcer struct {
+	storage storage.Storage
+	enforce bool
+	admins  []string
+}
+
+// NewEnforcer creates an Enforcer over the policies in store. When enforce is
+// unset every call is allowed. The admins hold every permission regardless of
+// policy, so fixtures can create secrets and grant roles; they are member
+// strings or emails, as callers identify themselves.
+func NewEnforcer(store storage.Storage, enforce bool, admins ...string) *Enforcer {
+	e := &Enforcer{storage: store, enforce: enforce}
+	for _, admin := range admins {
+		if principal := Principal(admin); principal != "" {
+			e.admins = append(e.admins, principal)
+		}
+	}
+	return e
+}
+
+// Enforced reports whether callers must be identified and hold the permission
+// each method needs.
+func (e *Enforcer) Enforced() bool {
+	return e.enforce
+}
+
+// Allowed reports whether principal is an admin or holds permission through
+// the policy of the project or, when secretID is set, of the secret. Regional
+// project IDs are qualified with their location, which project policies ignore.
+func (e *Enforcer) Allowed(ctx context.Context, principal, permission, projectID, secretID string) bool {
+	if slices.Contains(e.admins, principal) {
+		return true
+	}
+
+	var policies []*models.Policy
+	baseProjectID, _, _ := strings.Cut(projectID, "/locations/")
+	if policy, err := e.storage.GetIamPolicy(ctx, baseProjectID, ""); err == nil {
+		policies = append(policies, policy)
+	}
+	if secretID != "" {
+		if policy, err := e.storage.GetIamPolicy(ctx, projectID, secretID); err == nil {
+			policies = append(policies, policy)
+		}
+	}
+	return Allowed(principal, permission, policies...)
+}
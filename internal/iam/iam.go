@@ -0,0 +1,124 @@
+// Package iam evaluates IAM policies for the emulator's optional enforcement
+// mode, using the predefined Secret Manager and basic roles.
+package iam
+
+import (
+	"strings"
+
+	"github.com/charlesgreen/gsm/internal/models"
+)
+
+// Permissions checked by the emulator's API methods.
+const (
+	SecretsCreate       = "secretmanager.secrets.create"
+	SecretsDelete       = "secretmanager.secrets.delete"
+	SecretsGet          = "secretmanager.secrets.get"
+	SecretsList         = "secretmanager.secrets.list"
+	SecretsUpdate       = "secretmanager.secrets.update"
+	SecretsGetIamPolicy = "secretmanager.secrets.getIamPolicy"
+	SecretsSetIamPolicy = "secretmanager.secrets.setIamPolicy"
+	VersionsAdd         = "secretmanager.versions.add"
+	VersionsAccess      = "secretmanager.versions.access"
+	VersionsDestroy     = "secretmanager.versions.destroy"
+	VersionsDisable     = "secretmanager.versions.disable"
+	VersionsEnable      = "secretmanager.versions.enable"
+	VersionsGet         = "secretmanager.versions.get"
+	VersionsList        = "secretmanager.versions.list"
+	LocationsGet        = "secretmanager.locations.get"
+	LocationsList       = "secretmanager.locations.list"
+	ProjectsGetIam      = "resourcemanager.projects.getIamPolicy"
+	ProjectsSetIam      = "resourcemanager.projects.setIamPolicy"
+)
+
+var allSecretManager = []string{
+	SecretsCreate, SecretsDelete, SecretsGet, SecretsList, SecretsUpdate,
+	SecretsGetIamPolicy, SecretsSetIamPolicy,
+	VersionsAdd, VersionsAccess, VersionsDestroy, VersionsDisable, VersionsEnable, VersionsGet, VersionsList,
+	LocationsGet, LocationsList,
+}
+
+var viewer = []string{
+	SecretsGet, SecretsList, SecretsGetIamPolicy, VersionsGet, VersionsList, LocationsGet, LocationsList,
+}
+
+// rolePermissions maps the predefined roles to the permissions they grant.
+var rolePermissions = map[string][]string{
+	"roles/owner":                              append(append([]string{}, allSecretManager...), ProjectsGetIam, ProjectsSetIam),
+	"roles/editor":                             without(allSecretManager, SecretsSetIamPolicy),
+	"roles/viewer":                             append(append([]string{}, viewer...), ProjectsGetIam),
+	"roles/secretmanager.admin":                allSecretManager,
+	"roles/secretmanager.viewer":               viewer,
+	"roles/secretmanager.secretAccessor":       {VersionsAccess},
+	"roles/secretmanager.secretVersionAdder":   {VersionsAdd},
+	"roles/secretmanager.secretVersionManager": {VersionsAdd, VersionsDestroy, VersionsDisable, VersionsEnable, VersionsGet, VersionsList},
+}
+
+// Allowed reports whether principal holds permission through any of the policies.
+func Allowed(principal, permission string, policies ...*models.Policy) bool {
+	for _, policy := range policies {
+		if policy == nil {
+			continue
+		}
+		for _, binding := range policy.Bindings {
+			if !grants(binding.Role, permission) {
+				continue
+			}
+			for _, member := range binding.Members {
+				if matches(member, principal) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Principal normalises a caller identity into an IAM member string. Identities
+// that already carry a type prefix are kept; bare emails become users, or
+// service accounts for *.gserviceaccount.com addresses.
+func Principal(identity string) string {
+	identity = strings.TrimSpace(identity)
+	if identity == "" || strings.Contains(identity, ":") {
+		return identity
+	}
+	if !strings.Contains(identity, "@") {
+		return ""
+	}
+	if strings.HasSuffix(identity, ".gserviceaccount.com") {
+		return "serviceAccount:" + identity
+	}
+	return "user:" + identity
+}
+
+func grants(role, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func matches(member, principal string) bool {
+	switch {
+	case member == "allUsers":
+		return true
+	case member == "allAuthenticatedUsers":
+		return principal != ""
+	case strings.HasPrefix(member, "domain:"):
+		_, email, ok := strings.Cut(principal, ":")
+		return ok && strings.HasSuffix(email, "@"+strings.TrimPrefix(member, "domain:"))
+	default:
+		return member == principal
+	}
+}
+
+func without(permissions []string, excluded string) []string {
+	result := make([]string, 0, len(permissions))
+	for _, p := range permissions {
+		if p != excluded {
+			result = append(result, p)
+		}
+	}
+	return result
+}
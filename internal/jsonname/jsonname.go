@@ -0,0 +1,30 @@
+// Package jsonname converts the snake_case field names of the Secret Manager
+// protos to the camelCase names its JSON API uses.
+package jsonname
+
+import "strings"
+
+// FromProto converts a snake_case proto field name, or a path of them, to the
+// camelCase name the JSON API uses. Names without underscores are returned as
+// they are.
+func FromProto(s string) string {
+	parts := strings.Split(s, "_")
+	if len(parts) < 2 {
+		return s
+	}
+
+	var camelCase string
+	for _, p := range parts {
+		if len(p) == 0 {
+			continue
+		}
+
+		// The first segment written should stay naturally cased
+		if camelCase == "" {
+			camelCase += p
+		} else {
+			camelCase += strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return camelCase
+}
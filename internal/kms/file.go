@@ -0,0 +1,123 @@
+package kms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charlesgreen/gsm/internal/atomicfile"
+)
+
+// registryFile is the format of the file a registry is kept in.
+type registryFile struct {
+	Keys []fileKey `json:"keys"`
+}
+
+type fileKey struct {
+	Name       string        `json:"name"`
+	CreateTime time.Time     `json:"createTime"`
+	Versions   []fileVersion `json:"versions"`
+}
+
+type fileVersion struct {
+	CryptoKeyVersion
+	// Material is the AES-256 key of the version, absent once it is destroyed.
+	Material []byte `json:"material,omitempty"`
+}
+
+// Open creates a registry kept in the file at path, the GSM_KMS_FILE
+// environment variable, loading the keys already saved there. Each key version
+// gets random material that only the file holds, so the file must be kept as
+// secret as the data encrypted under its keys, and apart from it.
+func Open(path string) (*Registry, error) {
+	r := &Registry{keys: make(map[string]*key), path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file registryFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("reading KMS keys from %s: %w", path, err)
+	}
+	for _, fk := range file.Keys {
+		k, err := fk.key()
+		if err != nil {
+			return nil, fmt.Errorf("reading KMS keys from %s: %w", path, err)
+		}
+		r.keys[k.name] = k
+	}
+	return r, nil
+}
+
+// key validates a saved key and converts it back.
+func (fk fileKey) key() (*key, error) {
+	if !keyNamePattern.MatchString(fk.Name) {
+		return nil, fmt.Errorf("%s: %w", fk.Name, ErrInvalidName)
+	}
+	if len(fk.Versions) == 0 {
+		return nil, fmt.Errorf("%s has no versions", fk.Name)
+	}
+
+	k := &key{name: fk.Name, createTime: fk.CreateTime}
+	for i, fv := range fk.Versions {
+		version := fv.CryptoKeyVersion
+		if version.Name != versionName(fk.Name, i+1) {
+			return nil, fmt.Errorf("%s: version %d is named %s", fk.Name, i+1, version.Name)
+		}
+		switch version.State {
+		case Enabled, Disabled:
+			if len(fv.Material) != 32 {
+				return nil, fmt.Errorf("%s has %d bytes of key material, not 32", version.Name, len(fv.Material))
+			}
+		case Destroyed:
+			fv.Material = nil
+		default:
+			return nil, fmt.Errorf("%s has unknown state %q", version.Name, version.State)
+		}
+		k.versions = append(k.versions, &version)
+		k.material = append(k.material, fv.Material)
+	}
+	return k, nil
+}
+
+// Persistent reports whether the registry is kept in a file, and so holds
+// random key material rather than material derived from key names.
+func (r *Registry) Persistent() bool {
+	return r.path != ""
+}
+
+// save writes the registry to its file, if it has one. Callers must hold r.mu
+// for writing.
+func (r *Registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	var file registryFile
+	for _, k := range r.keys {
+		fk := fileKey{Name: k.name, CreateTime: k.createTime}
+		for i, version := range k.versions {
+			fk.Versions = append(fk.Versions, fileVersion{CryptoKeyVersion: *version, Material: k.material[i]})
+		}
+		file.Keys = append(file.Keys, fk)
+	}
+	slices.SortFunc(file.Keys, func(a, b fileKey) int { return strings.Compare(a.Name, b.Name) })
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(r.path, data, 0o600); err != nil {
+		return fmt.Errorf("saving KMS keys to %s: %w", r.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+// Package kms simulates the Cloud KMS keys that customer-managed encryption
+// (CMEK) refers to. Keys live in a local registry, and version payloads are
+// sealed with AES-GCM under the primary version of the secret's key.
+//
+// A registry created with NewRegistry derives key material from the key
+// version name, so that data encrypted by one emulator run can be decrypted by
+// the next. That provides no protection and exists only so that revoking a key
+// has the same effect as in production. A registry created with Open gives each
+// key version random material instead, and keeps it in a file with the keys.
+package kms
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State is the state of a crypto key version.
+type State string
+
+const (
+	// Enabled key versions may encrypt and decrypt.
+	Enabled State = "ENABLED"
+	// Disabled key versions may be enabled again but cannot be used meanwhile.
+	Disabled State = "DISABLED"
+	// Destroyed key versions have lost their material permanently.
+	Destroyed State = "DESTROYED"
+)
+
+var (
+	// ErrKeyExists is returned when creating a key that is already registered.
+	ErrKeyExists = errors.New("crypto key already exists")
+	// ErrInvalidName is returned for names that are not crypto key resource names.
+	ErrInvalidName = errors.New("invalid crypto key name")
+	// ErrInvalidCiphertext is returned when a ciphertext cannot be decrypted.
+	ErrInvalidCiphertext = errors.New("invalid ciphertext")
+)
+
+// NotFoundError is returned when a crypto key or key version is not registered.
+type NotFoundError struct {
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("crypto key %s not found", e.Name)
+}
+
+// StateError is returned when a crypto key version is used, or changed, while
+// in a state that does not allow it.
+type StateError struct {
+	Name  string
+	State State
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("crypto key version %s is %s", e.Name, e.State)
+}
+
+// keyNamePattern matches crypto key resource names.
+var keyNamePattern = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// CryptoKey is a registered key and its current primary version.
+type CryptoKey struct {
+	Name       string            `json:"name"`
+	Primary    *CryptoKeyVersion `json:"primary,omitempty"`
+	CreateTime time.Time         `json:"createTime"`
+}
+
+// CryptoKeyVersion is one version of a crypto key.
+type CryptoKeyVersion struct {
+	Name        string     `json:"name"`
+	State       State      `json:"state"`
+	CreateTime  time.Time  `json:"createTime"`
+	DestroyTime *time.Time `json:"destroyTime,omitempty"`
+}
+
+type key struct {
+	name       string
+	createTime time.Time
+	versions   []*CryptoKeyVersion // the last one is the primary
+	material   [][]byte            // of each version, nil once destroyed
+}
+
+func (k *key) cryptoKey() *CryptoKey {
+	primary := *k.versions[len(k.versions)-1]
+	return &CryptoKey{Name: k.name, Primary: &primary, CreateTime: k.createTime}
+}
+
+// Registry holds the crypto keys known to the emulator. It is safe for
+// concurrent use.
+type Registry struct {
+	mu   sync.RWMutex
+	keys map[string]*key
+	path string // where the keys are saved, empty to keep them in memory
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{keys: make(map[string]*key)}
+}
+
+// Parse creates a registry from a comma-separated list of crypto key names,
+// the format of the GSM_KMS_KEYS environment variable. Each key starts with
+// one enabled version.
+func Parse(spec string) (*Registry, error) {
+	r := NewRegistry()
+	if err := r.Register(spec); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Register creates the keys in a comma-separated list of crypto key names that
+// are not registered yet, such as keys listed in GSM_KMS_KEYS that a registry
+// opened from a file already holds.
+func (r *Registry) Register(spec string) error {
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, err := r.CreateKey(name); err != nil && err != ErrKeyExists {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// CreateKey registers a key with a single enabled version.
+func (r *Registry) CreateKey(name string) (*CryptoKey, error) {
+	if !keyNamePattern.MatchString(name) {
+		return nil, ErrInvalidName
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.keys[name]; exists {
+		return nil, ErrKeyExists
+	}
+	now := time.Now().UTC()
+	k := &key{name: name, createTime: now}
+	k.versions = append(k.versions, &CryptoKeyVersion{Name: versionName(name, 1), State: Enabled, CreateTime: now})
+	k.material = append(k.material, r.newMaterial(k.versions[0].Name))
+	r.keys[name] = k
+	if err := r.save(); err != nil {
+		delete(r.keys, name)
+		return nil, err
+	}
+	return k.cryptoKey(), nil
+}
+
+// GetKey returns a registered key.
+func (r *Registry) GetKey(name string) (*CryptoKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	k, exists := r.keys[name]
+	if !exists {
+		return nil, &NotFoundError{Name: name}
+	}
+	return k.cryptoKey(), nil
+}
+
+// CreateKeyVersion adds an enabled version to a key and makes it the primary,
+// so new payloads are encrypted under it while older ones stay readable.
+func (r *Registry) CreateKeyVersion(keyName string) (*CryptoKeyVersion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k, exists := r.keys[keyName]
+	if !exists {
+		return nil, &NotFoundError{Name: keyName}
+	}
+	version := &CryptoKeyVersion{
+		Name:       versionName(keyName, len(k.versions)+1),
+		State:      Enabled,
+		CreateTime: time.Now().UTC(),
+	}
+	k.versions = append(k.versions, version)
+	k.material = append(k.material, r.newMaterial(version.Name))
+	if err := r.save(); err != nil {
+		k.versions, k.material = k.versions[:len(k.versions)-1], k.material[:len(k.material)-1]
+		return nil, err
+	}
+	copied := *version
+	return &copied, nil
+}
+
+// GetKeyVersion returns a version of a registered key.
+func (r *Registry) GetKeyVersion(name string) (*CryptoKeyVersion, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	k, n, err := r.lookupVersion(name)
+	if err != nil {
+		return nil, err
+	}
+	copied := *k.versions[n-1]
+	return &copied, nil
+}
+
+// SetKeyVersionState enables, disables or destroys a key version. Destroyed
+// versions cannot change state again.
+func (r *Registry) SetKeyVersionState(name string, state State) (*CryptoKeyVersion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k, n, err := r.lookupVersion(name)
+	if err != nil {
+		return nil, err
+	}
+	version := k.versions[n-1]
+	if version.State == Destroyed {
+		return nil, &StateError{Name: version.Name, State: version.State}
+	}
+
+	previous, material := *version, k.material[n-1]
+	version.State = state
+	if state == Destroyed {
+		destroyTime := time.Now().UTC()
+		version.DestroyTime = &destroyTime
+		k.material[n-1] = nil
+	}
+	if err := r.save(); err != nil {
+		*version, k.material[n-1] = previous, material
+		return nil, err
+	}
+	copied := *version
+	return &copied, nil
+}
+
+// Encrypt seals plaintext under the primary version of the named key and
+// returns the ciphertext with the name of the key version used.
+func (r *Registry) Encrypt(keyName string, plaintext []byte) ([]byte, string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	k, exists := r.keys[keyName]
+	if !exists {
+		return nil, "", &NotFoundError{Name: keyName}
+	}
+	primary := k.versions[len(k.versions)-1]
+	if primary.State != Enabled {
+		return nil, "", &StateError{Name: primary.Name, State: primary.State}
+	}
+
+	aead, err := newAEAD(k.material[len(k.material)-1])
+	if err != nil {
+		return nil, "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(primary.Name)), primary.Name, nil
+}
+
+// Decrypt opens a ciphertext produced by Encrypt with the named key version.
+func (r *Registry) Decrypt(keyVersionName string, ciphertext []byte) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	k, n, err := r.lookupVersion(keyVersionName)
+	if err != nil {
+		return nil, err
+	}
+	version := k.versions[n-1]
+	if version.State != Enabled {
+		return nil, &StateError{Name: version.Name, State: version.State}
+	}
+
+	aead, err := newAEAD(k.material[n-1])
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(version.Name))
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	return plaintext, nil
+}
+
+// lookupVersion finds the key of a key version by name, along with the
+// version's number. Callers must hold r.mu.
+func (r *Registry) lookupVersion(name string) (*key, int, error) {
+	keyName, number, ok := strings.Cut(name, "/cryptoKeyVersions/")
+	n, err := strconv.Atoi(number)
+	if !ok || err != nil {
+		return nil, 0, &NotFoundError{Name: name}
+	}
+	k, exists := r.keys[keyName]
+	if !exists || n < 1 || n > len(k.versions) {
+		return nil, 0, &NotFoundError{Name: name}
+	}
+	return k, n, nil
+}
+
+func versionName(keyName string, n int) string {
+	return fmt.Sprintf("%s/cryptoKeyVersions/%d", keyName, n)
+}
+
+// newMaterial returns the key material of a new key version: random when the
+// registry is saved to a file, and otherwise derived from the version's name so
+// that it is the same in every run.
+func (r *Registry) newMaterial(keyVersionName string) []byte {
+	if r.path != "" {
+		material := make([]byte, 32)
+		_, _ = rand.Read(material)
+		return material
+	}
+	material := sha256.Sum256([]byte("gsm-kms:" + keyVersionName))
+	return material[:]
+}
+
+// newAEAD returns the AES-256-GCM cipher of a key version's material.
+func newAEAD(material []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(material)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
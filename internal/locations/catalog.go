@@ -0,0 +1,127 @@
+// Package locations provides the catalog of Google Cloud locations the emulator
+// serves through the Locations API and validates regional secrets against.
+package locations
+
+import (
+	"sort"
+	"strings"
+)
+
+// Location is a single entry in the catalog.
+type Location struct {
+	ID          string
+	DisplayName string
+}
+
+// defaultLocations are the Google Cloud regions offered when no catalog is configured.
+var defaultLocations = []Location{
+	{ID: "africa-south1", DisplayName: "Johannesburg"},
+	{ID: "asia-east1", DisplayName: "Taiwan"},
+	{ID: "asia-east2", DisplayName: "Hong Kong"},
+	{ID: "asia-northeast1", DisplayName: "Tokyo"},
+	{ID: "asia-northeast2", DisplayName: "Osaka"},
+	{ID: "asia-northeast3", DisplayName: "Seoul"},
+	{ID: "asia-south1", DisplayName: "Mumbai"},
+	{ID: "asia-south2", DisplayName: "Delhi"},
+	{ID: "asia-southeast1", DisplayName: "Singapore"},
+	{ID: "asia-southeast2", DisplayName: "Jakarta"},
+	{ID: "australia-southeast1", DisplayName: "Sydney"},
+	{ID: "australia-southeast2", DisplayName: "Melbourne"},
+	{ID: "europe-central2", DisplayName: "Warsaw"},
+	{ID: "europe-north1", DisplayName: "Finland"},
+	{ID: "europe-southwest1", DisplayName: "Madrid"},
+	{ID: "europe-west1", DisplayName: "Belgium"},
+	{ID: "europe-west2", DisplayName: "London"},
+	{ID: "europe-west3", DisplayName: "Frankfurt"},
+	{ID: "europe-west4", DisplayName: "Netherlands"},
+	{ID: "europe-west6", DisplayName: "Zurich"},
+	{ID: "europe-west8", DisplayName: "Milan"},
+	{ID: "europe-west9", DisplayName: "Paris"},
+	{ID: "europe-west10", DisplayName: "Berlin"},
+	{ID: "europe-west12", DisplayName: "Turin"},
+	{ID: "me-central1", DisplayName: "Doha"},
+	{ID: "me-central2", DisplayName: "Dammam"},
+	{ID: "me-west1", DisplayName: "Tel Aviv"},
+	{ID: "northamerica-northeast1", DisplayName: "Montréal"},
+	{ID: "northamerica-northeast2", DisplayName: "Toronto"},
+	{ID: "southamerica-east1", DisplayName: "São Paulo"},
+	{ID: "southamerica-west1", DisplayName: "Santiago"},
+	{ID: "us-central1", DisplayName: "Iowa"},
+	{ID: "us-east1", DisplayName: "South Carolina"},
+	{ID: "us-east4", DisplayName: "Northern Virginia"},
+	{ID: "us-east5", DisplayName: "Columbus"},
+	{ID: "us-south1", DisplayName: "Dallas"},
+	{ID: "us-west1", DisplayName: "Oregon"},
+	{ID: "us-west2", DisplayName: "Los Angeles"},
+	{ID: "us-west3", DisplayName: "Salt Lake City"},
+	{ID: "us-west4", DisplayName: "Las Vegas"},
+}
+
+// Catalog is an immutable, sorted set of locations.
+type Catalog struct {
+	locations []Location
+	index     map[string]Location
+}
+
+// NewCatalog creates a catalog from the given locations. Locations without a
+// display name borrow the default one when the ID is a known region.
+func NewCatalog(locations ...Location) *Catalog {
+	known := make(map[string]Location, len(defaultLocations))
+	for _, loc := range defaultLocations {
+		known[loc.ID] = loc
+	}
+
+	c := &Catalog{index: make(map[string]Location, len(locations))}
+	for _, loc := range locations {
+		if loc.DisplayName == "" {
+			loc.DisplayName = known[loc.ID].DisplayName
+		}
+		if _, exists := c.index[loc.ID]; exists {
+			continue
+		}
+		c.index[loc.ID] = loc
+		c.locations = append(c.locations, loc)
+	}
+
+	sort.Slice(c.locations, func(i, j int) bool {
+		return c.locations[i].ID < c.locations[j].ID
+	})
+	return c
+}
+
+// Default returns a catalog of the standard Google Cloud regions.
+func Default() *Catalog {
+	return NewCatalog(defaultLocations...)
+}
+
+// Parse builds a catalog from a comma separated list of location IDs, such as
+// the GSM_LOCATIONS environment variable. An empty list yields the default catalog.
+func Parse(spec string) *Catalog {
+	var locations []Location
+	for _, id := range strings.Split(spec, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			locations = append(locations, Location{ID: id})
+		}
+	}
+	if len(locations) == 0 {
+		return Default()
+	}
+	return NewCatalog(locations...)
+}
+
+// Get returns the location with the given ID.
+func (c *Catalog) Get(id string) (Location, bool) {
+	loc, ok := c.index[id]
+	return loc, ok
+}
+
+// Has reports whether the catalog contains the location ID.
+func (c *Catalog) Has(id string) bool {
+	_, ok := c.index[id]
+	return ok
+}
+
+// List returns every location in the catalog ordered by ID.
+func (c *Catalog) List() []Location {
+	return c.locations
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Duration is a length of time encoded as a JSON string of seconds with an "s"
+// suffix, such as "3600s" or "1.5s", matching how protojson represents
+// google.protobuf.Duration fields.
+type Duration time.Duration
+
+// MarshalJSON encodes the duration as decimal seconds with an "s" suffix.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatFloat(time.Duration(d).Seconds(), 'f', -1, 64) + "s")
+}
+
+// UnmarshalJSON decodes the duration from a string such as "3600s". Any unit
+// accepted by time.ParseDuration is allowed.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charlesgreen/gsm/internal/filter"
+)
+
+// SecretFilterFields are the secret fields FilterValues knows.
+var SecretFilterFields = filter.Fields{
+	"name", "createTime", "expireTime", "labels.*", "annotations.*", "versionAliases.*",
+	"topics", "rotation.nextRotationTime", "rotation.rotationPeriod",
+}
+
+// VersionFilterFields are the secret version fields FilterValues knows.
+var VersionFilterFields = filter.Fields{
+	"name", "state", "createTime", "destroyTime", "scheduledDestroyTime",
+}
+
+// FilterValues returns the values of a secret field for list filtering, such as
+// "name", "createTime" or "labels.env". See the filter package.
+func (s *Secret) FilterValues(field string) ([]string, bool) {
+	head, key, hasKey := strings.Cut(field, ".")
+	switch head {
+	case "name":
+		return []string{s.Name}, !hasKey
+	case "createTime":
+		return timeValues(&s.CreateTime), !hasKey
+	case "expireTime":
+		return timeValues(s.ExpireTime), !hasKey
+	case "labels":
+		return mapValues(s.Labels, key, hasKey), true
+	case "annotations":
+		return mapValues(s.Annotations, key, hasKey), true
+	case "versionAliases":
+		aliases := make(map[string]string, len(s.VersionAliases))
+		for alias, version := range s.VersionAliases {
+			aliases[alias] = strconv.FormatInt(int64(version), 10)
+		}
+		return mapValues(aliases, key, hasKey), true
+	case "topics":
+		var names []string
+		for _, topic := range s.Topics {
+			names = append(names, topic.Name)
+		}
+		return names, !hasKey
+	case "rotation":
+		if s.Rotation == nil {
+			return nil, hasKey
+		}
+		switch key {
+		case "nextRotationTime":
+			return timeValues(s.Rotation.NextRotationTime), true
+		case "rotationPeriod":
+			if s.Rotation.RotationPeriod == nil {
+				return nil, true
+			}
+			return []string{strconv.FormatFloat(time.Duration(*s.Rotation.RotationPeriod).Seconds(), 'f', -1, 64)}, true
+		}
+	}
+	return nil, false
+}
+
+// FilterValues returns the values of a secret version field for list
+// filtering, such as "state" or "createTime". See the filter package.
+func (v *SecretVersion) FilterValues(field string) ([]string, bool) {
+	switch field {
+	case "name":
+		return []string{v.Name}, true
+	case "state":
+		return []string{string(v.State)}, true
+	case "createTime":
+		return timeValues(&v.CreateTime), true
+	case "destroyTime":
+		return timeValues(v.DestroyTime), true
+	case "scheduledDestroyTime":
+		return timeValues(v.ScheduledDestroyTime), true
+	}
+	return nil, false
+}
+
+func timeValues(t *time.Time) []string {
+	if t == nil {
+		return nil
+	}
+	return []string{t.UTC().Format(time.RFC3339Nano)}
+}
+
+// mapValues returns the value stored under key, or every key of m when no key
+// is given so that labels:env matches secrets with an env label.
+func mapValues(m map[string]string, key string, hasKey bool) []string {
+	if hasKey {
+		if value, ok := m[key]; ok {
+			return []string{value}
+		}
+		return nil
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
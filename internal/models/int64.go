@@ -0,0 +1,36 @@
+package models
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Int64 is a 64-bit integer encoded as a JSON string, matching how protojson
+// represents int64 fields. It decodes from either a string or a number so that
+// hand-written requests work too.
+type Int64 int64
+
+// MarshalJSON encodes the integer as a quoted decimal string.
+func (i Int64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(i), 10))
+}
+
+// UnmarshalJSON decodes the integer from a quoted or bare number.
+func (i *Int64) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return err
+		}
+		*i = Int64(n)
+		return nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = Int64(n)
+	return nil
+}
@@ -0,0 +1,23 @@
+package models
+
+import "fmt"
+
+// Location represents a Google Cloud location from the google.cloud.location mixin.
+type Location struct {
+	Name        string            `json:"name"`
+	LocationID  string            `json:"locationId"`
+	DisplayName string            `json:"displayName,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// NewLocation creates the location resource for a project.
+func NewLocation(projectID, locationID, displayName string) *Location {
+	return &Location{
+		Name:        fmt.Sprintf("projects/%s/locations/%s", projectID, locationID),
+		LocationID:  locationID,
+		DisplayName: displayName,
+		Labels: map[string]string{
+			"cloud.googleapis.com/region": locationID,
+		},
+	}
+}
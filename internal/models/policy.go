@@ -0,0 +1,83 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"slices"
+)
+
+// emptyPolicyEtag is the etag production reports for a resource that has never
+// had a policy set.
+const emptyPolicyEtag = "ACAB"
+
+// Policy represents an IAM policy attached to a project or secret.
+type Policy struct {
+	Version  int        `json:"version,omitempty"`
+	Bindings []*Binding `json:"bindings,omitempty"`
+	Etag     string     `json:"etag,omitempty"`
+}
+
+// Binding associates a role with the members that hold it.
+type Binding struct {
+	Role    string   `json:"role"`
+	Members []string `json:"members,omitempty"`
+}
+
+// SetIamPolicyRequest represents the request to replace the IAM policy of a resource.
+type SetIamPolicyRequest struct {
+	Policy     *Policy `json:"policy"`
+	UpdateMask string  `json:"updateMask,omitempty"`
+}
+
+// TestIamPermissionsRequest represents the request to check which permissions the caller holds.
+type TestIamPermissionsRequest struct {
+	Permissions []string `json:"permissions"`
+}
+
+// TestIamPermissionsResponse lists the requested permissions the caller holds.
+type TestIamPermissionsResponse struct {
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// NewPolicy creates the empty policy reported for resources without one.
+func NewPolicy() *Policy {
+	return &Policy{
+		Version: 1,
+		Etag:    emptyPolicyEtag,
+	}
+}
+
+// Clone returns a deep copy of the policy that shares no memory with p.
+func (p *Policy) Clone() *Policy {
+	if p == nil {
+		return nil
+	}
+
+	clone := *p
+	if p.Bindings != nil {
+		clone.Bindings = make([]*Binding, len(p.Bindings))
+		for i, binding := range p.Bindings {
+			if binding != nil {
+				clone.Bindings[i] = &Binding{Role: binding.Role, Members: slices.Clone(binding.Members)}
+			}
+		}
+	}
+	return &clone
+}
+
+// generatePolicyEtag creates an IAM etag. IAM etags are bytes on the wire, so
+// unlike resource etags they must be valid base64.
+func generatePolicyEtag() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+// Refresh prepares a policy for storage by defaulting its version and
+// generating a new etag.
+func (p *Policy) Refresh() {
+	if p.Version == 0 {
+		p.Version = 1
+	}
+	p.Etag = generatePolicyEtag()
+}
@@ -25,16 +25,33 @@ type ListSecretVersionsResponse struct {
 	TotalSize     int              `json:"totalSize"`
 }
 
-// CreateSecretRequest represents the request to create a new secret.
+// ListLocationsResponse represents the response for listing the locations of a project.
+type ListLocationsResponse struct {
+	Locations     []*Location `json:"locations"`
+	NextPageToken string      `json:"nextPageToken,omitempty"`
+}
+
+// CreateSecretRequest represents the request to create a new secret. The
+// secret may be wrapped in a "secret" field or, as the REST client sends it, be
+// the request body itself.
 type CreateSecretRequest struct {
 	SecretID string            `json:"secretId"`
 	Secret   *CreateSecretData `json:"secret"`
+	CreateSecretData
 }
 
 // CreateSecretData contains the secret metadata for creation requests.
 type CreateSecretData struct {
-	Labels      map[string]string `json:"labels,omitempty"`
-	Replication *Replication      `json:"replication,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Annotations    map[string]string `json:"annotations,omitempty"`
+	Replication    *Replication      `json:"replication,omitempty"`
+	VersionAliases map[string]Int64  `json:"versionAliases,omitempty"`
+	ExpireTime     *time.Time        `json:"expireTime,omitempty"`
+	TTL            *Duration         `json:"ttl,omitempty"`
+	Topics         []*Topic          `json:"topics,omitempty"`
+	Rotation       *Rotation         `json:"rotation,omitempty"`
+
+	VersionDestroyTTL *Duration `json:"versionDestroyTtl,omitempty"`
 }
 
 // AddSecretVersionRequest represents the request to add a new version to an existing secret.
@@ -42,6 +59,13 @@ type AddSecretVersionRequest struct {
 	Payload *SecretPayload `json:"payload"`
 }
 
+// SecretVersionStateRequest represents the body of the enable, disable and
+// destroy requests for a secret version.
+type SecretVersionStateRequest struct {
+	Name string `json:"name"`
+	Etag string `json:"etag"`
+}
+
 // ErrorResponse represents an API error response following Google Cloud API standards.
 type ErrorResponse struct {
 	Error *ErrorDetail `json:"error"`
@@ -73,11 +97,25 @@ type ErrorInfo struct {
 	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
+// BadRequest lists the fields of a request that failed validation, following
+// google.rpc.BadRequest.
+type BadRequest struct {
+	Type            string           `json:"@type"`
+	FieldViolations []FieldViolation `json:"fieldViolations"`
+}
+
+// FieldViolation describes a single invalid field of a request.
+type FieldViolation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
 // HealthResponse represents the health check response.
 type HealthResponse struct {
 	Status    string    `json:"status"`
 	Timestamp time.Time `json:"timestamp"`
 	Version   string    `json:"version"`
+	Error     string    `json:"error,omitempty"`
 }
 
 // NewErrorResponse creates a new error response with the given details.
@@ -122,6 +160,18 @@ func NewErrorResponseWithInfo(code int, message, status, reason, domain string,
 	}
 }
 
+// NewBadRequestResponse creates an INVALID_ARGUMENT error response that carries
+// the field violations as google.rpc.BadRequest details next to the ErrorInfo.
+// The message is the description of the first violation.
+func NewBadRequestResponse(violations []FieldViolation) *ErrorResponse {
+	resp := NewErrorResponseWithInfo(400, violations[0].Description, "INVALID_ARGUMENT", "FIELD_VIOLATION", "secretmanager.googleapis.com", nil)
+	resp.Error.Details = append(resp.Error.Details, BadRequest{
+		Type:            "type.googleapis.com/google.rpc.BadRequest",
+		FieldViolations: violations,
+	})
+	return resp
+}
+
 // FormatResourceNotFoundError creates a properly formatted "not found" error message.
 func FormatResourceNotFoundError(resourceType, projectID, resourceID string) string {
 	switch resourceType {
@@ -138,6 +188,11 @@ func FormatResourceNotFoundError(resourceType, projectID, resourceID string) str
 	}
 }
 
+// FormatUnsupportedLocationError creates the message returned when a location is not in the catalog.
+func FormatUnsupportedLocationError(locationID string) string {
+	return fmt.Sprintf("Location [%s] is not supported.", locationID)
+}
+
 // FormatResourceExistsError creates a properly formatted "already exists" error message.
 func FormatResourceExistsError(resourceType, projectID, resourceID string) string {
 	switch resourceType {
@@ -148,6 +203,49 @@ func FormatResourceExistsError(resourceType, projectID, resourceID string) strin
 	}
 }
 
+// FormatVersionStateError creates the failed precondition message returned when a version is not enabled.
+func FormatVersionStateError(versionName string, state SecretVersionState) string {
+	return fmt.Sprintf("Secret Version [%s] is in %s state.", versionName, state)
+}
+
+// FormatEtagMismatchError creates a properly formatted error message for a
+// request whose etag does not match the current etag of the named resource.
+func FormatEtagMismatchError(resourceName string) string {
+	return fmt.Sprintf("The etag provided does not match the current etag of [%s].", resourceName)
+}
+
+// FormatChecksumMismatchError creates a properly formatted error message for a
+// payload whose dataCrc32c does not match its data.
+func FormatChecksumMismatchError(secretName string) string {
+	return fmt.Sprintf("Checksum mismatch for the payload added to [%s]: dataCrc32c does not match the payload data.", secretName)
+}
+
+// FormatInvalidFilterError creates a properly formatted error message for a
+// list filter that could not be parsed.
+func FormatInvalidFilterError(err error) string {
+	return fmt.Sprintf("Invalid filter: %v.", err)
+}
+
+// FormatKeyNotFoundError creates the failed precondition message returned when
+// a secret's customer-managed key does not exist.
+func FormatKeyNotFoundError(keyName string) string {
+	return fmt.Sprintf("The customer-managed encryption key [%s] was not found.", keyName)
+}
+
+// FormatKeyStateError creates the failed precondition message returned when a
+// customer-managed key version cannot be used because of its state.
+func FormatKeyStateError(keyVersionName, state string) string {
+	return fmt.Sprintf("The customer-managed encryption key version [%s] is in %s state.", keyVersionName, state)
+}
+
+// UnauthenticatedMessage is returned for requests without credentials when IAM
+// is enforced.
+const UnauthenticatedMessage = "Request is missing required authentication credential. Expected OAuth 2 access token, login cookie or other valid authentication credential."
+
+// PolicyConflictMessage is returned when a policy is set with an etag that no
+// longer matches the policy's current one.
+const PolicyConflictMessage = "There were concurrent policy changes. Please retry the whole read-modify-write with exponential backoff."
+
 // FormatPermissionDeniedError creates a properly formatted permission denied error message.
 func FormatPermissionDeniedError(permission, resourcePath string) string {
 	return fmt.Sprintf("Permission '%s' denied on resource '%s'.", permission, resourcePath)
@@ -158,7 +256,7 @@ func generateEtag() string {
 }
 
 func generateChecksum(data []byte) *SecretVersionChecksum {
-	crc32Hash := crc32.ChecksumIEEE(data)
+	crc32Hash := crc32.Checksum(data, crc32cTable)
 	sha256Hash := sha256.Sum256(data)
 
 	return &SecretVersionChecksum{
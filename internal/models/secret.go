@@ -1,19 +1,31 @@
 package models
 
 import (
+	"cmp"
 	"fmt"
+	"maps"
+	"strings"
 	"time"
 )
 
 // Secret represents a Google Secret Manager secret resource.
 type Secret struct {
-	Name         string                    `json:"name"`
-	CreateTime   time.Time                 `json:"createTime"`
-	Labels       map[string]string         `json:"labels,omitempty"`
-	Replication  Replication               `json:"replication"`
-	Etag         string                    `json:"etag"`
-	Versions     map[string]*SecretVersion `json:"-"`
-	VersionCount int                       `json:"-"`
+	Name           string            `json:"name"`
+	CreateTime     time.Time         `json:"createTime"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Annotations    map[string]string `json:"annotations,omitempty"`
+	Replication    Replication       `json:"replication,omitzero"`
+	Topics         []*Topic          `json:"topics,omitempty"`
+	Rotation       *Rotation         `json:"rotation,omitempty"`
+	Etag           string            `json:"etag"`
+	VersionAliases map[string]Int64  `json:"versionAliases,omitempty"`
+	ExpireTime     *time.Time        `json:"expireTime,omitempty"`
+	TTL            *Duration         `json:"ttl,omitempty"` // input only, see ResolveExpiration
+	// VersionDestroyTTL delays the destruction of versions. Destroying a
+	// version disables it and schedules the destruction this far ahead.
+	VersionDestroyTTL *Duration                 `json:"versionDestroyTtl,omitempty"`
+	Versions          map[string]*SecretVersion `json:"-"`
+	VersionCount      int                       `json:"-"`
 }
 
 // Replication describes the replication policy for a secret.
@@ -43,21 +55,232 @@ type CustomerManagedEncryption struct {
 	KmsKeyName string `json:"kmsKeyName"`
 }
 
+// KmsKeyName returns the customer-managed key that new versions of the secret
+// are encrypted with, or "" when it uses Google-managed encryption. Secrets
+// with user-managed replication use the key of their first replica that has one.
+func (s *Secret) KmsKeyName() string {
+	if automatic := s.Replication.Automatic; automatic != nil && automatic.CustomerManagedEncryption != nil {
+		return automatic.CustomerManagedEncryption.KmsKeyName
+	}
+	if userManaged := s.Replication.UserManaged; userManaged != nil {
+		for _, replica := range userManaged.Replicas {
+			if replica.CustomerManagedEncryption != nil {
+				return replica.CustomerManagedEncryption.KmsKeyName
+			}
+		}
+	}
+	return ""
+}
+
+// Topic is a Pub/Sub topic that receives notifications about a secret.
+type Topic struct {
+	Name string `json:"name"`
+}
+
+// Rotation schedules rotation notifications for a secret. When the next
+// rotation time passes a SECRET_ROTATE event is sent to the secret's topics and,
+// if a period is set, the next rotation time advances by it.
+type Rotation struct {
+	NextRotationTime *time.Time `json:"nextRotationTime,omitempty"`
+	RotationPeriod   *Duration  `json:"rotationPeriod,omitempty"`
+}
+
 // NewSecret creates a new secret with the given project ID, secret ID, and labels.
+//
+// A project ID of the form {project}/locations/{location} creates a regional
+// secret, which has no replication policy of its own.
 func NewSecret(projectID, secretID string, labels map[string]string) *Secret {
-	name := fmt.Sprintf("projects/%s/secrets/%s", projectID, secretID)
+	name := SecretName(projectID, secretID)
 
-	return &Secret{
-		Name:       name,
-		CreateTime: time.Now().UTC(),
-		Labels:     labels,
-		Replication: Replication{
-			Automatic: &AutomaticReplication{},
-		},
+	secret := &Secret{
+		Name:         name,
+		CreateTime:   time.Now().UTC(),
+		Labels:       labels,
 		Etag:         generateEtag(),
 		Versions:     make(map[string]*SecretVersion),
 		VersionCount: 0,
 	}
+	if !secret.IsRegional() {
+		secret.Replication = Replication{
+			Automatic: &AutomaticReplication{},
+		}
+	}
+	return secret
+}
+
+// SecretName returns the resource name of a secret. As with NewSecret, the
+// project ID may be qualified with a location for regional secrets.
+func SecretName(projectID, secretID string) string {
+	return fmt.Sprintf("projects/%s/secrets/%s", projectID, secretID)
+}
+
+// Clone returns a deep copy of the secret, including its versions, that shares
+// no memory with s.
+func (s *Secret) Clone() *Secret {
+	if s == nil {
+		return nil
+	}
+
+	clone := *s
+	clone.Labels = maps.Clone(s.Labels)
+	clone.Annotations = maps.Clone(s.Annotations)
+	clone.Replication = s.Replication.clone()
+	clone.Topics = cloneEach(s.Topics)
+	clone.VersionAliases = maps.Clone(s.VersionAliases)
+	clone.ExpireTime = clonePtr(s.ExpireTime)
+	clone.TTL = clonePtr(s.TTL)
+	clone.VersionDestroyTTL = clonePtr(s.VersionDestroyTTL)
+	if s.Rotation != nil {
+		clone.Rotation = &Rotation{
+			NextRotationTime: clonePtr(s.Rotation.NextRotationTime),
+			RotationPeriod:   clonePtr(s.Rotation.RotationPeriod),
+		}
+	}
+	if s.Versions != nil {
+		clone.Versions = make(map[string]*SecretVersion, len(s.Versions))
+		for id, version := range s.Versions {
+			clone.Versions[id] = version.Clone()
+		}
+	}
+	return &clone
+}
+
+func (r Replication) clone() Replication {
+	if r.Automatic != nil {
+		r.Automatic = &AutomaticReplication{
+			CustomerManagedEncryption: clonePtr(r.Automatic.CustomerManagedEncryption),
+		}
+	}
+	if r.UserManaged != nil {
+		replicas := make([]*Replica, len(r.UserManaged.Replicas))
+		for i, replica := range r.UserManaged.Replicas {
+			if replica != nil {
+				replicas[i] = &Replica{
+					Location:                  replica.Location,
+					CustomerManagedEncryption: clonePtr(replica.CustomerManagedEncryption),
+				}
+			}
+		}
+		r.UserManaged = &UserManagedReplication{Replicas: replicas}
+	}
+	return r
+}
+
+// clonePtr returns a pointer to a copy of the value p points at, or nil.
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+// cloneEach copies a slice of pointers along with the values they point at.
+func cloneEach[T any](s []*T) []*T {
+	if s == nil {
+		return nil
+	}
+	clone := make([]*T, len(s))
+	for i, p := range s {
+		clone[i] = clonePtr(p)
+	}
+	return clone
+}
+
+// IsEmpty reports whether no replication policy has been chosen.
+func (r *Replication) IsEmpty() bool {
+	return r.Automatic == nil && r.UserManaged == nil
+}
+
+// Update copies the fields named in paths from src and regenerates the etag.
+// Paths are expected to have been validated against the updatable fields.
+func (s *Secret) Update(src *Secret, paths []string) {
+	for _, path := range paths {
+		switch path {
+		case "labels":
+			s.Labels = src.Labels
+		case "annotations":
+			s.Annotations = src.Annotations
+		case "versionAliases":
+			s.VersionAliases = src.VersionAliases
+		case "expireTime", "ttl":
+			s.ExpireTime = src.ExpireTime
+		case "topics":
+			s.Topics = src.Topics
+		case "rotation":
+			s.Rotation = src.Rotation
+		case "rotation.nextRotationTime", "rotation.rotationPeriod":
+			s.updateRotationField(src.Rotation, path)
+		case "versionDestroyTtl":
+			s.VersionDestroyTTL = src.VersionDestroyTTL
+		}
+	}
+	s.Refresh()
+}
+
+// Refresh regenerates the etag after the secret has changed.
+func (s *Secret) Refresh() {
+	s.Etag = generateEtag()
+}
+
+// updateRotationField sets a single rotation field from src without modifying
+// the existing rotation, which callers may still hold. The rotation is removed
+// once neither field is set.
+func (s *Secret) updateRotationField(src *Rotation, path string) {
+	var rotation Rotation
+	if s.Rotation != nil {
+		rotation = *s.Rotation
+	}
+	src = cmp.Or(src, &Rotation{})
+
+	switch path {
+	case "rotation.nextRotationTime":
+		rotation.NextRotationTime = src.NextRotationTime
+	case "rotation.rotationPeriod":
+		rotation.RotationPeriod = src.RotationPeriod
+	}
+
+	s.Rotation = &rotation
+	if rotation.NextRotationTime == nil && rotation.RotationPeriod == nil {
+		s.Rotation = nil
+	}
+}
+
+// Advance moves the next rotation time past now by whole rotation periods. A
+// rotation without a period only fires once, so its next rotation time is
+// cleared instead.
+func (r *Rotation) Advance(now time.Time) {
+	if r.RotationPeriod == nil || *r.RotationPeriod <= 0 {
+		r.NextRotationTime = nil
+		return
+	}
+
+	next := *r.NextRotationTime
+	for !next.After(now) {
+		next = next.Add(time.Duration(*r.RotationPeriod))
+	}
+	r.NextRotationTime = &next
+}
+
+// IsDue reports whether the rotation's next rotation time is at or before now.
+func (r *Rotation) IsDue(now time.Time) bool {
+	return r != nil && r.NextRotationTime != nil && !r.NextRotationTime.After(now)
+}
+
+// ResolveExpiration converts a requested ttl into an absolute expiration time
+// measured from now. Production never returns ttl, so it is cleared afterwards.
+func (s *Secret) ResolveExpiration(now time.Time) {
+	if s.TTL == nil {
+		return
+	}
+	expireTime := now.Add(time.Duration(*s.TTL)).UTC()
+	s.ExpireTime = &expireTime
+	s.TTL = nil
+}
+
+// IsExpired reports whether the secret has an expiration time at or before now.
+func (s *Secret) IsExpired(now time.Time) bool {
+	return s.ExpireTime != nil && !s.ExpireTime.After(now)
 }
 
 // GetProjectID extracts the project ID from the secret's resource name.
@@ -70,6 +293,17 @@ func (s *Secret) GetSecretID() string {
 	return extractSecretID(s.Name)
 }
 
+// GetLocation extracts the location of a regional secret from its resource
+// name, returning an empty string for global secrets.
+func (s *Secret) GetLocation() string {
+	return extractLocation(s.Name)
+}
+
+// IsRegional reports whether the secret is scoped to a location.
+func (s *Secret) IsRegional() bool {
+	return s.GetLocation() != ""
+}
+
 func extractProjectID(name string) string {
 	if len(name) < 10 || name[:9] != "projects/" {
 		return ""
@@ -93,3 +327,11 @@ func extractSecretID(name string) string {
 	}
 	return ""
 }
+
+func extractLocation(name string) string {
+	parts := strings.Split(name, "/")
+	if len(parts) >= 4 && parts[0] == "projects" && parts[2] == "locations" {
+		return parts[3]
+	}
+	return ""
+}
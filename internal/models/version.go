@@ -1,18 +1,39 @@
 package models
 
 import (
+	"bytes"
 	"fmt"
+	"hash/crc32"
 	"time"
 )
 
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
 // SecretVersion represents a version of a secret with its data and metadata.
 type SecretVersion struct {
-	Name       string                 `json:"name"`
-	CreateTime time.Time              `json:"createTime"`
-	State      SecretVersionState     `json:"state"`
-	Etag       string                 `json:"etag"`
-	Data       []byte                 `json:"-"`
-	Checksum   *SecretVersionChecksum `json:"checksum,omitempty"`
+	Name        string     `json:"name"`
+	CreateTime  time.Time  `json:"createTime"`
+	DestroyTime *time.Time `json:"destroyTime,omitempty"`
+	// ScheduledDestroyTime is set while a destroy delayed by the secret's
+	// versionDestroyTtl is pending.
+	ScheduledDestroyTime *time.Time             `json:"scheduledDestroyTime,omitempty"`
+	State                SecretVersionState     `json:"state"`
+	Etag                 string                 `json:"etag"`
+	Data                 []byte                 `json:"-"`
+	Checksum             *SecretVersionChecksum `json:"checksum,omitempty"`
+
+	// CustomerManagedEncryption records the key version the payload was
+	// encrypted with when the secret uses a customer-managed key.
+	CustomerManagedEncryption *CustomerManagedEncryptionStatus `json:"customerManagedEncryption,omitempty"`
+
+	// ClientSpecifiedPayloadChecksum reports whether the payload was added
+	// with a dataCrc32c that the server verified.
+	ClientSpecifiedPayloadChecksum bool `json:"clientSpecifiedPayloadChecksum,omitempty"`
+}
+
+// CustomerManagedEncryptionStatus describes how a version's payload is encrypted.
+type CustomerManagedEncryptionStatus struct {
+	KmsKeyVersionName string `json:"kmsKeyVersionName"`
 }
 
 // SecretVersionState represents the state of a secret version.
@@ -39,10 +60,43 @@ type AccessSecretVersionResponse struct {
 	Payload *SecretPayload `json:"payload"`
 }
 
-// SecretPayload contains the actual secret data and its checksums.
+// NewAccessSecretVersionResponse creates the response for accessing version,
+// whose data is data.
+func NewAccessSecretVersionResponse(version *SecretVersion, data []byte) *AccessSecretVersionResponse {
+	payload := NewSecretPayload(data)
+	payload.Checksum = version.Checksum
+	return &AccessSecretVersionResponse{
+		Name:    version.Name,
+		Payload: payload,
+	}
+}
+
+// SecretPayload contains the actual secret data and its checksums. DataCrc32c
+// is the CRC32C (Castagnoli) checksum of Data, as production reports it.
 type SecretPayload struct {
-	Data     []byte                 `json:"data"`
-	Checksum *SecretVersionChecksum `json:"checksum,omitempty"`
+	Data       []byte                 `json:"data"`
+	DataCrc32c *Int64                 `json:"dataCrc32c,omitempty"`
+	Checksum   *SecretVersionChecksum `json:"checksum,omitempty"`
+}
+
+// NewSecretPayload creates a payload for data with its CRC32C checksum set.
+func NewSecretPayload(data []byte) *SecretPayload {
+	crc := PayloadCrc32c(data)
+	return &SecretPayload{
+		Data:       data,
+		DataCrc32c: &crc,
+	}
+}
+
+// PayloadCrc32c returns the CRC32C (Castagnoli) checksum of data.
+func PayloadCrc32c(data []byte) Int64 {
+	return Int64(crc32.Checksum(data, crc32cTable))
+}
+
+// VerifyChecksum reports whether the payload's DataCrc32c, if given, matches
+// its data. A payload without a checksum always verifies.
+func (p *SecretPayload) VerifyChecksum() bool {
+	return p.DataCrc32c == nil || *p.DataCrc32c == PayloadCrc32c(p.Data)
 }
 
 // NewSecretVersion creates a new secret version with the given parameters and data.
@@ -59,6 +113,52 @@ func NewSecretVersion(projectID, secretID string, versionID string, data []byte)
 	}
 }
 
+// Clone returns a deep copy of the version that shares no memory with v.
+func (v *SecretVersion) Clone() *SecretVersion {
+	if v == nil {
+		return nil
+	}
+
+	clone := *v
+	clone.DestroyTime = clonePtr(v.DestroyTime)
+	clone.ScheduledDestroyTime = clonePtr(v.ScheduledDestroyTime)
+	clone.Data = bytes.Clone(v.Data)
+	clone.Checksum = clonePtr(v.Checksum)
+	clone.CustomerManagedEncryption = clonePtr(v.CustomerManagedEncryption)
+	return &clone
+}
+
+// SetState moves the version to state and regenerates its etag. Destroying a
+// version discards its data but keeps the metadata, as production does.
+// Enabling or destroying a version clears any scheduled destruction.
+func (v *SecretVersion) SetState(state SecretVersionState) {
+	if state == StateDestroyed {
+		destroyTime := time.Now().UTC()
+		v.DestroyTime = &destroyTime
+		v.Data = nil
+		v.Checksum = nil
+	}
+	if state != StateDisabled {
+		v.ScheduledDestroyTime = nil
+	}
+	v.State = state
+	v.Etag = generateEtag()
+}
+
+// ScheduleDestroy disables the version and schedules its destruction for at.
+func (v *SecretVersion) ScheduleDestroy(at time.Time) {
+	at = at.UTC()
+	v.ScheduledDestroyTime = &at
+	v.State = StateDisabled
+	v.Etag = generateEtag()
+}
+
+// IsDestroyDue reports whether the version has a scheduled destruction at or
+// before now.
+func (v *SecretVersion) IsDestroyDue(now time.Time) bool {
+	return v.ScheduledDestroyTime != nil && !v.ScheduledDestroyTime.After(now)
+}
+
 // GetProjectID extracts the project ID from the version's resource name.
 func (v *SecretVersion) GetProjectID() string {
 	return extractProjectID(v.Name)
@@ -0,0 +1,101 @@
+// Package notify delivers the events Secret Manager publishes about changes to
+// secrets, such as new versions and scheduled rotations.
+package notify
+
+import (
+	"context"
+	"log"
+
+	"github.com/charlesgreen/gsm/internal/models"
+)
+
+// EventType names a kind of secret event, matching the eventType attribute of
+// production's Pub/Sub notifications.
+type EventType string
+
+// Event types production publishes to a secret's topics.
+const (
+	SecretCreate         EventType = "SECRET_CREATE"
+	SecretUpdate         EventType = "SECRET_UPDATE"
+	SecretDelete         EventType = "SECRET_DELETE"
+	SecretVersionAdd     EventType = "SECRET_VERSION_ADD"
+	SecretVersionEnable  EventType = "SECRET_VERSION_ENABLE"
+	SecretVersionDisable EventType = "SECRET_VERSION_DISABLE"
+	SecretVersionDestroy EventType = "SECRET_VERSION_DESTROY"
+	SecretRotate         EventType = "SECRET_ROTATE"
+
+	SecretVersionDestroyScheduled EventType = "SECRET_VERSION_DESTROY_SCHEDULED"
+)
+
+// Event describes a change to a secret. Version is set for version events.
+type Event struct {
+	Type    EventType
+	Secret  *models.Secret
+	Version *models.SecretVersion
+}
+
+// Notifier delivers events.
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// Func adapts a function to the Notifier interface.
+type Func func(ctx context.Context, event Event) error
+
+// Notify calls f.
+func (f Func) Notify(ctx context.Context, event Event) error {
+	return f(ctx, event)
+}
+
+// Discard is a Notifier that drops every event.
+var Discard Notifier = Func(func(context.Context, Event) error { return nil })
+
+// Logger returns a Notifier that writes each event to logger, or to the
+// standard logger when logger is nil.
+func Logger(logger *log.Logger) Notifier {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return Func(func(_ context.Context, event Event) error {
+		logger.Printf("%s %s", event.Type, event.Secret.Name)
+		return nil
+	})
+}
+
+// Multi returns a Notifier that delivers each event to every notifier in turn,
+// stopping at the first error.
+func Multi(notifiers ...Notifier) Notifier {
+	return Func(func(ctx context.Context, event Event) error {
+		for _, n := range notifiers {
+			if err := n.Notify(ctx, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Publish delivers an event about secret to notifier. Production publishes
+// notifications after the change has been committed, so failures are logged
+// rather than failing the request that caused them.
+func Publish(ctx context.Context, notifier Notifier, eventType EventType, secret *models.Secret, version *models.SecretVersion) {
+	event := Event{Type: eventType, Secret: secret, Version: version}
+	if err := notifier.Notify(context.WithoutCancel(ctx), event); err != nil {
+		log.Printf("Failed to deliver %s notification for %s: %v", eventType, secret.Name, err)
+	}
+}
+
+// SecretGetter looks up the secret a version event is about.
+type SecretGetter interface {
+	GetSecret(ctx context.Context, projectID, secretID string) (*models.Secret, error)
+}
+
+// PublishVersion delivers an event about version to notifier, looking up the
+// secret it belongs to in secrets. The event is dropped if the secret is gone.
+func PublishVersion(ctx context.Context, notifier Notifier, secrets SecretGetter, eventType EventType, projectID, secretID string, version *models.SecretVersion) {
+	secret, err := secrets.GetSecret(ctx, projectID, secretID)
+	if err != nil {
+		return
+	}
+	Publish(ctx, notifier, eventType, secret, version)
+}
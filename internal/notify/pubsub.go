@@ -0,0 +1,156 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a Pub/Sub message as production publishes it to a secret's topic.
+type Message struct {
+	Topic      string            `json:"-"`
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// Messages renders an event as one message per topic of its secret. The data is
+// the JSON of the secret, or of the version for version events.
+func Messages(event Event) ([]Message, error) {
+	if len(event.Secret.Topics) == 0 {
+		return nil, nil
+	}
+
+	attributes := map[string]string{
+		"eventType":  string(event.Type),
+		"dataFormat": "JSON",
+		"secretId":   event.Secret.Name,
+	}
+
+	var resource any = event.Secret
+	if event.Version != nil {
+		attributes["versionId"] = event.Version.Name
+		resource = event.Version
+	}
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s message: %w", event.Type, err)
+	}
+
+	messages := make([]Message, 0, len(event.Secret.Topics))
+	for _, topic := range event.Secret.Topics {
+		messages = append(messages, Message{
+			Topic:      topic.Name,
+			Data:       data,
+			Attributes: maps.Clone(attributes),
+		})
+	}
+	return messages, nil
+}
+
+// Publisher sends messages to Pub/Sub topics.
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+}
+
+// Topics returns a Notifier that publishes each event to the topics of its
+// secret through publisher. Events for secrets without topics are dropped.
+func Topics(publisher Publisher) Notifier {
+	return Func(func(ctx context.Context, event Event) error {
+		messages, err := Messages(event)
+		if err != nil {
+			return err
+		}
+
+		var errs []error
+		for _, msg := range messages {
+			if err := publisher.Publish(ctx, msg); err != nil {
+				errs = append(errs, fmt.Errorf("publishing to %s: %w", msg.Topic, err))
+			}
+		}
+		return errors.Join(errs...)
+	})
+}
+
+// RESTPublisher publishes messages through the Pub/Sub REST API, such as the
+// one served by the official Pub/Sub emulator.
+type RESTPublisher struct {
+	endpoint string
+	client   *http.Client
+}
+
+// publishTimeout bounds each publish made with the default client. Publishing
+// happens on the request path, so a stalled Pub/Sub server must not hang the
+// requests that notify it.
+const publishTimeout = 10 * time.Second
+
+// NewRESTPublisher creates a publisher for the Pub/Sub API at host. A host
+// without a scheme, as PUBSUB_EMULATOR_HOST is usually set, is reached over
+// plain HTTP. A nil client gives up on each publish after 10 seconds.
+func NewRESTPublisher(host string, client *http.Client) *RESTPublisher {
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	if client == nil {
+		client = &http.Client{Timeout: publishTimeout}
+	}
+	return &RESTPublisher{
+		endpoint: strings.TrimSuffix(host, "/"),
+		client:   client,
+	}
+}
+
+// Publish sends msg to its topic with the projects.topics.publish method.
+func (p *RESTPublisher) Publish(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(map[string][]Message{"messages": {msg}})
+	if err != nil {
+		return fmt.Errorf("encoding publish request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+"/v1/"+msg.Topic+":publish", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating publish request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending publish request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("publish returned %s: %s", resp.Status, bytes.TrimSpace(detail))
+	}
+	return nil
+}
+
+// Recorder is a Publisher that keeps every message in memory, in the order they
+// were published.
+type Recorder struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+// Publish records msg.
+func (r *Recorder) Publish(_ context.Context, msg Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, msg)
+	return nil
+}
+
+// Messages returns a copy of the messages recorded so far.
+func (r *Recorder) Messages() []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Message(nil), r.messages...)
+}
@@ -0,0 +1,95 @@
+// Package pagination implements the opaque page tokens list methods hand out.
+package pagination
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// DefaultPageSize is used when a list request does not ask for a page size.
+const DefaultPageSize = 100
+
+// MaxPageSize is the largest page a list request is given. Larger requests
+// are capped rather than rejected.
+const MaxPageSize = 1000
+
+// PageSize returns the page size to use for a requested one, which is zero
+// when the request does not ask for one.
+func PageSize(requested int) int {
+	switch {
+	case requested <= 0:
+		return DefaultPageSize
+	case requested > MaxPageSize:
+		return MaxPageSize
+	}
+	return requested
+}
+
+// ErrInvalidToken is returned when a page token is malformed or was issued for
+// a different list request.
+var ErrInvalidToken = errors.New("invalid page token")
+
+// pageToken is the decoded form of the opaque tokens list methods hand out. It
+// records the last resource returned rather than an offset, so pages stay
+// stable when resources are created or deleted between calls, and a hash of the
+// query so a token cannot be replayed against a different list.
+type pageToken struct {
+	Last  string `json:"l"`
+	Query string `json:"q"`
+}
+
+// Query identifies the parent and filter of a list request, binding tokens to
+// it. The page size is left out because clients may change it between pages.
+func Query(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+func encodePageToken(last, query string) string {
+	data, _ := json.Marshal(pageToken{Last: last, Query: query})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodePageToken(token, query string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	var decoded pageToken
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.Last == "" || decoded.Query != query {
+		return "", ErrInvalidToken
+	}
+	return decoded.Last, nil
+}
+
+// Paginate returns the page of items, which must already be sorted, that
+// follows token, along with the token for the next page. query comes from
+// Query, and after reports whether an item sorts after the resource named in a
+// token.
+func Paginate[T any](items []T, pageSize int, token, query string, name func(T) string, after func(item T, last string) bool) ([]T, string, error) {
+	start := 0
+	if token != "" {
+		last, err := decodePageToken(token, query)
+		if err != nil {
+			return nil, "", err
+		}
+		start = sort.Search(len(items), func(i int) bool { return after(items[i], last) })
+	}
+
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	end := min(start+pageSize, len(items))
+
+	var next string
+	if end < len(items) {
+		next = encodePageToken(name(items[end-1]), query)
+	}
+	return items[start:end], next, nil
+}
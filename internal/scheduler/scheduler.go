@@ -0,0 +1,136 @@
+// Package scheduler runs the emulator's time-based background work, such as
+// deleting expired secrets and firing rotations, on a fixed interval.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/notify"
+	"github.com/charlesgreen/gsm/internal/storage"
+)
+
+// DefaultInterval is how often jobs run when no interval is configured.
+const DefaultInterval = time.Second
+
+// Job is a unit of background work. It receives the time the current tick
+// started so every job in a tick agrees on what "now" is.
+type Job func(ctx context.Context, now time.Time) error
+
+type job struct {
+	name string
+	run  Job
+}
+
+// Scheduler runs its jobs one after another on every tick.
+type Scheduler struct {
+	interval time.Duration
+	jobs     []job
+
+	// ErrorLog receives job failures. Defaults to the standard logger.
+	ErrorLog *log.Logger
+}
+
+// New creates a scheduler that ticks every interval, or every DefaultInterval
+// when interval is not positive.
+func New(interval time.Duration) *Scheduler {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Scheduler{interval: interval}
+}
+
+// Add registers a job under a name used when reporting its failures.
+func (s *Scheduler) Add(name string, run Job) {
+	s.jobs = append(s.jobs, job{name: name, run: run})
+}
+
+// Run ticks until ctx is canceled.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.RunOnce(ctx, now)
+		}
+	}
+}
+
+// RunOnce runs every job a single time as of now.
+func (s *Scheduler) RunOnce(ctx context.Context, now time.Time) {
+	for _, j := range s.jobs {
+		if err := j.run(ctx, now); err != nil {
+			s.logf("scheduler: %s: %v", j.name, err)
+		}
+	}
+}
+
+func (s *Scheduler) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// ExpireSecrets deletes secrets from store once their expiration time passes and
+// sends a SECRET_DELETE event for each of them to notifier.
+func ExpireSecrets(store storage.Storage, notifier notify.Notifier) Job {
+	return func(ctx context.Context, now time.Time) error {
+		purged, err := store.PurgeExpiredSecrets(ctx, now)
+		if err != nil {
+			return err
+		}
+		return notifyAll(ctx, notifier, notify.SecretDelete, purged)
+	}
+}
+
+// RotateSecrets advances the rotation schedule of secrets that are due and sends
+// a SECRET_ROTATE event for each of them to notifier.
+func RotateSecrets(store storage.Storage, notifier notify.Notifier) Job {
+	return func(ctx context.Context, now time.Time) error {
+		rotated, err := store.RotateSecrets(ctx, now)
+		if err != nil {
+			return err
+		}
+		return notifyAll(ctx, notifier, notify.SecretRotate, rotated)
+	}
+}
+
+// DestroyScheduledVersions performs the delayed destruction of versions once
+// their scheduled destroy time passes and sends a SECRET_VERSION_DESTROY event
+// for each of them to notifier.
+func DestroyScheduledVersions(store storage.Storage, notifier notify.Notifier) Job {
+	return func(ctx context.Context, now time.Time) error {
+		destroyed, err := store.DestroyScheduledVersions(ctx, now)
+		if err != nil {
+			return err
+		}
+		var errs []error
+		for _, d := range destroyed {
+			event := notify.Event{Type: notify.SecretVersionDestroy, Secret: d.Secret, Version: d.Version}
+			if err := notifier.Notify(ctx, event); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// notifyAll sends an event of eventType for every secret, returning all failures.
+func notifyAll(ctx context.Context, notifier notify.Notifier, eventType notify.EventType, secrets []*models.Secret) error {
+	var errs []error
+	for _, secret := range secrets {
+		if err := notifier.Notify(ctx, notify.Event{Type: eventType, Secret: secret}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
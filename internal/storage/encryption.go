@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/charlesgreen/gsm/internal/atomicfile"
+	"github.com/charlesgreen/gsm/internal/kms"
+)
+
+var (
+	// ErrEncrypted is returned when loading an encrypted storage file without a key.
+	ErrEncrypted = errors.New("storage file is encrypted but no key was given")
+	// ErrWrongKey is returned when a storage file was encrypted with a different key.
+	ErrWrongKey = errors.New("storage file was encrypted with a different key")
+)
+
+// Key sources recorded in the envelope of encrypted data.
+const (
+	sourceKeyFile    = "key file"
+	sourcePassphrase = "passphrase"
+	sourceKMS        = "KMS key"
+)
+
+// passphraseIterations is the PBKDF2-HMAC-SHA256 work factor for passphrases.
+const passphraseIterations = 600_000
+
+// envelopePrefix starts every envelope, telling encrypted data apart from the
+// JSON of a plaintext storage file or journal record.
+var envelopePrefix = []byte(`{"encryption":`)
+
+// envelope is the on-disk form of data encrypted at rest. The data is sealed
+// with AES-256-GCM under a random data key, and the data key is sealed under
+// the key encryption key the header describes.
+type envelope struct {
+	Encryption *envelopeHeader `json:"encryption"`
+	Ciphertext []byte          `json:"ciphertext"`
+}
+
+type envelopeHeader struct {
+	Source            string `json:"source"`
+	Salt              []byte `json:"salt,omitempty"`
+	Iterations        int    `json:"iterations,omitempty"`
+	KmsKeyVersionName string `json:"kmsKeyVersionName,omitempty"`
+	WrappedKey        []byte `json:"wrappedKey"`
+}
+
+// EncryptionKey is a key encryption key that storage files and journals are
+// encrypted under. Create one with KeyConfig.
+type EncryptionKey interface {
+	source() string
+	// wrap seals a data key and records how in header.
+	wrap(dataKey []byte, header *envelopeHeader) error
+	// unwrap opens the data key sealed in header.
+	unwrap(header *envelopeHeader) ([]byte, error)
+}
+
+// KeyConfig selects where the key that encrypts storage at rest comes from,
+// mirroring the GSM_STORAGE_KEY_FILE, GSM_STORAGE_PASSPHRASE and
+// GSM_STORAGE_KMS_KEY environment variables. At most one may be set.
+type KeyConfig struct {
+	// KeyFile holds 32 bytes, raw or base64-encoded.
+	KeyFile string
+	// Passphrase is stretched into a key with PBKDF2.
+	Passphrase string
+	// KMSKey is a crypto key resource name in the simulated Cloud KMS. It is
+	// registered if it is not already. The registry must be kept in a file, see
+	// kms.Open, since only then does the key have material of its own.
+	KMSKey string
+}
+
+// Key returns the key the configuration selects, or nil when it selects none.
+func (c KeyConfig) Key(keys *kms.Registry) (EncryptionKey, error) {
+	set := 0
+	for _, value := range []string{c.KeyFile, c.Passphrase, c.KMSKey} {
+		if value != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, errors.New("only one of a key file, passphrase and KMS key may encrypt storage")
+	}
+
+	switch {
+	case c.KeyFile != "":
+		key, err := keyFromFile(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	case c.Passphrase != "":
+		salt := make([]byte, 16)
+		_, _ = rand.Read(salt)
+		return &passphraseKey{passphrase: c.Passphrase, salt: salt, derived: make(map[string][]byte)}, nil
+	case c.KMSKey != "":
+		if keys == nil || !keys.Persistent() {
+			return nil, errors.New("a KMS key can only encrypt storage when the KMS keys are kept in a file, which holds their material")
+		}
+		if _, err := keys.CreateKey(c.KMSKey); err != nil && err != kms.ErrKeyExists {
+			return nil, fmt.Errorf("%s: %w", c.KMSKey, err)
+		}
+		return &kmsKey{keys: keys, name: c.KMSKey}, nil
+	}
+	return nil, nil
+}
+
+// sealData encrypts data under key. A nil key leaves data as it is.
+func sealData(key EncryptionKey, data []byte) ([]byte, error) {
+	if key == nil {
+		return data, nil
+	}
+
+	dataKey := make([]byte, 32)
+	_, _ = rand.Read(dataKey)
+	sealed, err := encrypt(dataKey, data)
+	if err != nil {
+		return nil, err
+	}
+	header := &envelopeHeader{Source: key.source()}
+	if err := key.wrap(dataKey, header); err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	return json.Marshal(envelope{Encryption: header, Ciphertext: sealed})
+}
+
+// openData decrypts data sealed by sealData. Data that was never encrypted is
+// returned as it is, so that setting a key encrypts an existing store the next
+// time it is written.
+func openData(key EncryptionKey, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, envelopePrefix) {
+		return data, nil
+	}
+	if key == nil {
+		return nil, ErrEncrypted
+	}
+
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	if env.Encryption == nil {
+		return nil, errors.New("encrypted data has no encryption header")
+	}
+	if env.Encryption.Source != key.source() {
+		return nil, fmt.Errorf("%w: it was encrypted with a %s, not a %s", ErrWrongKey, env.Encryption.Source, key.source())
+	}
+	dataKey, err := key.unwrap(env.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decrypt(dataKey, env.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+// Rekey re-encrypts the storage file at path, and its journal if it has one,
+// from one key to another. Either key may be nil for plaintext. Data already
+// under the new key is left as it is, so an interrupted rekey can be rerun. The
+// emulator must not be running on the store meanwhile.
+func Rekey(path string, from, to EncryptionKey) error {
+	reseal := func(data []byte) ([]byte, error) {
+		plaintext, err := openData(from, data)
+		if err != nil {
+			var alreadyErr error
+			if plaintext, alreadyErr = openData(to, data); alreadyErr != nil {
+				return nil, err
+			}
+		}
+		return sealData(to, plaintext)
+	}
+
+	if data, err := os.ReadFile(path); err == nil {
+		resealed, err := reseal(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := atomicfile.WriteFile(path, resealed, 0o600); err != nil {
+			return fmt.Errorf("failed to write storage file: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read storage file: %w", err)
+	}
+
+	journalPath := path + ".journal"
+	journal, err := os.ReadFile(journalPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read journal: %w", err)
+	}
+	var resealed bytes.Buffer
+	for n := 1; ; n++ {
+		line, rest, complete := bytes.Cut(journal, []byte("\n"))
+		if !complete {
+			break
+		}
+		data, err := reseal(line)
+		if err != nil {
+			return fmt.Errorf("%s: record %d: %w", journalPath, n, err)
+		}
+		resealed.Write(data)
+		resealed.WriteByte('\n')
+		journal = rest
+	}
+	if err := atomicfile.WriteFile(journalPath, resealed.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	return nil
+}
+
+// encrypt encrypts plaintext with AES-256-GCM under key, prefixed by the nonce.
+func encrypt(key, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, _ = rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decrypt decrypts a ciphertext produced by encrypt.
+func decrypt(key, ciphertext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aesKey is a key encryption key read from a key file.
+type aesKey struct {
+	key []byte
+}
+
+func keyFromFile(path string) (*aesKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil && len(decoded) == 32 {
+		return &aesKey{key: decoded}, nil
+	}
+	if len(data) == 32 {
+		return &aesKey{key: data}, nil
+	}
+	return nil, fmt.Errorf("key file %s must hold 32 bytes, raw or base64-encoded", path)
+}
+
+func (k *aesKey) source() string {
+	return sourceKeyFile
+}
+
+func (k *aesKey) wrap(dataKey []byte, header *envelopeHeader) error {
+	wrapped, err := encrypt(k.key, dataKey)
+	header.WrappedKey = wrapped
+	return err
+}
+
+func (k *aesKey) unwrap(header *envelopeHeader) ([]byte, error) {
+	dataKey, err := decrypt(k.key, header.WrappedKey)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return dataKey, nil
+}
+
+// passphraseKey derives key encryption keys from a passphrase. Each key is
+// derived once per salt, since derivation is slow by design.
+type passphraseKey struct {
+	passphrase string
+	salt       []byte // for data sealed by this key
+
+	mu      sync.Mutex
+	derived map[string][]byte // by salt and iterations
+}
+
+func (k *passphraseKey) source() string {
+	return sourcePassphrase
+}
+
+func (k *passphraseKey) derive(salt []byte, iterations int) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	id := fmt.Sprintf("%x/%d", salt, iterations)
+	if key, ok := k.derived[id]; ok {
+		return key, nil
+	}
+	key, err := pbkdf2.Key(sha256.New, k.passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	k.derived[id] = key
+	return key, nil
+}
+
+func (k *passphraseKey) wrap(dataKey []byte, header *envelopeHeader) error {
+	header.Salt, header.Iterations = k.salt, passphraseIterations
+	key, err := k.derive(header.Salt, header.Iterations)
+	if err != nil {
+		return err
+	}
+	wrapped, err := encrypt(key, dataKey)
+	header.WrappedKey = wrapped
+	return err
+}
+
+func (k *passphraseKey) unwrap(header *envelopeHeader) ([]byte, error) {
+	key, err := k.derive(header.Salt, header.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := decrypt(key, header.WrappedKey)
+	if err != nil {
+		return nil, ErrWrongKey
+	}
+	return dataKey, nil
+}
+
+// kmsKey wraps data keys with a crypto key of the simulated Cloud KMS, so
+// disabling or destroying its key version makes the store unreadable.
+type kmsKey struct {
+	keys *kms.Registry
+	name string
+}
+
+func (k *kmsKey) source() string {
+	return sourceKMS
+}
+
+func (k *kmsKey) wrap(dataKey []byte, header *envelopeHeader) error {
+	wrapped, keyVersionName, err := k.keys.Encrypt(k.name, dataKey)
+	header.WrappedKey, header.KmsKeyVersionName = wrapped, keyVersionName
+	return err
+}
+
+func (k *kmsKey) unwrap(header *envelopeHeader) ([]byte, error) {
+	if !strings.HasPrefix(header.KmsKeyVersionName, k.name+"/") {
+		return nil, fmt.Errorf("%w: it was encrypted with %s, not %s", ErrWrongKey, header.KmsKeyVersionName, k.name)
+	}
+	dataKey, err := k.keys.Decrypt(header.KmsKeyVersionName, header.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dataKey, nil
+}
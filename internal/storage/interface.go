@@ -4,7 +4,12 @@ package storage
 import (
 	"context"
 	"errors"
+	"fmt"
+	"time"
+
+	"github.com/charlesgreen/gsm/internal/filter"
 	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/pagination"
 )
 
 var (
@@ -14,21 +19,86 @@ var (
 	ErrVersionNotFound = errors.New("version not found")
 	// ErrSecretExists is returned when attempting to create a secret that already exists.
 	ErrSecretExists = errors.New("secret already exists")
+	// ErrVersionDisabled is returned when accessing the data of a disabled secret version.
+	ErrVersionDisabled = errors.New("version is disabled")
+	// ErrVersionDestroyed is returned when accessing or changing the state of a destroyed secret version.
+	ErrVersionDestroyed = errors.New("version is destroyed")
+	// ErrInvalidPageToken is returned when a page token is malformed or was issued for a different list request.
+	ErrInvalidPageToken = pagination.ErrInvalidToken
+	// ErrEtagMismatch is returned when a request's etag does not match the stored resource.
+	ErrEtagMismatch = errors.New("etag mismatch")
+	// ErrRotationWithoutTopics is returned when an update would leave a secret with a rotation schedule but no topics.
+	ErrRotationWithoutTopics = errors.New("rotation requires at least one topic")
+	// ErrRotationWithoutTime is returned when a secret would have a rotation period but no next rotation time.
+	ErrRotationWithoutTime = errors.New("rotation period requires a next rotation time")
+	// ErrChecksumMismatch is returned when a payload's dataCrc32c does not match its data.
+	ErrChecksumMismatch = errors.New("payload checksum mismatch")
 )
 
+// DestroyedVersion is a version destroyed by DestroyScheduledVersions,
+// together with the secret it belongs to.
+type DestroyedVersion struct {
+	Secret  *models.Secret
+	Version *models.SecretVersion
+}
+
+// VersionAliasError is returned when a version alias does not point at an
+// existing version that has not been destroyed.
+type VersionAliasError struct {
+	Alias   string
+	Version int64
+}
+
+func (e *VersionAliasError) Error() string {
+	return fmt.Sprintf("version alias %q refers to version %d, which does not exist or is destroyed", e.Alias, e.Version)
+}
+
 // Storage defines the interface for secret storage operations.
+//
+// Secrets are addressed by project and secret ID. Regional secrets use a project
+// ID qualified with their location, {project}/locations/{location}, so they never
+// collide with a global secret of the same ID and their resource names carry the
+// location.
 type Storage interface {
 	CreateSecret(ctx context.Context, projectID, secretID string, secret *models.Secret) error
 	GetSecret(ctx context.Context, projectID, secretID string) (*models.Secret, error)
-	ListSecrets(ctx context.Context, projectID string, pageSize int, pageToken string) ([]*models.Secret, string, error)
-	DeleteSecret(ctx context.Context, projectID, secretID string) error
+	ListSecrets(ctx context.Context, projectID string, match *filter.Filter, pageSize int, pageToken string) (secrets []*models.Secret, nextPageToken string, totalSize int, err error)
+	UpdateSecret(ctx context.Context, projectID, secretID string, secret *models.Secret, updateMask []string) (*models.Secret, error)
+	// DeleteSecret, UpdateSecret and SetSecretVersionState fail with
+	// ErrEtagMismatch when given an etag that differs from the resource's
+	// current one. An empty etag skips the check.
+	DeleteSecret(ctx context.Context, projectID, secretID, etag string) error
 
-	AddSecretVersion(ctx context.Context, projectID, secretID string, data []byte) (*models.SecretVersion, error)
+	// AddSecretVersion fails with ErrChecksumMismatch when the payload carries
+	// a dataCrc32c that does not match its data.
+	AddSecretVersion(ctx context.Context, projectID, secretID string, payload *models.SecretPayload) (*models.SecretVersion, error)
 	GetSecretVersion(ctx context.Context, projectID, secretID, versionID string) (*models.SecretVersion, error)
-	ListSecretVersions(ctx context.Context, projectID, secretID string, pageSize int, pageToken string) ([]*models.SecretVersion, string, error)
-	DeleteSecretVersion(ctx context.Context, projectID, secretID, versionID string) error
+	ListSecretVersions(ctx context.Context, projectID, secretID string, match *filter.Filter, pageSize int, pageToken string) (versions []*models.SecretVersion, nextPageToken string, totalSize int, err error)
+	SetSecretVersionState(ctx context.Context, projectID, secretID, versionID string, state models.SecretVersionState, etag string) (*models.SecretVersion, error)
+
+	// AccessSecretVersion returns the version versionID resolves to along with
+	// its data, read together so that an alias or "latest" cannot move to
+	// another version in between. AddSecretVersion and AccessSecretVersion
+	// fail with a *kms.NotFoundError or *kms.StateError when the secret's
+	// customer-managed key is missing or its key version is not enabled.
+	AccessSecretVersion(ctx context.Context, projectID, secretID, versionID string) (*models.SecretVersion, []byte, error)
+
+	// GetIamPolicy and SetIamPolicy operate on the secret's policy, or on the
+	// project's own policy when secretID is empty.
+	GetIamPolicy(ctx context.Context, projectID, secretID string) (*models.Policy, error)
+	SetIamPolicy(ctx context.Context, projectID, secretID string, policy *models.Policy) (*models.Policy, error)
+
+	// PurgeExpiredSecrets deletes secrets whose expiration time has passed and
+	// returns them. Expired secrets are already hidden from every other method.
+	PurgeExpiredSecrets(ctx context.Context, now time.Time) ([]*models.Secret, error)
+
+	// RotateSecrets advances the rotation schedule of every secret whose next
+	// rotation time is at or before now and returns the secrets that rotated.
+	RotateSecrets(ctx context.Context, now time.Time) ([]*models.Secret, error)
 
-	AccessSecretVersion(ctx context.Context, projectID, secretID, versionID string) ([]byte, error)
+	// DestroyScheduledVersions destroys every version whose scheduled destroy
+	// time, set when a secret has a versionDestroyTtl, is at or before now.
+	DestroyScheduledVersions(ctx context.Context, now time.Time) ([]DestroyedVersion, error)
 
 	Close() error
 }
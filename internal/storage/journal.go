@@ -0,0 +1,556 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charlesgreen/gsm/internal/atomicfile"
+	"github.com/charlesgreen/gsm/internal/models"
+)
+
+// Operations recorded in the journal.
+const (
+	opCreateSecret            = "CreateSecret"
+	opUpdateSecret            = "UpdateSecret"
+	opDeleteSecret            = "DeleteSecret"
+	opAddSecretVersion        = "AddSecretVersion"
+	opSetSecretVersionState   = "SetSecretVersionState"
+	opSetIamPolicy            = "SetIamPolicy"
+	opPurgeExpiredSecret      = "PurgeExpiredSecret"
+	opRotateSecret            = "RotateSecret"
+	opDestroyScheduledVersion = "DestroyScheduledVersion"
+)
+
+// defaultCompactThreshold is how many records the journal holds before it is
+// compacted into the snapshot.
+const defaultCompactThreshold = 1000
+
+// journalLegacyVersion is the schema version of journal records that do not
+// record one, which were written before records carried it.
+const journalLegacyVersion = "2.0.0"
+
+// JournalRecord is one change in the journal, stored as a line of JSON. It
+// carries the state of what changed afterwards, rather than the request, so
+// that replaying it needs neither the clock nor the keys the change was made
+// with, and replaying it again is harmless. Schema is the SchemaVersion of
+// the records it embeds.
+type JournalRecord struct {
+	Schema   string         `json:"schema,omitempty"`
+	Time     time.Time      `json:"time"`
+	Op       string         `json:"op"`
+	Key      string         `json:"key,omitempty"`
+	Secret   *SecretRecord  `json:"secret,omitempty"`
+	Version  *VersionRecord `json:"version,omitempty"`
+	Resource string         `json:"resource,omitempty"`
+	Policy   *PolicyRecord  `json:"policy,omitempty"`
+}
+
+// apply replays the record onto secrets and policies. Records in a schema
+// version other than SchemaVersion are refused rather than misread.
+func (r *JournalRecord) apply(secrets map[string]*models.Secret, policies map[string]*models.Policy) error {
+	schema := r.Schema
+	if schema == "" {
+		schema = journalLegacyVersion
+	}
+	if schema != SchemaVersion {
+		return &SchemaVersionError{Version: schema}
+	}
+
+	switch r.Op {
+	case opCreateSecret:
+		if r.Secret == nil {
+			return fmt.Errorf("%s of %s has no secret", r.Op, r.Key)
+		}
+		secret := r.Secret.secret()
+		delete(policies, secret.Name)
+		secrets[r.Key] = secret
+	case opUpdateSecret, opRotateSecret, opAddSecretVersion, opSetSecretVersionState, opDestroyScheduledVersion:
+		if r.Secret == nil {
+			return fmt.Errorf("%s of %s has no secret", r.Op, r.Key)
+		}
+		// A secret missing here was deleted later on, after the snapshot this
+		// journal is replayed onto was written, and will be deleted again.
+		secret := r.Secret.secret()
+		if existing, exists := secrets[r.Key]; exists {
+			secret.Versions = existing.Versions
+		}
+		if r.Version != nil {
+			version := r.Version.version()
+			secret.Versions[version.GetVersionID()] = version
+		}
+		secrets[r.Key] = secret
+	case opDeleteSecret, opPurgeExpiredSecret:
+		if secret, exists := secrets[r.Key]; exists {
+			delete(policies, secret.Name)
+			delete(secrets, r.Key)
+		}
+	case opSetIamPolicy:
+		if r.Policy == nil {
+			return fmt.Errorf("%s of %s has no policy", r.Op, r.Resource)
+		}
+		policies[r.Resource] = r.Policy.policy()
+	default:
+		return fmt.Errorf("unknown operation %q", r.Op)
+	}
+	return nil
+}
+
+// JournalStorage provides file-backed storage that appends each change to a
+// journal instead of rewriting the whole store. The journal lives next to a
+// snapshot in the storage file format, at the snapshot's path with a .journal
+// suffix. Once it holds enough records it is compacted: the snapshot is
+// rewritten with the current state and the journal emptied.
+//
+// Until then the journal is an exact record of every change, with the time it
+// was made.
+type JournalStorage struct {
+	*MemoryStorage
+	filePath string
+
+	mu               sync.Mutex // serialises changes with their records
+	file             *os.File
+	size             int64 // bytes of complete records in file
+	records          int   // records since the last compaction
+	compactThreshold int
+	compactErr       error
+	key              EncryptionKey
+}
+
+// NewJournalStorage creates a journal storage instance with its snapshot at
+// the specified file and its journal alongside it.
+func NewJournalStorage(filePath string) (*JournalStorage, error) {
+	return &JournalStorage{
+		MemoryStorage:    NewMemoryStorage(),
+		filePath:         filePath,
+		compactThreshold: defaultCompactThreshold,
+	}, nil
+}
+
+// SetCompactThreshold sets how many records the journal holds before it is
+// compacted. A threshold of zero or less only compacts on Compact and Close.
+func (j *JournalStorage) SetCompactThreshold(records int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.compactThreshold = records
+}
+
+// SetEncryptionKey encrypts the snapshot and each journal record at rest under
+// key. Data written without a key still loads, and is encrypted when it is
+// next written.
+func (j *JournalStorage) SetEncryptionKey(key EncryptionKey) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.key = key
+}
+
+// journalPath is where the journal of the snapshot at filePath is kept.
+func (j *JournalStorage) journalPath() string {
+	return j.filePath + ".journal"
+}
+
+// Load restores the snapshot, which may be a storage file written by
+// PersistentStorage, and replays the journal on top of it. A record cut short
+// by a crash while it was appended is discarded.
+func (j *JournalStorage) Load() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	secrets := make(map[string]*models.Secret)
+	policies := make(map[string]*models.Policy)
+	raw, err := os.ReadFile(j.filePath)
+	switch {
+	case err == nil:
+		data, err := openData(j.key, raw)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt storage file: %w", err)
+		}
+		if data, err = upgradeFile(j.filePath, raw, data, j.key); err != nil {
+			return err
+		}
+		if secrets, policies, err = decodeData(data); err != nil {
+			return fmt.Errorf("failed to parse storage file: %w", err)
+		}
+	case !os.IsNotExist(err):
+		return fmt.Errorf("failed to read storage file: %w", err)
+	}
+
+	if err := j.open(); err != nil {
+		return err
+	}
+	journal, err := os.ReadFile(j.journalPath())
+	if err != nil {
+		return fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	var size int64
+	records := 0
+	for len(journal) > 0 {
+		line, rest, complete := bytes.Cut(journal, []byte("\n"))
+		if !complete {
+			break
+		}
+		plaintext, err := openData(j.key, line)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt journal record %d: %w", records+1, err)
+		}
+		var record JournalRecord
+		if err := json.Unmarshal(plaintext, &record); err != nil {
+			return fmt.Errorf("failed to parse journal record %d: %w", records+1, err)
+		}
+		if err := record.apply(secrets, policies); err != nil {
+			return fmt.Errorf("failed to replay journal record %d: %w", records+1, err)
+		}
+		size += int64(len(line)) + 1
+		records++
+		journal = rest
+	}
+	if len(journal) > 0 {
+		if err := j.file.Truncate(size); err != nil {
+			return fmt.Errorf("failed to discard incomplete journal record: %w", err)
+		}
+	}
+
+	j.size, j.records = size, records
+	j.restore(secrets, policies)
+	return nil
+}
+
+// open opens the journal for appending, creating it if needed. Callers must
+// hold j.mu.
+func (j *JournalStorage) open() error {
+	if j.file != nil {
+		return nil
+	}
+	file, err := os.OpenFile(j.journalPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	j.file, j.size = file, info.Size()
+	return nil
+}
+
+// append writes records to the end of the journal and syncs it, then compacts
+// the journal if it has grown past the threshold. A failed write is cut off so
+// that later records still follow a complete one, and a record that failed to
+// sync is not replayed for a change its caller rolled back. Callers must hold
+// j.mu.
+func (j *JournalStorage) append(records ...*JournalRecord) error {
+	if err := j.open(); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	now := time.Now().UTC()
+	for _, record := range records {
+		record.Schema, record.Time = SchemaVersion, now
+		data, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal journal record: %w", err)
+		}
+		if data, err = sealData(j.key, data); err != nil {
+			return fmt.Errorf("failed to encrypt journal record: %w", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	if _, err := j.file.Write(buf.Bytes()); err != nil {
+		_ = j.file.Truncate(j.size)
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		_ = j.file.Truncate(j.size)
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	j.size += int64(buf.Len())
+	j.records += len(records)
+
+	// The change is durable already, so a failed compaction is only reported
+	// through FlushError and retried with the next record.
+	if j.compactThreshold > 0 && j.records >= j.compactThreshold {
+		j.compactErr = j.compact()
+	}
+	return nil
+}
+
+// Compact rewrites the snapshot with the current state and empties the journal.
+func (j *JournalStorage) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.compactErr = j.compact()
+	return j.compactErr
+}
+
+// compact writes the snapshot before emptying the journal, so a crash in
+// between replays records the snapshot already holds, which changes nothing.
+// Callers must hold j.mu.
+func (j *JournalStorage) compact() error {
+	data, err := j.encodeData()
+	if err != nil {
+		return fmt.Errorf("failed to marshal storage data: %w", err)
+	}
+	if data, err = sealData(j.key, data); err != nil {
+		return fmt.Errorf("failed to encrypt storage data: %w", err)
+	}
+	if err := atomicfile.WriteFile(j.filePath, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write storage file: %w", err)
+	}
+
+	if err := j.open(); err != nil {
+		return err
+	}
+	if err := j.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	j.size, j.records = 0, 0
+	return nil
+}
+
+// FlushError returns the error of the most recent compaction, or nil if it
+// succeeded. Compactions triggered by a change do not fail the change, so this
+// is how their failures surface.
+func (j *JournalStorage) FlushError() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.compactErr
+}
+
+// secretRecord returns the metadata of a stored secret as a journal record
+// field.
+func (j *JournalStorage) secretRecord(key string) *SecretRecord {
+	j.MemoryStorage.mu.RLock()
+	defer j.MemoryStorage.mu.RUnlock()
+	return newSecretMetadataRecord(j.secrets[key])
+}
+
+// update applies change to the stored state and appends the records that
+// persist builds for it. Both happen under j.mu, and a change whose records
+// cannot be appended is rolled back, so memory never holds a change the
+// journal does not. Callers must hold j.mu.
+func (j *JournalStorage) update(change func() error, persist func() ([]*JournalRecord, error)) error {
+	return j.atomically(change, func() error {
+		records, err := persist()
+		if err != nil {
+			return err
+		}
+		return j.append(records...)
+	})
+}
+
+// CreateSecret creates a new secret and records it in the journal.
+func (j *JournalStorage) CreateSecret(ctx context.Context, projectID, secretID string, secret *models.Secret) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	key := fmt.Sprintf("%s/%s", projectID, secretID)
+	return j.update(func() error {
+		return j.MemoryStorage.CreateSecret(ctx, projectID, secretID, secret)
+	}, func() ([]*JournalRecord, error) {
+		return []*JournalRecord{{Op: opCreateSecret, Key: key, Secret: j.secretRecord(key)}}, nil
+	})
+}
+
+// UpdateSecret updates a secret's metadata and records the change in the journal.
+func (j *JournalStorage) UpdateSecret(ctx context.Context, projectID, secretID string, secret *models.Secret, updateMask []string) (*models.Secret, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var updated *models.Secret
+	key := fmt.Sprintf("%s/%s", projectID, secretID)
+	if err := j.update(func() (err error) {
+		updated, err = j.MemoryStorage.UpdateSecret(ctx, projectID, secretID, secret, updateMask)
+		return err
+	}, func() ([]*JournalRecord, error) {
+		return []*JournalRecord{{Op: opUpdateSecret, Key: key, Secret: newSecretMetadataRecord(updated)}}, nil
+	}); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeleteSecret removes a secret and records the change in the journal.
+func (j *JournalStorage) DeleteSecret(ctx context.Context, projectID, secretID, etag string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.update(func() error {
+		return j.MemoryStorage.DeleteSecret(ctx, projectID, secretID, etag)
+	}, func() ([]*JournalRecord, error) {
+		return []*JournalRecord{{Op: opDeleteSecret, Key: fmt.Sprintf("%s/%s", projectID, secretID)}}, nil
+	})
+}
+
+// AddSecretVersion adds a new version to an existing secret and records it in
+// the journal.
+func (j *JournalStorage) AddSecretVersion(ctx context.Context, projectID, secretID string, payload *models.SecretPayload) (*models.SecretVersion, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var version *models.SecretVersion
+	key := fmt.Sprintf("%s/%s", projectID, secretID)
+	if err := j.update(func() (err error) {
+		version, err = j.MemoryStorage.AddSecretVersion(ctx, projectID, secretID, payload)
+		return err
+	}, func() ([]*JournalRecord, error) {
+		return []*JournalRecord{{Op: opAddSecretVersion, Key: key, Secret: j.secretRecord(key), Version: newVersionRecord(version)}}, nil
+	}); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// SetSecretVersionState changes the state of a secret version and records the
+// change in the journal.
+func (j *JournalStorage) SetSecretVersionState(ctx context.Context, projectID, secretID, versionID string, state models.SecretVersionState, etag string) (*models.SecretVersion, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var version *models.SecretVersion
+	key := fmt.Sprintf("%s/%s", projectID, secretID)
+	if err := j.update(func() (err error) {
+		version, err = j.MemoryStorage.SetSecretVersionState(ctx, projectID, secretID, versionID, state, etag)
+		return err
+	}, func() ([]*JournalRecord, error) {
+		// Destroying a version may remove aliases from the secret as well
+		return []*JournalRecord{{Op: opSetSecretVersionState, Key: key, Secret: j.secretRecord(key), Version: newVersionRecord(version)}}, nil
+	}); err != nil {
+		return nil, err
+	}
+	return version, nil
+}
+
+// SetIamPolicy replaces an IAM policy and records the change in the journal.
+func (j *JournalStorage) SetIamPolicy(ctx context.Context, projectID, secretID string, policy *models.Policy) (*models.Policy, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var updated *models.Policy
+	if err := j.update(func() (err error) {
+		updated, err = j.MemoryStorage.SetIamPolicy(ctx, projectID, secretID, policy)
+		return err
+	}, func() ([]*JournalRecord, error) {
+		j.MemoryStorage.mu.RLock()
+		resource, err := j.policyResource(projectID, secretID)
+		j.MemoryStorage.mu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		return []*JournalRecord{{Op: opSetIamPolicy, Resource: resource, Policy: newPolicyRecord(updated)}}, nil
+	}); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// PurgeExpiredSecrets deletes expired secrets and records each deletion in the
+// journal. Secrets whose deletion cannot be recorded stay in place and are
+// purged again on the next call.
+func (j *JournalStorage) PurgeExpiredSecrets(ctx context.Context, now time.Time) ([]*models.Secret, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var purged []*models.Secret
+	if err := j.update(func() (err error) {
+		purged, err = j.MemoryStorage.PurgeExpiredSecrets(ctx, now)
+		return err
+	}, func() ([]*JournalRecord, error) {
+		records := make([]*JournalRecord, 0, len(purged))
+		for _, secret := range purged {
+			records = append(records, &JournalRecord{Op: opPurgeExpiredSecret, Key: secretKey(secret.Name)})
+		}
+		return records, nil
+	}); err != nil {
+		return nil, err
+	}
+	return purged, nil
+}
+
+// RotateSecrets advances due rotation schedules and records each rotation in
+// the journal. Rotations that cannot be recorded are undone and happen again
+// on the next call.
+func (j *JournalStorage) RotateSecrets(ctx context.Context, now time.Time) ([]*models.Secret, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var rotated []*models.Secret
+	if err := j.update(func() (err error) {
+		rotated, err = j.MemoryStorage.RotateSecrets(ctx, now)
+		return err
+	}, func() ([]*JournalRecord, error) {
+		records := make([]*JournalRecord, 0, len(rotated))
+		for _, secret := range rotated {
+			records = append(records, &JournalRecord{Op: opRotateSecret, Key: secretKey(secret.Name), Secret: newSecretMetadataRecord(secret)})
+		}
+		return records, nil
+	}); err != nil {
+		return nil, err
+	}
+	return rotated, nil
+}
+
+// DestroyScheduledVersions destroys versions whose scheduled destruction is due
+// and records each one in the journal. Destructions that cannot be recorded
+// are undone and happen again on the next call.
+func (j *JournalStorage) DestroyScheduledVersions(ctx context.Context, now time.Time) ([]DestroyedVersion, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var destroyed []DestroyedVersion
+	if err := j.update(func() (err error) {
+		destroyed, err = j.MemoryStorage.DestroyScheduledVersions(ctx, now)
+		return err
+	}, func() ([]*JournalRecord, error) {
+		// Records keep the order versions were destroyed in, so the last one of
+		// each secret carries its final aliases.
+		records := make([]*JournalRecord, 0, len(destroyed))
+		for _, d := range destroyed {
+			records = append(records, &JournalRecord{
+				Op:      opDestroyScheduledVersion,
+				Key:     secretKey(d.Secret.Name),
+				Secret:  newSecretMetadataRecord(d.Secret),
+				Version: newVersionRecord(d.Version),
+			})
+		}
+		return records, nil
+	}); err != nil {
+		return nil, err
+	}
+	return destroyed, nil
+}
+
+// Close compacts the journal into the snapshot and closes it.
+func (j *JournalStorage) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.compactErr = j.compact()
+	if j.file == nil {
+		return j.compactErr
+	}
+	err := j.file.Close()
+	j.file = nil
+	return errors.Join(j.compactErr, err)
+}
+
+// secretKey returns the key a secret is stored under, "projectID/secretID",
+// from its resource name. Regional secrets keep their location in the project
+// ID.
+func secretKey(name string) string {
+	projectID, secretID, _ := strings.Cut(strings.TrimPrefix(name, "projects/"), "/secrets/")
+	return projectID + "/" + secretID
+}
@@ -1,40 +1,75 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/charlesgreen/gsm/internal/filter"
+	"github.com/charlesgreen/gsm/internal/kms"
 	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/pagination"
 )
 
 // MemoryStorage provides in-memory storage for secrets and versions with thread safety.
+//
+// The storage owns its data: secrets, versions and policies are copied on the
+// way in and out, so callers may modify what they pass or receive freely.
 type MemoryStorage struct {
-	mu      sync.RWMutex
-	secrets map[string]*models.Secret // key: "projectID/secretID"
+	mu       sync.RWMutex
+	secrets  map[string]*models.Secret // key: "projectID/secretID"
+	policies map[string]*models.Policy // key: resource name
+	keys     *kms.Registry
+	undo     *undoLog // state before the change in progress, if it may be rolled back
 }
 
 // NewMemoryStorage creates a new in-memory storage instance.
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
-		secrets: make(map[string]*models.Secret),
+		secrets:  make(map[string]*models.Secret),
+		policies: make(map[string]*models.Policy),
+		keys:     kms.NewRegistry(),
 	}
 }
 
+// SetKeyRegistry sets the registry of customer-managed keys that payloads are
+// encrypted with. Defaults to an empty registry.
+func (m *MemoryStorage) SetKeyRegistry(keys *kms.Registry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys = keys
+}
+
 // CreateSecret stores a new secret in memory.
 func (m *MemoryStorage) CreateSecret(_ context.Context, projectID, secretID string, secret *models.Secret) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	key := fmt.Sprintf("%s/%s", projectID, secretID)
-	if _, exists := m.secrets[key]; exists {
+	if _, exists := m.lookupSecret(projectID, secretID); exists {
 		return ErrSecretExists
 	}
 
-	m.secrets[key] = secret
+	if err := validateVersionAliases(secret, secret.VersionAliases); err != nil {
+		return err
+	}
+	if err := validateRotation(secret); err != nil {
+		return err
+	}
+
+	// An expired secret that has not been reaped yet gives way to the new one
+	key := fmt.Sprintf("%s/%s", projectID, secretID)
+	m.recordSecret(key)
+	if expired, exists := m.secrets[key]; exists {
+		delete(m.policies, expired.Name)
+	}
+
+	m.secrets[key] = secret.Clone()
 	return nil
 }
 
@@ -43,25 +78,29 @@ func (m *MemoryStorage) GetSecret(_ context.Context, projectID, secretID string)
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	key := fmt.Sprintf("%s/%s", projectID, secretID)
-	secret, exists := m.secrets[key]
+	secret, exists := m.lookupSecret(projectID, secretID)
 	if !exists {
 		return nil, ErrSecretNotFound
 	}
 
-	return secret, nil
+	return secret.Clone(), nil
 }
 
-// ListSecrets retrieves all secrets for a project with pagination support.
-func (m *MemoryStorage) ListSecrets(_ context.Context, projectID string, pageSize int, pageToken string) ([]*models.Secret, string, error) {
+// ListSecrets retrieves the secrets of a project that satisfy match, with
+// pagination support. The filter is applied before paginating, and totalSize
+// counts every matching secret.
+func (m *MemoryStorage) ListSecrets(_ context.Context, projectID string, match *filter.Filter, pageSize int, pageToken string) ([]*models.Secret, string, int, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	var secrets []*models.Secret
 	prefix := projectID + "/"
+	now := time.Now()
 
 	for key, secret := range m.secrets {
-		if strings.HasPrefix(key, prefix) {
+		// Regional secrets live under {project}/locations/{location}/, so only keys
+		// with nothing but the secret ID after the prefix belong to this scope.
+		if strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], "/") && !secret.IsExpired(now) && match.Match(secret) {
 			secrets = append(secrets, secret)
 		}
 	}
@@ -70,65 +109,106 @@ func (m *MemoryStorage) ListSecrets(_ context.Context, projectID string, pageSiz
 		return secrets[i].Name < secrets[j].Name
 	})
 
-	start := 0
-	if pageToken != "" {
-		startIdx, err := strconv.Atoi(pageToken)
-		if err == nil && startIdx >= 0 && startIdx < len(secrets) {
-			start = startIdx
-		}
+	page, next, err := pagination.Paginate(secrets, pageSize, pageToken, pagination.Query(projectID, match.String()),
+		func(s *models.Secret) string { return s.Name },
+		func(s *models.Secret, last string) bool { return s.Name > last },
+	)
+	if err != nil {
+		return nil, "", 0, err
 	}
+	return cloneAll(page), next, len(secrets), nil
+}
 
-	if pageSize <= 0 {
-		pageSize = 100
-	}
+// UpdateSecret copies the fields named in updateMask from secret onto the stored
+// secret. A non-empty etag on secret must match the stored secret's.
+func (m *MemoryStorage) UpdateSecret(_ context.Context, projectID, secretID string, secret *models.Secret, updateMask []string) (*models.Secret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	end := start + pageSize
-	if end > len(secrets) {
-		end = len(secrets)
+	existing, exists := m.lookupSecret(projectID, secretID)
+	if !exists {
+		return nil, ErrSecretNotFound
+	}
+	if secret.Etag != "" && secret.Etag != existing.Etag {
+		return nil, ErrEtagMismatch
 	}
 
-	result := secrets[start:end]
+	if slices.Contains(updateMask, "versionAliases") {
+		if err := validateVersionAliases(existing, secret.VersionAliases); err != nil {
+			return nil, err
+		}
+	}
 
-	var nextPageToken string
-	if end < len(secrets) {
-		nextPageToken = strconv.Itoa(end)
+	// Rotation and topics can be updated separately, so check the combination on
+	// a copy before committing it.
+	updated := *existing
+	updated.Update(secret.Clone(), updateMask)
+	if err := validateRotation(&updated); err != nil {
+		return nil, err
 	}
 
-	return result, nextPageToken, nil
+	m.recordSecret(fmt.Sprintf("%s/%s", projectID, secretID))
+	*existing = updated
+	return existing.Clone(), nil
 }
 
-// DeleteSecret removes a secret from memory.
-func (m *MemoryStorage) DeleteSecret(_ context.Context, projectID, secretID string) error {
+// DeleteSecret removes a secret from memory. A non-empty etag must match the
+// secret's.
+func (m *MemoryStorage) DeleteSecret(_ context.Context, projectID, secretID, etag string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	key := fmt.Sprintf("%s/%s", projectID, secretID)
-	if _, exists := m.secrets[key]; !exists {
+	secret, exists := m.lookupSecret(projectID, secretID)
+	if !exists {
 		return ErrSecretNotFound
 	}
+	if etag != "" && etag != secret.Etag {
+		return ErrEtagMismatch
+	}
 
+	key := fmt.Sprintf("%s/%s", projectID, secretID)
+	m.recordSecret(key)
 	delete(m.secrets, key)
+	delete(m.policies, secret.Name)
 	return nil
 }
 
 // AddSecretVersion adds a new version to an existing secret in memory.
-func (m *MemoryStorage) AddSecretVersion(_ context.Context, projectID, secretID string, data []byte) (*models.SecretVersion, error) {
+func (m *MemoryStorage) AddSecretVersion(_ context.Context, projectID, secretID string, payload *models.SecretPayload) (*models.SecretVersion, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	key := fmt.Sprintf("%s/%s", projectID, secretID)
-	secret, exists := m.secrets[key]
+	secret, exists := m.lookupSecret(projectID, secretID)
 	if !exists {
 		return nil, ErrSecretNotFound
 	}
 
+	if !payload.VerifyChecksum() {
+		return nil, ErrChecksumMismatch
+	}
+
+	data := bytes.Clone(payload.Data)
+	var encryption *models.CustomerManagedEncryptionStatus
+	if keyName := secret.KmsKeyName(); keyName != "" {
+		ciphertext, keyVersionName, err := m.keys.Encrypt(keyName, payload.Data)
+		if err != nil {
+			return nil, err
+		}
+		data = ciphertext
+		encryption = &models.CustomerManagedEncryptionStatus{KmsKeyVersionName: keyVersionName}
+	}
+
+	m.recordSecret(fmt.Sprintf("%s/%s", projectID, secretID))
 	secret.VersionCount++
 	versionID := strconv.Itoa(secret.VersionCount)
 
-	version := models.NewSecretVersion(projectID, secretID, versionID, data)
+	version := models.NewSecretVersion(projectID, secretID, versionID, payload.Data)
+	version.Data = data
+	version.CustomerManagedEncryption = encryption
+	version.ClientSpecifiedPayloadChecksum = payload.DataCrc32c != nil
 	secret.Versions[versionID] = version
 
-	return version, nil
+	return version.Clone(), nil
 }
 
 // GetSecretVersion retrieves a specific version of a secret from memory.
@@ -136,113 +216,331 @@ func (m *MemoryStorage) GetSecretVersion(_ context.Context, projectID, secretID,
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	key := fmt.Sprintf("%s/%s", projectID, secretID)
-	secret, exists := m.secrets[key]
+	secret, exists := m.lookupSecret(projectID, secretID)
 	if !exists {
 		return nil, ErrSecretNotFound
 	}
 
-	if versionID == "latest" {
-		if secret.VersionCount == 0 {
-			return nil, ErrVersionNotFound
-		}
-		versionID = strconv.Itoa(secret.VersionCount)
-	}
-
-	version, exists := secret.Versions[versionID]
-	if !exists {
-		return nil, ErrVersionNotFound
+	version, err := lookupVersion(secret, versionID)
+	if err != nil {
+		return nil, err
 	}
-
-	return version, nil
+	return version.Clone(), nil
 }
 
-// ListSecretVersions retrieves all versions of a secret with pagination support.
-func (m *MemoryStorage) ListSecretVersions(_ context.Context, projectID, secretID string, pageSize int, pageToken string) ([]*models.SecretVersion, string, error) {
+// ListSecretVersions retrieves the versions of a secret that satisfy match,
+// newest first, with pagination support. The filter is applied before
+// paginating, and totalSize counts every matching version.
+func (m *MemoryStorage) ListSecretVersions(_ context.Context, projectID, secretID string, match *filter.Filter, pageSize int, pageToken string) ([]*models.SecretVersion, string, int, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	key := fmt.Sprintf("%s/%s", projectID, secretID)
-	secret, exists := m.secrets[key]
+	secret, exists := m.lookupSecret(projectID, secretID)
 	if !exists {
-		return nil, "", ErrSecretNotFound
+		return nil, "", 0, ErrSecretNotFound
 	}
 
 	versions := make([]*models.SecretVersion, 0, len(secret.Versions))
 	for _, version := range secret.Versions {
-		versions = append(versions, version)
+		if match.Match(version) {
+			versions = append(versions, version)
+		}
 	}
 
 	sort.Slice(versions, func(i, j int) bool {
-		iVersion := versions[i].GetVersionID()
-		jVersion := versions[j].GetVersionID()
+		return versionNumber(versions[i].Name) > versionNumber(versions[j].Name)
+	})
+
+	page, next, err := pagination.Paginate(versions, pageSize, pageToken, pagination.Query(secret.Name, match.String()),
+		func(v *models.SecretVersion) string { return v.Name },
+		func(v *models.SecretVersion, last string) bool { return versionNumber(v.Name) < versionNumber(last) },
+	)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return cloneAll(page), next, len(versions), nil
+}
 
-		iNum, iErr := strconv.Atoi(iVersion)
-		jNum, jErr := strconv.Atoi(jVersion)
+// SetSecretVersionState moves a secret version to the given state. Destroyed
+// versions are final and cannot change state again. A non-empty etag must
+// match the version's.
+func (m *MemoryStorage) SetSecretVersionState(_ context.Context, projectID, secretID, versionID string, state models.SecretVersionState, etag string) (*models.SecretVersion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		if iErr == nil && jErr == nil {
-			return iNum > jNum // Latest first
+	secret, exists := m.lookupSecret(projectID, secretID)
+	if !exists {
+		return nil, ErrSecretNotFound
+	}
+
+	version, err := lookupVersion(secret, versionID)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" && etag != version.Etag {
+		return nil, ErrEtagMismatch
+	}
+
+	if version.State == models.StateDestroyed {
+		return nil, ErrVersionDestroyed
+	}
+
+	m.recordSecret(fmt.Sprintf("%s/%s", projectID, secretID))
+	switch {
+	case state != models.StateDestroyed:
+		version.SetState(state)
+	case secret.VersionDestroyTTL != nil && *secret.VersionDestroyTTL > 0:
+		// A pending destruction keeps its original deadline
+		if version.ScheduledDestroyTime == nil {
+			version.ScheduleDestroy(time.Now().Add(time.Duration(*secret.VersionDestroyTTL)))
 		}
-		return iVersion > jVersion
-	})
+	default:
+		destroyVersion(secret, version)
+	}
 
-	start := 0
-	if pageToken != "" {
-		startIdx, err := strconv.Atoi(pageToken)
-		if err == nil && startIdx >= 0 && startIdx < len(versions) {
-			start = startIdx
+	return version.Clone(), nil
+}
+
+// DestroyScheduledVersions destroys every version whose scheduled destruction
+// time is at or before now.
+func (m *MemoryStorage) DestroyScheduledVersions(_ context.Context, now time.Time) ([]DestroyedVersion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var destroyed []DestroyedVersion
+	for key, secret := range m.secrets {
+		if secret.IsExpired(now) {
+			continue
+		}
+		for _, version := range secret.Versions {
+			if version.IsDestroyDue(now) {
+				m.recordSecret(key)
+				destroyVersion(secret, version)
+				destroyed = append(destroyed, DestroyedVersion{Secret: secret.Clone(), Version: version.Clone()})
+			}
 		}
 	}
+	return destroyed, nil
+}
+
+// AccessSecretVersion retrieves a secret version together with its raw data,
+// resolving an alias or "latest" once so the two always belong together. Only
+// enabled versions can be accessed, and payloads encrypted with a
+// customer-managed key need that key version to be enabled too.
+func (m *MemoryStorage) AccessSecretVersion(_ context.Context, projectID, secretID, versionID string) (*models.SecretVersion, []byte, error) {
+	version, err := m.GetSecretVersion(context.TODO(), projectID, secretID, versionID)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	if pageSize <= 0 {
-		pageSize = 100
+	switch version.State {
+	case models.StateDisabled:
+		return nil, nil, ErrVersionDisabled
+	case models.StateDestroyed:
+		return nil, nil, ErrVersionDestroyed
 	}
 
-	end := start + pageSize
-	if end > len(versions) {
-		end = len(versions)
+	data := version.Data
+	if version.CustomerManagedEncryption != nil {
+		m.mu.RLock()
+		keys := m.keys
+		m.mu.RUnlock()
+		if data, err = keys.Decrypt(version.CustomerManagedEncryption.KmsKeyVersionName, version.Data); err != nil {
+			return nil, nil, err
+		}
 	}
+	version.Data = nil
+	return version, data, nil
+}
 
-	result := versions[start:end]
+// GetIamPolicy retrieves the IAM policy of a secret, or of the project when
+// secretID is empty. Resources without a policy report an empty one.
+func (m *MemoryStorage) GetIamPolicy(_ context.Context, projectID, secretID string) (*models.Policy, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	var nextPageToken string
-	if end < len(versions) {
-		nextPageToken = strconv.Itoa(end)
+	resource, err := m.policyResource(projectID, secretID)
+	if err != nil {
+		return nil, err
 	}
 
-	return result, nextPageToken, nil
+	if policy, exists := m.policies[resource]; exists {
+		return policy.Clone(), nil
+	}
+	return models.NewPolicy(), nil
 }
 
-// DeleteSecretVersion removes a specific version of a secret from memory.
-func (m *MemoryStorage) DeleteSecretVersion(_ context.Context, projectID, secretID, versionID string) error {
+// SetIamPolicy replaces the IAM policy of a secret, or of the project when
+// secretID is empty. A non-empty etag on policy must match the current policy.
+func (m *MemoryStorage) SetIamPolicy(_ context.Context, projectID, secretID string, policy *models.Policy) (*models.Policy, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	key := fmt.Sprintf("%s/%s", projectID, secretID)
-	secret, exists := m.secrets[key]
+	resource, err := m.policyResource(projectID, secretID)
+	if err != nil {
+		return nil, err
+	}
+
+	current, exists := m.policies[resource]
 	if !exists {
-		return ErrSecretNotFound
+		current = models.NewPolicy()
+	}
+	if policy.Etag != "" && policy.Etag != current.Etag {
+		return nil, ErrEtagMismatch
 	}
 
-	if _, exists := secret.Versions[versionID]; !exists {
-		return ErrVersionNotFound
+	m.recordPolicy(resource)
+	policy = policy.Clone()
+	policy.Refresh()
+	m.policies[resource] = policy
+	return policy.Clone(), nil
+}
+
+// policyResource returns the resource name policies are keyed by. Callers must
+// hold m.mu.
+func (m *MemoryStorage) policyResource(projectID, secretID string) (string, error) {
+	if secretID == "" {
+		return "projects/" + projectID, nil
 	}
 
-	delete(secret.Versions, versionID)
-	return nil
+	secret, exists := m.lookupSecret(projectID, secretID)
+	if !exists {
+		return "", ErrSecretNotFound
+	}
+	return secret.Name, nil
 }
 
-// AccessSecretVersion retrieves the raw data of a specific secret version.
-func (m *MemoryStorage) AccessSecretVersion(_ context.Context, projectID, secretID, versionID string) ([]byte, error) {
-	version, err := m.GetSecretVersion(context.TODO(), projectID, secretID, versionID)
-	if err != nil {
-		return nil, err
+// PurgeExpiredSecrets deletes every secret whose expiration time is at or before
+// now and returns the secrets it removed.
+func (m *MemoryStorage) PurgeExpiredSecrets(_ context.Context, now time.Time) ([]*models.Secret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var purged []*models.Secret
+	for key, secret := range m.secrets {
+		if secret.IsExpired(now) {
+			m.recordSecret(key)
+			delete(m.secrets, key)
+			delete(m.policies, secret.Name)
+			purged = append(purged, secret)
+		}
+	}
+	return purged, nil
+}
+
+// RotateSecrets advances the rotation schedule of every secret that is due to
+// rotate and returns the secrets that rotated.
+func (m *MemoryStorage) RotateSecrets(_ context.Context, now time.Time) ([]*models.Secret, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rotated []*models.Secret
+	for key, secret := range m.secrets {
+		if secret.IsExpired(now) || !secret.Rotation.IsDue(now) {
+			continue
+		}
+		m.recordSecret(key)
+
+		rotation := *secret.Rotation
+		rotation.Advance(now)
+		secret.Rotation = &rotation
+		secret.Refresh()
+		rotated = append(rotated, secret.Clone())
 	}
+	return rotated, nil
+}
 
-	return version.Data, nil
+// lookupSecret finds a secret by project and secret ID. Secrets past their
+// expiration time are reported as missing even before the reaper deletes them,
+// so lookups never depend on when it last ran. Callers must hold m.mu.
+func (m *MemoryStorage) lookupSecret(projectID, secretID string) (*models.Secret, bool) {
+	secret, exists := m.secrets[fmt.Sprintf("%s/%s", projectID, secretID)]
+	if !exists || secret.IsExpired(time.Now()) {
+		return nil, false
+	}
+	return secret, true
 }
 
 // Close releases any resources used by the memory storage (no-op for memory storage).
 func (m *MemoryStorage) Close() error {
 	return nil
 }
+
+// destroyVersion destroys version and removes the aliases of secret that point
+// at it, since aliases may only point at versions that still hold data.
+func destroyVersion(secret *models.Secret, version *models.SecretVersion) {
+	version.SetState(models.StateDestroyed)
+
+	number := versionNumber(version.Name)
+	for alias, target := range secret.VersionAliases {
+		if int(target) == number {
+			delete(secret.VersionAliases, alias)
+			secret.Refresh()
+		}
+	}
+}
+
+// cloneAll returns deep copies of secrets or versions, so that callers never
+// hold pointers into the storage's maps.
+func cloneAll[T interface{ Clone() T }](items []T) []T {
+	clones := make([]T, len(items))
+	for i, item := range items {
+		clones[i] = item.Clone()
+	}
+	return clones
+}
+
+// versionNumber returns the numeric ID at the end of a version resource name.
+func versionNumber(name string) int {
+	n, _ := strconv.Atoi(name[strings.LastIndex(name, "/")+1:])
+	return n
+}
+
+// lookupVersion finds a version of secret by ID, resolving the "latest" alias to
+// the most recently created version and any of the secret's version aliases to
+// the version they point at.
+func lookupVersion(secret *models.Secret, versionID string) (*models.SecretVersion, error) {
+	if versionID == "latest" {
+		if secret.VersionCount == 0 {
+			return nil, ErrVersionNotFound
+		}
+		versionID = strconv.Itoa(secret.VersionCount)
+	} else if target, ok := secret.VersionAliases[versionID]; ok {
+		if _, err := strconv.Atoi(versionID); err != nil {
+			versionID = strconv.FormatInt(int64(target), 10)
+		}
+	}
+
+	version, exists := secret.Versions[versionID]
+	if !exists {
+		return nil, ErrVersionNotFound
+	}
+
+	return version, nil
+}
+
+// validateVersionAliases checks that every alias points at an existing version
+// of secret that has not been destroyed.
+func validateVersionAliases(secret *models.Secret, aliases map[string]models.Int64) error {
+	for alias, target := range aliases {
+		version, exists := secret.Versions[strconv.FormatInt(int64(target), 10)]
+		if !exists || version.State == models.StateDestroyed {
+			return &VersionAliasError{Alias: alias, Version: int64(target)}
+		}
+	}
+	return nil
+}
+
+// validateRotation checks that a secret's rotation schedule can fire: it needs
+// a topic to notify, and a period only makes sense with a time to start from.
+func validateRotation(secret *models.Secret) error {
+	switch {
+	case secret.Rotation == nil:
+		return nil
+	case len(secret.Topics) == 0:
+		return ErrRotationWithoutTopics
+	case secret.Rotation.RotationPeriod != nil && secret.Rotation.NextRotationTime == nil:
+		return ErrRotationWithoutTime
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charlesgreen/gsm/internal/atomicfile"
+	"github.com/charlesgreen/gsm/internal/models"
+)
+
+// legacyVersion is the schema version of storage files that do not record one.
+const legacyVersion = "1.0.0"
+
+// migration upgrades the contents of a storage file to the next schema version.
+type migration struct {
+	to      string
+	upgrade func(data []byte) ([]byte, error)
+}
+
+// migrations are keyed by the schema version they upgrade from. Each one
+// upgrades a single step, so a file is brought up to date by applying them in
+// turn. Add one, with a golden fixture of the version it upgrades from,
+// whenever SchemaVersion changes, and freeze copies of the record types the
+// previous migration produces, as dataV1 freezes the types of 1.0.0. Journal
+// records carry the schema version as well and are refused in any other, so
+// a change to SchemaVersion must upgrade those too.
+var migrations = map[string]migration{
+	"1.0.0": {to: "2.0.0", upgrade: upgradeFrom1},
+}
+
+// SchemaVersionError is returned when loading a storage file, or a journal
+// record, with a schema version this emulator cannot read, such as one written
+// by a newer release.
+type SchemaVersionError struct {
+	Version string
+}
+
+func (e *SchemaVersionError) Error() string {
+	if newer, err := compareVersions(e.Version, SchemaVersion); err == nil && newer > 0 {
+		return fmt.Sprintf("storage file has schema version %s, which is newer than the %s this emulator supports; upgrade the emulator to load it", e.Version, SchemaVersion)
+	}
+	return fmt.Sprintf("storage file has unknown schema version %q", e.Version)
+}
+
+// migrate upgrades the contents of a storage file to SchemaVersion and returns
+// them with the version they started from. Current files are returned as they
+// are.
+func migrate(data []byte) ([]byte, string, error) {
+	var header struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, "", err
+	}
+	from := header.Version
+	if from == "" {
+		from = legacyVersion
+	}
+
+	version := from
+	for version != SchemaVersion {
+		step, ok := migrations[version]
+		if !ok {
+			return nil, "", &SchemaVersionError{Version: from}
+		}
+		upgraded, err := step.upgrade(data)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to upgrade schema version %s to %s: %w", version, step.to, err)
+		}
+		data, version = upgraded, step.to
+	}
+	return data, from, nil
+}
+
+// upgradeFile brings the storage file at path up to SchemaVersion. raw is the
+// file as read, and data its decrypted contents. A file that needs upgrading
+// is first copied to a backup named for its version, such as
+// storage.json.v1.0.0.bak, then replaced with the upgraded contents encrypted
+// under key. It returns the contents in the current schema.
+func upgradeFile(path string, raw, data []byte, key EncryptionKey) ([]byte, error) {
+	upgraded, from, err := migrate(data)
+	if err != nil || from == SchemaVersion {
+		return upgraded, err
+	}
+
+	if err := atomicfile.WriteFile(fmt.Sprintf("%s.v%s.bak", path, from), raw, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to back up storage file: %w", err)
+	}
+	sealed, err := sealData(key, upgraded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt storage data: %w", err)
+	}
+	if err := atomicfile.WriteFile(path, sealed, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write storage file: %w", err)
+	}
+	return upgraded, nil
+}
+
+// compareVersions compares two major.minor.patch versions, returning -1, 0 or
+// +1 as a is older than, the same as or newer than b.
+func compareVersions(a, b string) (int, error) {
+	parse := func(version string) ([3]int, error) {
+		var parts [3]int
+		fields := strings.Split(version, ".")
+		if len(fields) != len(parts) {
+			return parts, fmt.Errorf("invalid version %q", version)
+		}
+		for i, field := range fields {
+			n, err := strconv.Atoi(field)
+			if err != nil || n < 0 {
+				return parts, fmt.Errorf("invalid version %q", version)
+			}
+			parts[i] = n
+		}
+		return parts, nil
+	}
+
+	partsA, err := parse(a)
+	if err != nil {
+		return 0, err
+	}
+	partsB, err := parse(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := range partsA {
+		switch {
+		case partsA[i] < partsB[i]:
+			return -1, nil
+		case partsA[i] > partsB[i]:
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// dataV1 is schema version 1.0.0, which stored each secret as its API model
+// and lost every version. The types below are frozen copies of those models,
+// so later changes to the models cannot change how old files read.
+type dataV1 struct {
+	Secrets   map[string]*secretV1     `json:"secrets"`
+	Policies  map[string]*PolicyRecord `json:"policies,omitempty"`
+	Timestamp time.Time                `json:"timestamp"`
+}
+
+type secretV1 struct {
+	Name              string                  `json:"name"`
+	CreateTime        time.Time               `json:"createTime"`
+	Labels            map[string]string       `json:"labels,omitempty"`
+	Annotations       map[string]string       `json:"annotations,omitempty"`
+	Replication       replicationV1           `json:"replication"`
+	Topics            []*topicV1              `json:"topics,omitempty"`
+	Rotation          *rotationV1             `json:"rotation,omitempty"`
+	Etag              string                  `json:"etag"`
+	VersionAliases    map[string]models.Int64 `json:"versionAliases,omitempty"`
+	ExpireTime        *time.Time              `json:"expireTime,omitempty"`
+	VersionDestroyTTL *models.Duration        `json:"versionDestroyTtl,omitempty"`
+}
+
+type replicationV1 struct {
+	Automatic *struct {
+		CustomerManagedEncryption *encryptionV1 `json:"customerManagedEncryption,omitempty"`
+	} `json:"automatic,omitempty"`
+	UserManaged *struct {
+		Replicas []*struct {
+			Location                  string        `json:"location"`
+			CustomerManagedEncryption *encryptionV1 `json:"customerManagedEncryption,omitempty"`
+		} `json:"replicas"`
+	} `json:"userManaged,omitempty"`
+}
+
+type encryptionV1 struct {
+	KmsKeyName string `json:"kmsKeyName"`
+}
+
+type topicV1 struct {
+	Name string `json:"name"`
+}
+
+type rotationV1 struct {
+	NextRotationTime *time.Time       `json:"nextRotationTime,omitempty"`
+	RotationPeriod   *models.Duration `json:"rotationPeriod,omitempty"`
+}
+
+// upgradeFrom1 converts schema version 1.0.0 to 2.0.0. The secrets come back
+// without versions, which 1.0.0 never stored, so their aliases are dropped too
+// rather than left pointing at whatever versions are added next.
+func upgradeFrom1(data []byte) ([]byte, error) {
+	var old dataV1
+	if err := json.Unmarshal(data, &old); err != nil {
+		return nil, err
+	}
+
+	upgraded := Data{
+		Secrets:   make(map[string]*SecretRecord, len(old.Secrets)),
+		Policies:  old.Policies,
+		Timestamp: old.Timestamp,
+		Version:   "2.0.0",
+	}
+	for key, secret := range old.Secrets {
+		record := &SecretRecord{
+			Name:              secret.Name,
+			CreateTime:        secret.CreateTime,
+			Etag:              secret.Etag,
+			Labels:            secret.Labels,
+			Annotations:       secret.Annotations,
+			ExpireTime:        secret.ExpireTime,
+			VersionDestroyTTL: (*time.Duration)(secret.VersionDestroyTTL),
+		}
+		if automatic := secret.Replication.Automatic; automatic != nil {
+			record.Replication.Automatic = true
+			if automatic.CustomerManagedEncryption != nil {
+				record.Replication.KmsKeyName = automatic.CustomerManagedEncryption.KmsKeyName
+			}
+		}
+		if userManaged := secret.Replication.UserManaged; userManaged != nil {
+			for _, replica := range userManaged.Replicas {
+				replicaRecord := ReplicaRecord{Location: replica.Location}
+				if replica.CustomerManagedEncryption != nil {
+					replicaRecord.KmsKeyName = replica.CustomerManagedEncryption.KmsKeyName
+				}
+				record.Replication.Replicas = append(record.Replication.Replicas, replicaRecord)
+			}
+		}
+		for _, topic := range secret.Topics {
+			record.Topics = append(record.Topics, topic.Name)
+		}
+		if rotation := secret.Rotation; rotation != nil {
+			record.Rotation = &RotationRecord{
+				NextRotationTime: rotation.NextRotationTime,
+				RotationPeriod:   (*time.Duration)(rotation.RotationPeriod),
+			}
+		}
+		upgraded.Secrets[key] = record
+	}
+	return json.MarshalIndent(upgraded, "", "  ")
+}
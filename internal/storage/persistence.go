@@ -3,26 +3,32 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/charlesgreen/gsm/internal/atomicfile"
 	"github.com/charlesgreen/gsm/internal/models"
 )
 
 // PersistentStorage provides file-backed storage for secrets and versions.
+//
+// Every change is written to the file before the method returns, unless a
+// flush delay is set: changes are then coalesced and written by a background
+// flush at most that long after the first of them. Close flushes anything
+// still pending.
 type PersistentStorage struct {
 	*MemoryStorage
 	filePath string
-	mu       sync.RWMutex
-}
+	mu       sync.RWMutex // serialises changes and saves
+	key      EncryptionKey
 
-// Data represents the JSON structure for persisted storage data.
-type Data struct {
-	Secrets   map[string]*models.Secret `json:"secrets"`
-	Timestamp time.Time                 `json:"timestamp"`
-	Version   string                    `json:"version"`
+	flushMu    sync.Mutex // guards the fields below
+	flushDelay time.Duration
+	flushTimer *time.Timer
+	flushErr   error
 }
 
 // NewPersistentStorage creates a new persistent storage instance that saves data to the specified file.
@@ -33,97 +39,298 @@ func NewPersistentStorage(filePath string) (*PersistentStorage, error) {
 	}, nil
 }
 
+// SetEncryptionKey encrypts the storage file at rest under key. A file written
+// without a key still loads, and is encrypted the next time it is saved.
+func (p *PersistentStorage) SetEncryptionKey(key EncryptionKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.key = key
+}
+
+// SetFlushDelay batches changes into background flushes written at most delay
+// after the first unsaved change. A delay of zero, the default, saves every
+// change before returning.
+func (p *PersistentStorage) SetFlushDelay(delay time.Duration) {
+	p.flushMu.Lock()
+	defer p.flushMu.Unlock()
+	p.flushDelay = delay
+}
+
+// Flush writes any pending changes to the file now.
+func (p *PersistentStorage) Flush() error {
+	p.flushMu.Lock()
+	if p.flushTimer != nil {
+		p.flushTimer.Stop()
+		p.flushTimer = nil
+	}
+	p.flushMu.Unlock()
+
+	err := p.Save()
+	p.flushMu.Lock()
+	p.flushErr = err
+	p.flushMu.Unlock()
+	return err
+}
+
+// FlushError returns the error of the most recent flush, or nil if it
+// succeeded. Background flushes have no caller to report to, so this is how
+// their failures surface.
+func (p *PersistentStorage) FlushError() error {
+	p.flushMu.Lock()
+	defer p.flushMu.Unlock()
+	return p.flushErr
+}
+
+// changed records that the stored state changed. Without a flush delay it is
+// saved right away; otherwise a background flush is scheduled unless one is
+// already pending. Callers must hold p.mu.
+func (p *PersistentStorage) changed() error {
+	p.flushMu.Lock()
+	if p.flushDelay <= 0 {
+		p.flushMu.Unlock()
+		err := p.save()
+		p.flushMu.Lock()
+		p.flushErr = err
+		p.flushMu.Unlock()
+		return err
+	}
+	if p.flushTimer == nil {
+		p.flushTimer = time.AfterFunc(p.flushDelay, func() { _ = p.Flush() })
+	}
+	p.flushMu.Unlock()
+	return nil
+}
+
 // Load reads and restores secrets from the persistent storage file.
 func (p *PersistentStorage) Load() error {
 	if _, err := os.Stat(p.filePath); os.IsNotExist(err) {
 		return nil
 	}
 
-	data, err := os.ReadFile(p.filePath)
+	raw, err := os.ReadFile(p.filePath)
 	if err != nil {
 		return fmt.Errorf("failed to read storage file: %w", err)
 	}
 
-	var storageData Data
-	if err := json.Unmarshal(data, &storageData); err != nil {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	data, err := openData(p.key, raw)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt storage file: %w", err)
+	}
+	if data, err = upgradeFile(p.filePath, raw, data, p.key); err != nil {
+		return err
+	}
+
+	secrets, policies, err := decodeData(data)
+	if err != nil {
 		return fmt.Errorf("failed to parse storage file: %w", err)
 	}
 
-	p.MemoryStorage.mu.Lock()
-	p.secrets = storageData.Secrets
-	p.MemoryStorage.mu.Unlock()
+	p.restore(secrets, policies)
 	return nil
 }
 
-// Save writes the current state of secrets to the persistent storage file.
-func (p *PersistentStorage) Save() error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+// IsFatalLoadError reports whether err, returned by Load on a storage file
+// encrypted under key, must stop the caller rather than let it start with
+// empty storage. Saving over a file that could not be decrypted, or that a
+// newer release wrote, would destroy it.
+func IsFatalLoadError(err error, key EncryptionKey) bool {
+	var schemaErr *SchemaVersionError
+	return key != nil || errors.Is(err, ErrEncrypted) || errors.As(err, &schemaErr)
+}
+
+// decodeData restores secrets and policies from the contents of a storage
+// file in the current schema. Older files are upgraded by migrate first.
+func decodeData(data []byte) (map[string]*models.Secret, map[string]*models.Policy, error) {
+	var storageData Data
+	if err := json.Unmarshal(data, &storageData); err != nil {
+		return nil, nil, err
+	}
+	if storageData.Version != SchemaVersion {
+		return nil, nil, &SchemaVersionError{Version: storageData.Version}
+	}
+
+	secrets := make(map[string]*models.Secret)
+	policies := make(map[string]*models.Policy)
+	for key, record := range storageData.Secrets {
+		secrets[key] = record.secret()
+	}
+	for resource, record := range storageData.Policies {
+		policies[resource] = record.policy()
+	}
+	return secrets, policies, nil
+}
+
+// encodeData marshals the stored state in the storage file format. The state
+// is read under m.mu so that concurrent changes cannot race with marshalling.
+func (m *MemoryStorage) encodeData() ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
 	storageData := Data{
-		Secrets:   p.secrets,
+		Secrets:   make(map[string]*SecretRecord, len(m.secrets)),
+		Policies:  make(map[string]*PolicyRecord, len(m.policies)),
 		Timestamp: time.Now().UTC(),
-		Version:   "1.0.0",
+		Version:   SchemaVersion,
+	}
+	for key, secret := range m.secrets {
+		storageData.Secrets[key] = newSecretRecord(secret)
 	}
+	for resource, policy := range m.policies {
+		storageData.Policies[resource] = newPolicyRecord(policy)
+	}
+	return json.MarshalIndent(storageData, "", "  ")
+}
+
+// restore replaces the stored state with secrets and policies read from disk.
+func (m *MemoryStorage) restore(secrets map[string]*models.Secret, policies map[string]*models.Policy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.secrets = secrets
+	m.policies = policies
+}
+
+// Save writes the current state of secrets to the persistent storage file.
+// Saves are serialised by p.mu.
+func (p *PersistentStorage) Save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.save()
+}
 
-	data, err := json.MarshalIndent(storageData, "", "  ")
+// save writes the current state to the file. Callers must hold p.mu.
+func (p *PersistentStorage) save() error {
+	data, err := p.encodeData()
 	if err != nil {
 		return fmt.Errorf("failed to marshal storage data: %w", err)
 	}
+	if data, err = sealData(p.key, data); err != nil {
+		return fmt.Errorf("failed to encrypt storage data: %w", err)
+	}
 
-	if err := os.WriteFile(p.filePath, data, 0o600); err != nil {
+	if err := atomicfile.WriteFile(p.filePath, data, 0o600); err != nil {
 		return fmt.Errorf("failed to write storage file: %w", err)
 	}
 
 	return nil
 }
 
+// update applies change to the stored state and records it with changed. The
+// change and its save happen as one unit under p.mu, and a change that cannot
+// be saved is rolled back, so the file and memory never disagree.
+func (p *PersistentStorage) update(change func() error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.atomically(change, p.changed)
+}
+
 // CreateSecret creates a new secret and persists it to storage.
 func (p *PersistentStorage) CreateSecret(ctx context.Context, projectID, secretID string, secret *models.Secret) error {
-	if err := p.MemoryStorage.CreateSecret(ctx, projectID, secretID, secret); err != nil {
+	return p.update(func() error {
+		return p.MemoryStorage.CreateSecret(ctx, projectID, secretID, secret)
+	})
+}
+
+// UpdateSecret updates a secret's metadata and persists the change to storage.
+func (p *PersistentStorage) UpdateSecret(ctx context.Context, projectID, secretID string, secret *models.Secret, updateMask []string) (*models.Secret, error) {
+	var updated *models.Secret
+	if err := p.update(func() (err error) {
+		updated, err = p.MemoryStorage.UpdateSecret(ctx, projectID, secretID, secret, updateMask)
 		return err
+	}); err != nil {
+		return nil, err
 	}
-	return p.Save()
+	return updated, nil
 }
 
 // DeleteSecret removes a secret and persists the change to storage.
-func (p *PersistentStorage) DeleteSecret(ctx context.Context, projectID, secretID string) error {
-	if err := p.MemoryStorage.DeleteSecret(ctx, projectID, secretID); err != nil {
+func (p *PersistentStorage) DeleteSecret(ctx context.Context, projectID, secretID, etag string) error {
+	return p.update(func() error {
+		return p.MemoryStorage.DeleteSecret(ctx, projectID, secretID, etag)
+	})
+}
+
+// AddSecretVersion adds a new version to an existing secret and persists it to storage.
+func (p *PersistentStorage) AddSecretVersion(ctx context.Context, projectID, secretID string, payload *models.SecretPayload) (*models.SecretVersion, error) {
+	var version *models.SecretVersion
+	if err := p.update(func() (err error) {
+		version, err = p.MemoryStorage.AddSecretVersion(ctx, projectID, secretID, payload)
 		return err
+	}); err != nil {
+		return nil, err
 	}
-	return p.Save()
+	return version, nil
 }
 
-// AddSecretVersion adds a new version to an existing secret and persists it to storage.
-func (p *PersistentStorage) AddSecretVersion(ctx context.Context, projectID, secretID string, data []byte) (*models.SecretVersion, error) {
-	version, err := p.MemoryStorage.AddSecretVersion(ctx, projectID, secretID, data)
-	if err != nil {
+// SetSecretVersionState changes the state of a secret version and persists the change to storage.
+func (p *PersistentStorage) SetSecretVersionState(ctx context.Context, projectID, secretID, versionID string, state models.SecretVersionState, etag string) (*models.SecretVersion, error) {
+	var version *models.SecretVersion
+	if err := p.update(func() (err error) {
+		version, err = p.MemoryStorage.SetSecretVersionState(ctx, projectID, secretID, versionID, state, etag)
+		return err
+	}); err != nil {
 		return nil, err
 	}
+	return version, nil
+}
 
-	if err := p.Save(); err != nil {
-		p.MemoryStorage.mu.Lock()
-		key := fmt.Sprintf("%s/%s", projectID, secretID)
-		if secret, exists := p.secrets[key]; exists {
-			delete(secret.Versions, version.GetVersionID())
-			secret.VersionCount--
-		}
-		p.MemoryStorage.mu.Unlock()
+// SetIamPolicy replaces an IAM policy and persists the change to storage.
+func (p *PersistentStorage) SetIamPolicy(ctx context.Context, projectID, secretID string, policy *models.Policy) (*models.Policy, error) {
+	var updated *models.Policy
+	if err := p.update(func() (err error) {
+		updated, err = p.MemoryStorage.SetIamPolicy(ctx, projectID, secretID, policy)
+		return err
+	}); err != nil {
 		return nil, err
 	}
+	return updated, nil
+}
 
-	return version, nil
+// PurgeExpiredSecrets deletes expired secrets and persists the change to disk
+// when any were removed. Secrets whose removal cannot be saved stay in place
+// and are purged again on the next call.
+func (p *PersistentStorage) PurgeExpiredSecrets(ctx context.Context, now time.Time) ([]*models.Secret, error) {
+	var purged []*models.Secret
+	if err := p.update(func() (err error) {
+		purged, err = p.MemoryStorage.PurgeExpiredSecrets(ctx, now)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return purged, nil
+}
+
+// RotateSecrets advances due rotation schedules and persists the change to disk
+// when any secret rotated. Rotations that cannot be saved are undone and
+// happen again on the next call.
+func (p *PersistentStorage) RotateSecrets(ctx context.Context, now time.Time) ([]*models.Secret, error) {
+	var rotated []*models.Secret
+	if err := p.update(func() (err error) {
+		rotated, err = p.MemoryStorage.RotateSecrets(ctx, now)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return rotated, nil
 }
 
-// DeleteSecretVersion removes a secret version and persists the change to storage.
-func (p *PersistentStorage) DeleteSecretVersion(ctx context.Context, projectID, secretID, versionID string) error {
-	if err := p.MemoryStorage.DeleteSecretVersion(ctx, projectID, secretID, versionID); err != nil {
+// DestroyScheduledVersions destroys versions whose scheduled destruction is due
+// and persists the change to disk when any version was destroyed. Destructions
+// that cannot be saved are undone and happen again on the next call.
+func (p *PersistentStorage) DestroyScheduledVersions(ctx context.Context, now time.Time) ([]DestroyedVersion, error) {
+	var destroyed []DestroyedVersion
+	if err := p.update(func() (err error) {
+		destroyed, err = p.MemoryStorage.DestroyScheduledVersions(ctx, now)
 		return err
+	}); err != nil {
+		return nil, err
 	}
-	return p.Save()
+	return destroyed, nil
 }
 
-// Close saves the current state to disk and releases resources.
+// Close writes any pending changes to disk and releases resources.
 func (p *PersistentStorage) Close() error {
-	return p.Save()
+	return p.Flush()
 }
@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/charlesgreen/gsm/internal/models"
+)
+
+// SchemaVersion is the version of the storage file format written by Save.
+const SchemaVersion = "2.0.0"
+
+// Data is the on-disk format of the storage file. It is kept separate from the
+// API models so that state clients never see, such as version payloads and
+// counters, survives a restart, and so that API changes do not alter the file.
+type Data struct {
+	Secrets   map[string]*SecretRecord `json:"secrets"`
+	Policies  map[string]*PolicyRecord `json:"policies,omitempty"`
+	Timestamp time.Time                `json:"timestamp"`
+	Version   string                   `json:"version"`
+}
+
+// SecretRecord is a secret and all of its versions as stored on disk.
+type SecretRecord struct {
+	Name              string                    `json:"name"`
+	CreateTime        time.Time                 `json:"createTime"`
+	Etag              string                    `json:"etag"`
+	Labels            map[string]string         `json:"labels,omitempty"`
+	Annotations       map[string]string         `json:"annotations,omitempty"`
+	Replication       ReplicationRecord         `json:"replication,omitzero"`
+	Topics            []string                  `json:"topics,omitempty"`
+	Rotation          *RotationRecord           `json:"rotation,omitempty"`
+	VersionAliases    map[string]int64          `json:"versionAliases,omitempty"`
+	ExpireTime        *time.Time                `json:"expireTime,omitempty"`
+	VersionDestroyTTL *time.Duration            `json:"versionDestroyTtl,omitempty"`
+	VersionCount      int                       `json:"versionCount"`
+	Versions          map[string]*VersionRecord `json:"versions,omitempty"`
+}
+
+// ReplicationRecord is a secret's replication policy. Regional secrets have
+// neither automatic replication nor replicas.
+type ReplicationRecord struct {
+	Automatic  bool            `json:"automatic,omitempty"`
+	KmsKeyName string          `json:"kmsKeyName,omitempty"`
+	Replicas   []ReplicaRecord `json:"replicas,omitempty"`
+}
+
+// ReplicaRecord is one location of a user-managed replication policy.
+type ReplicaRecord struct {
+	Location   string `json:"location"`
+	KmsKeyName string `json:"kmsKeyName,omitempty"`
+}
+
+// RotationRecord is a secret's rotation schedule.
+type RotationRecord struct {
+	NextRotationTime *time.Time     `json:"nextRotationTime,omitempty"`
+	RotationPeriod   *time.Duration `json:"rotationPeriod,omitempty"`
+}
+
+// VersionRecord is a secret version as stored on disk. Data holds the payload,
+// or its ciphertext when the secret uses a customer-managed key.
+type VersionRecord struct {
+	Name                           string     `json:"name"`
+	CreateTime                     time.Time  `json:"createTime"`
+	DestroyTime                    *time.Time `json:"destroyTime,omitempty"`
+	ScheduledDestroyTime           *time.Time `json:"scheduledDestroyTime,omitempty"`
+	State                          string     `json:"state"`
+	Etag                           string     `json:"etag"`
+	Data                           []byte     `json:"data,omitempty"`
+	Crc32c                         string     `json:"crc32c,omitempty"`
+	Sha256                         string     `json:"sha256,omitempty"`
+	KmsKeyVersionName              string     `json:"kmsKeyVersionName,omitempty"`
+	ClientSpecifiedPayloadChecksum bool       `json:"clientSpecifiedPayloadChecksum,omitempty"`
+}
+
+// PolicyRecord is an IAM policy as stored on disk.
+type PolicyRecord struct {
+	Version  int             `json:"version,omitempty"`
+	Bindings []BindingRecord `json:"bindings,omitempty"`
+	Etag     string          `json:"etag,omitempty"`
+}
+
+// BindingRecord grants a role to members.
+type BindingRecord struct {
+	Role    string   `json:"role"`
+	Members []string `json:"members,omitempty"`
+}
+
+// newSecretRecord converts a stored secret into its on-disk record.
+func newSecretRecord(secret *models.Secret) *SecretRecord {
+	record := newSecretMetadataRecord(secret)
+	record.Versions = make(map[string]*VersionRecord, len(secret.Versions))
+	for id, version := range secret.Versions {
+		record.Versions[id] = newVersionRecord(version)
+	}
+	return record
+}
+
+// newSecretMetadataRecord converts a stored secret into an on-disk record
+// without its versions.
+func newSecretMetadataRecord(secret *models.Secret) *SecretRecord {
+	record := &SecretRecord{
+		Name:              secret.Name,
+		CreateTime:        secret.CreateTime,
+		Etag:              secret.Etag,
+		Labels:            secret.Labels,
+		Annotations:       secret.Annotations,
+		ExpireTime:        secret.ExpireTime,
+		VersionDestroyTTL: (*time.Duration)(secret.VersionDestroyTTL),
+		VersionCount:      secret.VersionCount,
+	}
+
+	if automatic := secret.Replication.Automatic; automatic != nil {
+		record.Replication.Automatic = true
+		if automatic.CustomerManagedEncryption != nil {
+			record.Replication.KmsKeyName = automatic.CustomerManagedEncryption.KmsKeyName
+		}
+	}
+	if userManaged := secret.Replication.UserManaged; userManaged != nil {
+		for _, replica := range userManaged.Replicas {
+			replicaRecord := ReplicaRecord{Location: replica.Location}
+			if replica.CustomerManagedEncryption != nil {
+				replicaRecord.KmsKeyName = replica.CustomerManagedEncryption.KmsKeyName
+			}
+			record.Replication.Replicas = append(record.Replication.Replicas, replicaRecord)
+		}
+	}
+
+	for _, topic := range secret.Topics {
+		record.Topics = append(record.Topics, topic.Name)
+	}
+	if rotation := secret.Rotation; rotation != nil {
+		record.Rotation = &RotationRecord{
+			NextRotationTime: rotation.NextRotationTime,
+			RotationPeriod:   (*time.Duration)(rotation.RotationPeriod),
+		}
+	}
+	if secret.VersionAliases != nil {
+		record.VersionAliases = make(map[string]int64, len(secret.VersionAliases))
+		for alias, version := range secret.VersionAliases {
+			record.VersionAliases[alias] = int64(version)
+		}
+	}
+	return record
+}
+
+// secret converts the record back into a secret with all of its versions.
+func (r *SecretRecord) secret() *models.Secret {
+	secret := &models.Secret{
+		Name:              r.Name,
+		CreateTime:        r.CreateTime,
+		Etag:              r.Etag,
+		Labels:            r.Labels,
+		Annotations:       r.Annotations,
+		ExpireTime:        r.ExpireTime,
+		VersionDestroyTTL: (*models.Duration)(r.VersionDestroyTTL),
+		VersionCount:      r.VersionCount,
+		Versions:          make(map[string]*models.SecretVersion, len(r.Versions)),
+	}
+
+	if r.Replication.Automatic {
+		secret.Replication.Automatic = &models.AutomaticReplication{}
+		if r.Replication.KmsKeyName != "" {
+			secret.Replication.Automatic.CustomerManagedEncryption = &models.CustomerManagedEncryption{KmsKeyName: r.Replication.KmsKeyName}
+		}
+	}
+	if len(r.Replication.Replicas) > 0 {
+		secret.Replication.UserManaged = &models.UserManagedReplication{}
+		for _, replicaRecord := range r.Replication.Replicas {
+			replica := &models.Replica{Location: replicaRecord.Location}
+			if replicaRecord.KmsKeyName != "" {
+				replica.CustomerManagedEncryption = &models.CustomerManagedEncryption{KmsKeyName: replicaRecord.KmsKeyName}
+			}
+			secret.Replication.UserManaged.Replicas = append(secret.Replication.UserManaged.Replicas, replica)
+		}
+	}
+
+	for _, topic := range r.Topics {
+		secret.Topics = append(secret.Topics, &models.Topic{Name: topic})
+	}
+	if rotation := r.Rotation; rotation != nil {
+		secret.Rotation = &models.Rotation{
+			NextRotationTime: rotation.NextRotationTime,
+			RotationPeriod:   (*models.Duration)(rotation.RotationPeriod),
+		}
+	}
+	if r.VersionAliases != nil {
+		secret.VersionAliases = make(map[string]models.Int64, len(r.VersionAliases))
+		for alias, version := range r.VersionAliases {
+			secret.VersionAliases[alias] = models.Int64(version)
+		}
+	}
+
+	for id, record := range r.Versions {
+		secret.Versions[id] = record.version()
+	}
+	return secret
+}
+
+// newVersionRecord converts a stored version into its on-disk record.
+func newVersionRecord(version *models.SecretVersion) *VersionRecord {
+	record := &VersionRecord{
+		Name:                           version.Name,
+		CreateTime:                     version.CreateTime,
+		DestroyTime:                    version.DestroyTime,
+		ScheduledDestroyTime:           version.ScheduledDestroyTime,
+		State:                          string(version.State),
+		Etag:                           version.Etag,
+		Data:                           version.Data,
+		ClientSpecifiedPayloadChecksum: version.ClientSpecifiedPayloadChecksum,
+	}
+	if checksum := version.Checksum; checksum != nil {
+		record.Crc32c, record.Sha256 = checksum.Crc32c, checksum.Sha256
+	}
+	if encryption := version.CustomerManagedEncryption; encryption != nil {
+		record.KmsKeyVersionName = encryption.KmsKeyVersionName
+	}
+	return record
+}
+
+// version converts the record back into a secret version.
+func (r *VersionRecord) version() *models.SecretVersion {
+	version := &models.SecretVersion{
+		Name:                           r.Name,
+		CreateTime:                     r.CreateTime,
+		DestroyTime:                    r.DestroyTime,
+		ScheduledDestroyTime:           r.ScheduledDestroyTime,
+		State:                          models.SecretVersionState(r.State),
+		Etag:                           r.Etag,
+		Data:                           r.Data,
+		ClientSpecifiedPayloadChecksum: r.ClientSpecifiedPayloadChecksum,
+	}
+	if r.Crc32c != "" || r.Sha256 != "" {
+		version.Checksum = &models.SecretVersionChecksum{Crc32c: r.Crc32c, Sha256: r.Sha256}
+	}
+	if r.KmsKeyVersionName != "" {
+		version.CustomerManagedEncryption = &models.CustomerManagedEncryptionStatus{KmsKeyVersionName: r.KmsKeyVersionName}
+	}
+	return version
+}
+
+// newPolicyRecord converts a stored IAM policy into its on-disk record.
+func newPolicyRecord(policy *models.Policy) *PolicyRecord {
+	record := &PolicyRecord{Version: policy.Version, Etag: policy.Etag}
+	for _, binding := range policy.Bindings {
+		record.Bindings = append(record.Bindings, BindingRecord{Role: binding.Role, Members: binding.Members})
+	}
+	return record
+}
+
+// policy converts the record back into an IAM policy.
+func (r *PolicyRecord) policy() *models.Policy {
+	policy := &models.Policy{Version: r.Version, Etag: r.Etag}
+	for _, binding := range r.Bindings {
+		policy.Bindings = append(policy.Bindings, &models.Binding{Role: binding.Role, Members: binding.Members})
+	}
+	return policy
+}
@@ -0,0 +1,85 @@
+package storage
+
+import "github.com/charlesgreen/gsm/internal/models"
+
+// undoLog holds the state that secrets and policies had before a change, so
+// that the change can be rolled back when its backend fails to persist it. A
+// nil entry means the secret or policy did not exist.
+type undoLog struct {
+	secrets  map[string]*models.Secret
+	policies map[string]*models.Policy
+}
+
+// atomically applies change and then persist, and rolls change back if either
+// fails, so the stored state only ever holds changes that were persisted.
+// persist is skipped when change left the state as it was, such as a scheduler
+// tick with nothing due. Callers must serialise calls to atomically with every
+// other change to the storage.
+func (m *MemoryStorage) atomically(change, persist func() error) error {
+	m.mu.Lock()
+	m.undo = &undoLog{
+		secrets:  make(map[string]*models.Secret),
+		policies: make(map[string]*models.Policy),
+	}
+	m.mu.Unlock()
+
+	err := change()
+
+	m.mu.Lock()
+	undo := m.undo
+	m.undo = nil
+	m.mu.Unlock()
+
+	if err == nil {
+		if len(undo.secrets) == 0 && len(undo.policies) == 0 {
+			return nil
+		}
+		if err = persist(); err == nil {
+			return nil
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, secret := range undo.secrets {
+		if secret == nil {
+			delete(m.secrets, key)
+		} else {
+			m.secrets[key] = secret
+		}
+	}
+	for resource, policy := range undo.policies {
+		if policy == nil {
+			delete(m.policies, resource)
+		} else {
+			m.policies[resource] = policy
+		}
+	}
+	return err
+}
+
+// recordSecret saves the state of the secret stored under key, and of its
+// policy, before a change to them. Only the first state recorded for a change
+// is kept. Callers must hold m.mu.
+func (m *MemoryStorage) recordSecret(key string) {
+	if m.undo == nil {
+		return
+	}
+	if _, recorded := m.undo.secrets[key]; !recorded {
+		m.undo.secrets[key] = m.secrets[key].Clone()
+	}
+	if secret, exists := m.secrets[key]; exists {
+		m.recordPolicy(secret.Name)
+	}
+}
+
+// recordPolicy saves the state of the policy of resource before a change to
+// it. Callers must hold m.mu.
+func (m *MemoryStorage) recordPolicy(resource string) {
+	if m.undo == nil {
+		return
+	}
+	if _, recorded := m.undo.policies[resource]; !recorded {
+		m.undo.policies[resource] = m.policies[resource].Clone()
+	}
+}
@@ -0,0 +1,323 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charlesgreen/gsm/internal/jsonname"
+	"github.com/charlesgreen/gsm/internal/locations"
+	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/storage"
+)
+
+// updatableSecretFields are the update mask paths UpdateSecret applies.
+var updatableSecretFields = map[string]struct{}{
+	"labels":                    {},
+	"annotations":               {},
+	"versionAliases":            {},
+	"expireTime":                {},
+	"ttl":                       {},
+	"topics":                    {},
+	"rotation":                  {},
+	"rotation.nextRotationTime": {},
+	"rotation.rotationPeriod":   {},
+	"versionDestroyTtl":         {},
+}
+
+// immutableSecretFields are fields of a secret that are fixed once it is created.
+var immutableSecretFields = map[string]struct{}{
+	"name":        {},
+	"createTime":  {},
+	"replication": {},
+	"etag":        {},
+}
+
+// UpdateMask converts the paths of an update mask to camelCase, rejecting an
+// empty mask and any path that cannot be updated.
+func UpdateMask(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("updateMask is required")
+	}
+
+	mask := make([]string, 0, len(paths))
+	for _, path := range paths {
+		path = jsonname.FromProto(strings.TrimSpace(path))
+		if _, ok := immutableSecretFields[path]; ok {
+			return nil, fmt.Errorf("field %q is immutable and cannot be updated", path)
+		}
+		if _, ok := updatableSecretFields[path]; !ok {
+			return nil, fmt.Errorf("unknown field %q in updateMask", path)
+		}
+		mask = append(mask, path)
+	}
+	return mask, nil
+}
+
+// Secret checks a request to create the secret secretID in projectID and
+// returns the secret it creates, or the violations that reject it. Regional
+// secrets and user-managed replicas must use a location from catalog.
+func Secret(projectID, secretID string, data *models.CreateSecretData, catalog *locations.Catalog, now time.Time) (*models.Secret, []models.FieldViolation) {
+	if secretID == "" {
+		return nil, []models.FieldViolation{{Field: "secret_id", Description: "secretId is required"}}
+	}
+	if violations := slices.Concat(
+		SecretID(secretID),
+		Labels("secret.labels", data.Labels),
+		Replication("secret.replication", data.Replication),
+	); len(violations) > 0 {
+		return nil, violations
+	}
+
+	secret := models.NewSecret(projectID, secretID, data.Labels)
+	if violations := secretLocations(secret, data.Replication, catalog); len(violations) > 0 {
+		return nil, violations
+	}
+	if data.Replication != nil && !data.Replication.IsEmpty() {
+		secret.Replication = *data.Replication
+	}
+	secret.VersionAliases = data.VersionAliases
+	secret.Annotations = data.Annotations
+	secret.ExpireTime, secret.TTL = data.ExpireTime, data.TTL
+	secret.Topics, secret.Rotation = data.Topics, data.Rotation
+	secret.VersionDestroyTTL = data.VersionDestroyTTL
+
+	if violations := slices.Concat(
+		versionAliasNames(secret.VersionAliases),
+		annotations(secret.Annotations),
+		expiration(secret, now),
+		rotation(secret.Topics, secret.Rotation, now),
+		versionDestroyTTL(secret.VersionDestroyTTL),
+	); len(violations) > 0 {
+		return nil, violations
+	}
+	secret.ResolveExpiration(now)
+	return secret, nil
+}
+
+// SecretUpdate checks the fields of secret that the update mask selects,
+// returning the violations that reject the update. Fields outside the mask are
+// left as they are by the update, so a secret read back with, say, a rotation
+// that is already due can still be sent with a mask of other fields. A ttl in
+// the mask is resolved into an expireTime.
+func SecretUpdate(mask []string, secret *models.Secret, now time.Time) []models.FieldViolation {
+	masked := func(paths ...string) bool {
+		return slices.ContainsFunc(paths, func(path string) bool { return slices.Contains(mask, path) })
+	}
+
+	var violations []models.FieldViolation
+	if masked("labels") {
+		violations = append(violations, Labels("secret.labels", secret.Labels)...)
+	}
+	if masked("versionAliases") {
+		violations = append(violations, versionAliasNames(secret.VersionAliases)...)
+	}
+	if masked("annotations") {
+		violations = append(violations, annotations(secret.Annotations)...)
+	}
+	if masked("expireTime", "ttl") {
+		violations = append(violations, expiration(secret, now)...)
+	}
+	if masked("topics", "rotation", "rotation.nextRotationTime", "rotation.rotationPeriod") {
+		var topics []*models.Topic
+		if masked("topics") {
+			topics = secret.Topics
+		}
+		var maskedRotation *models.Rotation
+		if secret.Rotation != nil {
+			maskedRotation = new(models.Rotation)
+			if masked("rotation", "rotation.nextRotationTime") {
+				maskedRotation.NextRotationTime = secret.Rotation.NextRotationTime
+			}
+			if masked("rotation", "rotation.rotationPeriod") {
+				maskedRotation.RotationPeriod = secret.Rotation.RotationPeriod
+			}
+		}
+		violations = append(violations, rotation(topics, maskedRotation, now)...)
+	}
+	if masked("versionDestroyTtl") {
+		violations = append(violations, versionDestroyTTL(secret.VersionDestroyTTL)...)
+	}
+	if len(violations) > 0 {
+		return violations
+	}
+
+	if masked("expireTime", "ttl") {
+		secret.ResolveExpiration(now)
+	}
+	return nil
+}
+
+// secretLocations checks that a regional secret, or each replica of a secret,
+// uses a location from catalog, and that regional secrets are not replicated.
+func secretLocations(secret *models.Secret, replication *models.Replication, catalog *locations.Catalog) []models.FieldViolation {
+	if secret.IsRegional() && !catalog.Has(secret.GetLocation()) {
+		return []models.FieldViolation{{Field: "parent", Description: models.FormatUnsupportedLocationError(secret.GetLocation())}}
+	}
+	if replication == nil || replication.IsEmpty() {
+		return nil
+	}
+	if secret.IsRegional() {
+		return []models.FieldViolation{{Field: "secret.replication", Description: "Replication policy is not supported for regional secrets."}}
+	}
+	if replication.UserManaged != nil {
+		for i, replica := range replication.UserManaged.Replicas {
+			if !catalog.Has(replica.Location) {
+				return []models.FieldViolation{{
+					Field:       fmt.Sprintf("secret.replication.user_managed.replicas[%d].location", i),
+					Description: models.FormatUnsupportedLocationError(replica.Location),
+				}}
+			}
+		}
+	}
+	return nil
+}
+
+// versionAliasPattern matches the alias names Secret Manager accepts: lowercase
+// letters, digits, underscores and hyphens.
+var versionAliasPattern = regexp.MustCompile(`^[\p{Ll}\p{Lo}\p{N}_-]{1,63}$`)
+
+// versionAliasNames rejects alias names that are malformed or that would
+// shadow the reserved "latest" alias or a version ID.
+func versionAliasNames(aliases map[string]models.Int64) []models.FieldViolation {
+	for alias, version := range aliases {
+		violation := func(format string) []models.FieldViolation {
+			return []models.FieldViolation{{
+				Field:       fmt.Sprintf("secret.version_aliases[%s]", alias),
+				Description: fmt.Sprintf(format, alias),
+			}}
+		}
+		if alias == "latest" {
+			return violation("version alias %q is reserved")
+		}
+		if !versionAliasPattern.MatchString(alias) {
+			return violation("version alias %q must be 1-63 lowercase letters, digits, underscores or hyphens")
+		}
+		if _, err := strconv.Atoi(alias); err == nil {
+			return violation("version alias %q must not be a number, which would read as a version ID")
+		}
+		if version < 1 {
+			return violation("version alias %q must refer to a version greater than 0")
+		}
+	}
+	return nil
+}
+
+// maxAnnotationsSize is the largest total size, in bytes, of a secret's
+// annotation keys and values.
+const maxAnnotationsSize = 16 * 1024
+
+// annotationKeyPattern matches annotation keys: 1-63 characters that begin and
+// end with an alphanumeric and may contain dashes, underscores and dots between.
+var annotationKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9._-]{0,61}[a-zA-Z0-9])?$`)
+
+// annotations applies production's annotation limits.
+func annotations(annotations map[string]string) []models.FieldViolation {
+	size := 0
+	for key, value := range annotations {
+		if !annotationKeyPattern.MatchString(key) {
+			return []models.FieldViolation{{
+				Field:       fmt.Sprintf("secret.annotations[%s]", key),
+				Description: fmt.Sprintf("Annotation key [%s] is invalid. Keys must be 1-63 characters long, begin and end with an alphanumeric character, and contain only alphanumerics, dashes, underscores and dots.", key),
+			}}
+		}
+		size += len(key) + len(value)
+	}
+	if size > maxAnnotationsSize {
+		return []models.FieldViolation{{
+			Field:       "secret.annotations",
+			Description: fmt.Sprintf("The total size of annotations is %d bytes, which exceeds the limit of %d bytes.", size, maxAnnotationsSize),
+		}}
+	}
+	return nil
+}
+
+// expiration checks the mutually exclusive expireTime and ttl fields.
+func expiration(secret *models.Secret, now time.Time) []models.FieldViolation {
+	switch {
+	case secret.ExpireTime != nil && secret.TTL != nil:
+		return []models.FieldViolation{{Field: "secret.expiration", Description: "Only one of expireTime and ttl may be set."}}
+	case secret.TTL != nil && *secret.TTL <= 0:
+		return []models.FieldViolation{{Field: "secret.ttl", Description: "The ttl must be a positive duration."}}
+	case secret.ExpireTime != nil && !secret.ExpireTime.After(now):
+		return []models.FieldViolation{{Field: "secret.expire_time", Description: "The expireTime must be in the future."}}
+	}
+	return nil
+}
+
+// minVersionDestroyTTL is the shortest delay production accepts for version
+// destruction.
+const minVersionDestroyTTL = 24 * time.Hour
+
+// versionDestroyTTL checks the delay before disabled versions are destroyed.
+func versionDestroyTTL(ttl *models.Duration) []models.FieldViolation {
+	if ttl != nil && time.Duration(*ttl) < minVersionDestroyTTL {
+		return []models.FieldViolation{{Field: "secret.version_destroy_ttl", Description: "The versionDestroyTtl must be at least 1 day."}}
+	}
+	return nil
+}
+
+// Rotation periods production accepts, from one hour to 100 years.
+const (
+	minRotationPeriod = time.Hour
+	maxRotationPeriod = 100 * 365 * 24 * time.Hour
+)
+
+// minRotationLeadTime is how far in the future a next rotation time must be.
+const minRotationLeadTime = 5 * time.Minute
+
+// topicNamePattern matches Pub/Sub topic resource names.
+var topicNamePattern = regexp.MustCompile(`^projects/[^/]+/topics/[^/]+$`)
+
+// rotation checks topic names and rotation fields. Whether the resulting
+// secret has the topics and times a rotation needs is checked by storage once
+// the change has been applied, and reported by InvariantMessage.
+func rotation(topics []*models.Topic, rotation *models.Rotation, now time.Time) []models.FieldViolation {
+	for i, topic := range topics {
+		if topic == nil || !topicNamePattern.MatchString(topic.Name) {
+			return []models.FieldViolation{{
+				Field:       fmt.Sprintf("secret.topics[%d].name", i),
+				Description: "Topic names must be in the format projects/*/topics/*.",
+			}}
+		}
+	}
+	if rotation == nil {
+		return nil
+	}
+
+	if period := rotation.RotationPeriod; period != nil {
+		if time.Duration(*period) < minRotationPeriod || time.Duration(*period) > maxRotationPeriod {
+			return []models.FieldViolation{{
+				Field:       "secret.rotation.rotation_period",
+				Description: "The rotation.rotationPeriod must be between 1 hour and 100 years.",
+			}}
+		}
+	}
+	if next := rotation.NextRotationTime; next != nil && next.Before(now.Add(minRotationLeadTime)) {
+		return []models.FieldViolation{{
+			Field:       "secret.rotation.next_rotation_time",
+			Description: "The rotation.nextRotationTime must be at least 5 minutes in the future.",
+		}}
+	}
+	return nil
+}
+
+// InvariantMessage formats the storage errors raised when a secret would be
+// left inconsistent, such as an alias to a missing version or a rotation
+// without topics, reporting whether err was one.
+func InvariantMessage(err error) (string, bool) {
+	var aliasErr *storage.VersionAliasError
+	switch {
+	case errors.As(err, &aliasErr):
+		return fmt.Sprintf("Version alias [%s] refers to version [%d], which does not exist or is destroyed.", aliasErr.Alias, aliasErr.Version), true
+	case err == storage.ErrRotationWithoutTopics:
+		return "A secret with a rotation schedule must have at least one topic.", true
+	case err == storage.ErrRotationWithoutTime:
+		return "The rotation.nextRotationTime must be set when rotation.rotationPeriod is set.", true
+	}
+	return "", false
+}
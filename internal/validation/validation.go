@@ -0,0 +1,154 @@
+// Package validation applies production's limits on secret IDs, labels,
+// replication policies and payloads, and on the other fields of secret
+// requests. The checks return the violations they find as
+// google.rpc.BadRequest field violations, keyed by the proto field path, with
+// the message production reports.
+//
+// Both the REST and gRPC APIs validate requests with Secret, SecretUpdate and
+// Payload, so they accept and reject the same requests.
+package validation
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/charlesgreen/gsm/internal/models"
+)
+
+// Production's limits on secret resources.
+const (
+	// MaxLabels is the largest number of labels a secret may have.
+	MaxLabels = 64
+	// MaxPayloadSize is the largest payload, in bytes, a version may hold.
+	MaxPayloadSize = 64 * 1024
+	// maxLabelBytes is the longest UTF-8 encoding of a label key or value.
+	maxLabelBytes = 128
+)
+
+var (
+	secretIDPattern   = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,255}$`)
+	labelKeyPattern   = regexp.MustCompile(`^[\p{Ll}\p{Lo}][\p{Ll}\p{Lo}\p{N}_-]{0,62}$`)
+	labelValuePattern = regexp.MustCompile(`^[\p{Ll}\p{Lo}\p{N}_-]{0,63}$`)
+	kmsKeyNamePattern = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+)
+
+// SecretID checks a secret ID against production's format.
+func SecretID(id string) []models.FieldViolation {
+	if secretIDPattern.MatchString(id) {
+		return nil
+	}
+	return []models.FieldViolation{{
+		Field:       "secret_id",
+		Description: fmt.Sprintf("The secret ID [%s] must be 1-255 characters long and contain only letters, digits, underscores and hyphens.", id),
+	}}
+}
+
+// Labels checks the number of labels and the format of each key and value.
+// Violations are reported in key order so responses are stable.
+func Labels(field string, labels map[string]string) []models.FieldViolation {
+	var violations []models.FieldViolation
+	if len(labels) > MaxLabels {
+		violations = append(violations, models.FieldViolation{
+			Field:       field,
+			Description: fmt.Sprintf("A secret may have at most %d labels, got %d.", MaxLabels, len(labels)),
+		})
+	}
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := labels[key]
+		switch {
+		case !labelKeyPattern.MatchString(key) || len(key) > maxLabelBytes || !utf8.ValidString(key):
+			violations = append(violations, models.FieldViolation{
+				Field:       fmt.Sprintf("%s[%s]", field, key),
+				Description: fmt.Sprintf("Label key [%s] is invalid. Keys must be 1-63 characters long, start with a lowercase letter, and contain only lowercase letters, digits, underscores and hyphens.", key),
+			})
+		case !labelValuePattern.MatchString(value) || len(value) > maxLabelBytes || !utf8.ValidString(value):
+			violations = append(violations, models.FieldViolation{
+				Field:       fmt.Sprintf("%s[%s]", field, key),
+				Description: fmt.Sprintf("Label value [%s] is invalid. Values must be at most 63 characters long and contain only lowercase letters, digits, underscores and hyphens.", value),
+			})
+		}
+	}
+	return violations
+}
+
+// Replication checks that a replication policy picks exactly one of automatic
+// and user-managed replication, that user-managed replication lists each
+// location once, and that customer-managed keys are crypto key names. Whether
+// a location is offered is left to the locations catalog.
+func Replication(field string, replication *models.Replication) []models.FieldViolation {
+	if replication == nil || replication.IsEmpty() {
+		return nil
+	}
+	if replication.Automatic != nil && replication.UserManaged != nil {
+		return []models.FieldViolation{{
+			Field:       field,
+			Description: "Only one of automatic and user_managed replication may be set.",
+		}}
+	}
+
+	var violations []models.FieldViolation
+	if automatic := replication.Automatic; automatic != nil {
+		violations = append(violations, encryption(field+".automatic.customer_managed_encryption", automatic.CustomerManagedEncryption)...)
+	}
+
+	userManaged := replication.UserManaged
+	if userManaged == nil {
+		return violations
+	}
+	if len(userManaged.Replicas) == 0 {
+		return append(violations, models.FieldViolation{
+			Field:       field + ".user_managed.replicas",
+			Description: "User-managed replication requires at least one replica.",
+		})
+	}
+
+	seen := make(map[string]bool, len(userManaged.Replicas))
+	for i, replica := range userManaged.Replicas {
+		replicaField := fmt.Sprintf("%s.user_managed.replicas[%d]", field, i)
+		switch {
+		case replica.Location == "":
+			violations = append(violations, models.FieldViolation{
+				Field:       replicaField + ".location",
+				Description: "A replica location is required.",
+			})
+		case seen[replica.Location]:
+			violations = append(violations, models.FieldViolation{
+				Field:       replicaField + ".location",
+				Description: fmt.Sprintf("Replica location [%s] is listed more than once.", replica.Location),
+			})
+		}
+		seen[replica.Location] = true
+		violations = append(violations, encryption(replicaField+".customer_managed_encryption", replica.CustomerManagedEncryption)...)
+	}
+	return violations
+}
+
+// Payload checks that a version payload is within production's size limit.
+func Payload(field string, payload *models.SecretPayload) []models.FieldViolation {
+	if payload == nil || len(payload.Data) <= MaxPayloadSize {
+		return nil
+	}
+	return []models.FieldViolation{{
+		Field:       field + ".data",
+		Description: fmt.Sprintf("The payload data must be at most %d bytes, got %d bytes.", MaxPayloadSize, len(payload.Data)),
+	}}
+}
+
+func encryption(field string, cmek *models.CustomerManagedEncryption) []models.FieldViolation {
+	if cmek == nil || kmsKeyNamePattern.MatchString(cmek.KmsKeyName) {
+		return nil
+	}
+	return []models.FieldViolation{{
+		Field:       field + ".kms_key_name",
+		Description: fmt.Sprintf("The KMS key name [%s] must have the form projects/*/locations/*/keyRings/*/cryptoKeys/*.", cmek.KmsKeyName),
+	}}
+}
@@ -4,13 +4,23 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/charlesgreen/gsm/internal/api/routes"
+	"github.com/charlesgreen/gsm/internal/kms"
+	"github.com/charlesgreen/gsm/internal/locations"
 	"github.com/charlesgreen/gsm/internal/models"
 	"github.com/charlesgreen/gsm/internal/storage"
+	"github.com/charlesgreen/gsm/internal/validation"
 )
 
 func TestHealthEndpoint(t *testing.T) {
@@ -39,6 +49,37 @@ func TestHealthEndpoint(t *testing.T) {
 	}
 }
 
+func TestReadyEndpointReportsFlushError(t *testing.T) {
+	store, _ := storage.NewPersistentStorage(filepath.Join(t.TempDir(), "missing", "storage.json"))
+	store.SetFlushDelay(time.Hour)
+	router := routes.SetupRoutes(store)
+
+	ready := func() (int, models.HealthResponse) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", "/ready", nil))
+		var health models.HealthResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &health); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return rr.Code, health
+	}
+
+	if status, health := ready(); status != http.StatusOK || health.Status != "READY" {
+		t.Fatalf("Expected READY, got %d %+v", status, health)
+	}
+
+	_ = store.CreateSecret(context.Background(), "test-project", "test-secret", models.NewSecret("test-project", "test-secret", nil))
+	_ = store.Flush()
+
+	status, health := ready()
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d, got %d", http.StatusServiceUnavailable, status)
+	}
+	if health.Status != "NOT_READY" || health.Error == "" {
+		t.Errorf("Expected NOT_READY with the flush error, got %+v", health)
+	}
+}
+
 func TestCreateSecret(t *testing.T) {
 	store := storage.NewMemoryStorage()
 	router := routes.SetupRoutes(store)
@@ -150,7 +191,7 @@ func TestAccessSecretVersion(t *testing.T) {
 	_ = store.CreateSecret(context.Background(), "test-project", "test-secret", secret)
 
 	secretData := []byte("my-secret-value")
-	_, _ = store.AddSecretVersion(context.Background(), "test-project", "test-secret", secretData)
+	_, _ = store.AddSecretVersion(context.Background(), "test-project", "test-secret", &models.SecretPayload{Data: secretData})
 
 	req, err := http.NewRequest("GET", "/v1/projects/test-project/secrets/test-secret/versions/1:access", nil)
 	if err != nil {
@@ -172,6 +213,96 @@ func TestAccessSecretVersion(t *testing.T) {
 	if string(accessResp.Payload.Data) != string(secretData) {
 		t.Errorf("Expected data %s, got %s", string(secretData), string(accessResp.Payload.Data))
 	}
+
+	if accessResp.Payload.DataCrc32c == nil || *accessResp.Payload.DataCrc32c != models.PayloadCrc32c(secretData) {
+		t.Errorf("Expected dataCrc32c %d, got %v", models.PayloadCrc32c(secretData), accessResp.Payload.DataCrc32c)
+	}
+}
+
+func TestAccessLatestWhileAddingVersions(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+	ctx := context.Background()
+
+	_ = store.CreateSecret(ctx, "test-project", "test-secret", models.NewSecret("test-project", "test-secret", nil))
+	_, _ = store.AddSecretVersion(ctx, "test-project", "test-secret", &models.SecretPayload{Data: []byte("1")})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 2; i <= 200; i++ {
+			_, _ = store.AddSecretVersion(ctx, "test-project", "test-secret", &models.SecretPayload{Data: []byte(strconv.Itoa(i))})
+		}
+	}()
+
+	// Each response pairs a version's name with that version's data and checksum
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		req, err := http.NewRequest("GET", "/v1/projects/test-project/secrets/test-secret/versions/latest:access", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		var access models.AccessSecretVersionResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &access); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if want := "projects/test-project/secrets/test-secret/versions/" + string(access.Payload.Data); access.Name != want {
+			t.Fatalf("Expected data of %s, got %q for %s", access.Name, access.Payload.Data, access.Name)
+		}
+		if crc := access.Payload.DataCrc32c; crc == nil || *crc != models.PayloadCrc32c(access.Payload.Data) {
+			t.Fatalf("Expected dataCrc32c of the data of %s, got %v", access.Name, crc)
+		}
+	}
+}
+
+func TestAddSecretVersionChecksum(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+
+	secret := models.NewSecret("test-project", "test-secret", nil)
+	_ = store.CreateSecret(context.Background(), "test-project", "test-secret", secret)
+
+	add := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/v1/projects/test-project/secrets/test-secret:addVersion", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// "c2VjcmV0" is base64 for "secret", whose CRC32C is 2956741965
+	rr := add(`{"payload": {"data": "c2VjcmV0", "dataCrc32c": "12345"}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT",
+		"Checksum mismatch for the payload added to [projects/test-project/secrets/test-secret]: dataCrc32c does not match the payload data.")
+
+	rr = add(`{"payload": {"data": "c2VjcmV0", "dataCrc32c": "2956741965"}}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var version models.SecretVersion
+	if err := json.Unmarshal(rr.Body.Bytes(), &version); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if !version.ClientSpecifiedPayloadChecksum || version.Name != "projects/test-project/secrets/test-secret/versions/1" {
+		t.Errorf("Expected version 1 with a client-specified checksum, got %+v", version)
+	}
+
+	// Without a checksum the payload is accepted unverified
+	rr = add(`{"payload": {"data": "c2VjcmV0"}}`)
+	if rr.Code != http.StatusCreated || strings.Contains(rr.Body.String(), "clientSpecifiedPayloadChecksum") {
+		t.Errorf("Expected an unverified version, got %d: %s", rr.Code, rr.Body.String())
+	}
 }
 
 func TestListSecrets(t *testing.T) {
@@ -221,3 +352,1018 @@ func TestNotFoundEndpoint(t *testing.T) {
 		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, status)
 	}
 }
+
+func TestUpdateSecret(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+
+	secret := models.NewSecret("test-project", "test-secret", map[string]string{"env": "test"})
+	_ = store.CreateSecret(context.Background(), "test-project", "test-secret", secret)
+	originalEtag := secret.Etag
+
+	body := []byte(`{"labels": {"env": "prod"}, "replication": {"userManaged": {"replicas": [{"location": "us-east1"}]}}}`)
+	req, err := http.NewRequest("PATCH", "/v1/projects/test-project/secrets/test-secret?updateMask=labels", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, status, rr.Body.String())
+	}
+
+	var updated models.Secret
+	if err := json.Unmarshal(rr.Body.Bytes(), &updated); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	if updated.Labels["env"] != "prod" {
+		t.Errorf("Expected label env=prod, got %v", updated.Labels)
+	}
+	if updated.Replication.Automatic == nil || updated.Replication.UserManaged != nil {
+		t.Errorf("Expected replication outside the mask to be untouched, got %+v", updated.Replication)
+	}
+	if updated.Etag == originalEtag {
+		t.Errorf("Expected etag to change after update")
+	}
+}
+
+func TestUpdateSecretInvalidMask(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+
+	secret := models.NewSecret("test-project", "test-secret", nil)
+	_ = store.CreateSecret(context.Background(), "test-project", "test-secret", secret)
+
+	for _, mask := range []string{"", "replication", "bogus", "labels,create_time"} {
+		t.Run(mask, func(t *testing.T) {
+			req, err := http.NewRequest("PATCH", "/v1/projects/test-project/secrets/test-secret?updateMask="+mask, bytes.NewBufferString(`{}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusBadRequest {
+				t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, status)
+			}
+		})
+	}
+}
+
+func TestSecretVersionStateTransitions(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+
+	secret := models.NewSecret("test-project", "test-secret", nil)
+	_ = store.CreateSecret(context.Background(), "test-project", "test-secret", secret)
+	_, _ = store.AddSecretVersion(context.Background(), "test-project", "test-secret", &models.SecretPayload{Data: []byte("my-secret-value")})
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	const versionPath = "/v1/projects/test-project/secrets/test-secret/versions/1"
+
+	rr := do("POST", versionPath+":disable")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var version models.SecretVersion
+	if err := json.Unmarshal(rr.Body.Bytes(), &version); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if version.State != models.StateDisabled {
+		t.Errorf("Expected state %s, got %s", models.StateDisabled, version.State)
+	}
+
+	rr = do("GET", "/v1/projects/test-project/secrets/test-secret/versions/latest:access")
+	assertError(t, rr, http.StatusBadRequest, "FAILED_PRECONDITION",
+		"Secret Version [projects/test-project/secrets/test-secret/versions/1] is in DISABLED state.")
+
+	rr = do("POST", versionPath+":enable")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if rr = do("GET", versionPath+":access"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected re-enabled version to be accessible, got %d", rr.Code)
+	}
+
+	rr = do("POST", versionPath+":destroy")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	version = models.SecretVersion{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &version); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if version.State != models.StateDestroyed || version.DestroyTime == nil {
+		t.Errorf("Expected destroyed version with destroyTime, got %+v", version)
+	}
+
+	rr = do("GET", versionPath+":access")
+	assertError(t, rr, http.StatusBadRequest, "FAILED_PRECONDITION",
+		"Secret Version [projects/test-project/secrets/test-secret/versions/1] is in DESTROYED state.")
+
+	rr = do("POST", versionPath+":enable")
+	assertError(t, rr, http.StatusBadRequest, "FAILED_PRECONDITION",
+		"Secret Version [projects/test-project/secrets/test-secret/versions/1] is in DESTROYED state.")
+
+	if rr = do("DELETE", versionPath); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected DELETE on a version to be unsupported, got %d", rr.Code)
+	}
+}
+
+func assertError(t *testing.T, rr *httptest.ResponseRecorder, code int, status, message string) {
+	t.Helper()
+
+	if rr.Code != code {
+		t.Fatalf("Expected status code %d, got %d: %s", code, rr.Code, rr.Body.String())
+	}
+
+	var errorResp models.ErrorResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &errorResp); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if errorResp.Error.Status != status {
+		t.Errorf("Expected error status %s, got %s", status, errorResp.Error.Status)
+	}
+	if errorResp.Error.Message != message {
+		t.Errorf("Expected error message '%s', got '%s'", message, errorResp.Error.Message)
+	}
+}
+
+func TestGetSecretVersion(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+
+	secret := models.NewSecret("test-project", "test-secret", nil)
+	_ = store.CreateSecret(context.Background(), "test-project", "test-secret", secret)
+	_, _ = store.AddSecretVersion(context.Background(), "test-project", "test-secret", &models.SecretPayload{Data: []byte("v1")})
+	_, _ = store.AddSecretVersion(context.Background(), "test-project", "test-secret", &models.SecretPayload{Data: []byte("v2")})
+
+	req, err := http.NewRequest("GET", "/v1/projects/test-project/secrets/test-secret/versions/latest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, status)
+	}
+
+	var version models.SecretVersion
+	if err := json.Unmarshal(rr.Body.Bytes(), &version); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	expectedName := "projects/test-project/secrets/test-secret/versions/2"
+	if version.Name != expectedName {
+		t.Errorf("Expected name %s, got %s", expectedName, version.Name)
+	}
+	if version.State != models.StateEnabled {
+		t.Errorf("Expected state %s, got %s", models.StateEnabled, version.State)
+	}
+	if len(version.Data) != 0 {
+		t.Errorf("Expected version metadata without payload data")
+	}
+
+	req, err = http.NewRequest("GET", "/v1/projects/test-project/secrets/test-secret/versions/3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assertError(t, rr, http.StatusNotFound, "NOT_FOUND",
+		"Secret Version [projects/test-project/secrets/test-secret/versions/3] not found.")
+}
+
+func TestRegionalSecrets(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A global and a regional secret can share an ID without colliding
+	if rr := do("POST", "/v1/projects/test-project/secrets", `{"secretId": "shared", "secret": {}}`); rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	rr := do("POST", "/v1/projects/test-project/locations/us-east1/secrets?secretId=shared", `{}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var secret models.Secret
+	if err := json.Unmarshal(rr.Body.Bytes(), &secret); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if expected := "projects/test-project/locations/us-east1/secrets/shared"; secret.Name != expected {
+		t.Errorf("Expected name %s, got %s", expected, secret.Name)
+	}
+	if !secret.Replication.IsEmpty() {
+		t.Errorf("Expected regional secret without replication, got %+v", secret.Replication)
+	}
+
+	rr = do("POST", "/v1/projects/test-project/locations/us-east1/secrets/shared:addVersion", `{"payload": {"data": "cmVnaW9uYWw="}}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	rr = do("GET", "/v1/projects/test-project/locations/us-east1/secrets/shared/versions/latest:access", "")
+	var accessResp models.AccessSecretVersionResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &accessResp); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if expected := "projects/test-project/locations/us-east1/secrets/shared/versions/1"; accessResp.Name != expected {
+		t.Errorf("Expected name %s, got %s", expected, accessResp.Name)
+	}
+	if string(accessResp.Payload.Data) != "regional" {
+		t.Errorf("Expected data regional, got %s", accessResp.Payload.Data)
+	}
+
+	// The global secret is untouched and each scope lists only its own secrets
+	rr = do("GET", "/v1/projects/test-project/secrets/shared/versions/latest:access", "")
+	assertError(t, rr, http.StatusNotFound, "NOT_FOUND",
+		"Secret Version [projects/test-project/secrets/shared/versions/latest] not found.")
+
+	for _, path := range []string{"/v1/projects/test-project/secrets", "/v1/projects/test-project/locations/us-east1/secrets"} {
+		var listResp models.ListSecretsResponse
+		if err := json.Unmarshal(do("GET", path, "").Body.Bytes(), &listResp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if len(listResp.Secrets) != 1 {
+			t.Errorf("Expected 1 secret under %s, got %d", path, len(listResp.Secrets))
+		}
+	}
+
+	rr = do("DELETE", "/v1/projects/test-project/locations/us-east1/secrets/missing", "")
+	assertError(t, rr, http.StatusNotFound, "NOT_FOUND",
+		"Secret [projects/test-project/locations/us-east1/secrets/missing] not found.")
+
+	rr = do("POST", "/v1/projects/test-project/locations/us-east1/secrets", `{"secretId": "replicated", "secret": {"replication": {"automatic": {}}}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT",
+		"Replication policy is not supported for regional secrets.")
+}
+
+func TestListLocationsPagination(t *testing.T) {
+	catalog := locations.NewCatalog(locations.Location{ID: "asia-east1"}, locations.Location{ID: "europe-west1"}, locations.Location{ID: "us-east1"})
+	router := routes.SetupRoutes(storage.NewMemoryStorage(), routes.Locations(catalog))
+
+	list := func(query string) (*httptest.ResponseRecorder, models.ListLocationsResponse) {
+		req, _ := http.NewRequest("GET", "/v1/projects/test-project/locations?"+query, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var resp models.ListLocationsResponse
+		_ = json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr, resp
+	}
+
+	rr, first := list("pageSize=2")
+	if rr.Code != http.StatusOK || len(first.Locations) != 2 || first.NextPageToken == "" {
+		t.Fatalf("Expected a first page of 2 with a token, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if first.NextPageToken == "2" {
+		t.Errorf("Expected an opaque page token, got %q", first.NextPageToken)
+	}
+
+	rr, second := list("pageSize=2&pageToken=" + first.NextPageToken)
+	if rr.Code != http.StatusOK || len(second.Locations) != 1 || second.Locations[0].LocationID != "us-east1" || second.NextPageToken != "" {
+		t.Fatalf("Expected a last page holding us-east1, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Tokens are bound to the project they were issued for
+	req, _ := http.NewRequest("GET", "/v1/projects/other-project/locations?pageToken="+first.NextPageToken, nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "Invalid page token")
+
+	rr, _ = list("pageToken=2")
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "Invalid page token")
+}
+
+func TestCreateSecretUnsupportedLocation(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store, routes.Locations(locations.NewCatalog(locations.Location{ID: "us-east1"})))
+
+	tests := []struct {
+		name    string
+		path    string
+		body    string
+		message string
+	}{
+		{
+			name:    "RegionalSecret",
+			path:    "/v1/projects/test-project/locations/us-moon1/secrets",
+			body:    `{"secretId": "test-secret"}`,
+			message: "Location [us-moon1] is not supported.",
+		},
+		{
+			name:    "UserManagedReplica",
+			path:    "/v1/projects/test-project/secrets",
+			body:    `{"secretId": "test-secret", "secret": {"replication": {"userManaged": {"replicas": [{"location": "us-east1"}, {"location": "europe-west1"}]}}}}`,
+			message: "Location [europe-west1] is not supported.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", tt.path, bytes.NewBufferString(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", tt.message)
+		})
+	}
+}
+
+func TestIamEnforcement(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	const admin = "user:admin@example.com"
+	router := routes.SetupRoutes(store, routes.EnforceIAM(), routes.IAMAdmins(admin))
+
+	const principal = "serviceAccount:app@test-project.iam.gserviceaccount.com"
+
+	do := func(method, path, caller, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if caller != "" {
+			req.Header.Set("X-GSM-Principal", caller)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Callers must identify themselves, and admins set up fixtures
+	rr := do("POST", "/v1/projects/test-project/secrets", "", `{"secretId": "db-password"}`)
+	assertError(t, rr, http.StatusUnauthorized, "UNAUTHENTICATED", models.UnauthenticatedMessage)
+	if rr := do("POST", "/v1/projects/test-project/secrets", admin, `{"secretId": "db-password"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	if rr := do("POST", "/v1/projects/test-project/secrets/db-password:addVersion", admin, `{"payload": {"data": "c2VjcmV0"}}`); rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	const accessPath = "/v1/projects/test-project/secrets/db-password/versions/latest:access"
+	rr = do("GET", accessPath, principal, "")
+	assertError(t, rr, http.StatusForbidden, "PERMISSION_DENIED",
+		"Permission 'secretmanager.versions.access' denied on resource 'projects/test-project/secrets/db-password/versions/latest'.")
+
+	policy := `{"policy": {"bindings": [{"role": "roles/secretmanager.secretAccessor", "members": ["` + principal + `"]}]}}`
+	if rr := do("POST", "/v1/projects/test-project/secrets/db-password:setIamPolicy", admin, policy); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	if rr := do("GET", accessPath, principal, ""); rr.Code != http.StatusOK {
+		t.Fatalf("Expected granted principal to access the secret, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// The secret accessor role grants nothing beyond reading payloads
+	rr = do("POST", "/v1/projects/test-project/secrets/db-password:addVersion", principal, `{"payload": {"data": "c2VjcmV0"}}`)
+	assertError(t, rr, http.StatusForbidden, "PERMISSION_DENIED",
+		"Permission 'secretmanager.versions.add' denied on resource 'projects/test-project/secrets/db-password'.")
+
+	rr = do("POST", "/v1/projects/test-project/secrets/db-password:testIamPermissions", principal,
+		`{"permissions": ["secretmanager.versions.access", "secretmanager.versions.add"]}`)
+	var testResp models.TestIamPermissionsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &testResp); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(testResp.Permissions) != 1 || testResp.Permissions[0] != "secretmanager.versions.access" {
+		t.Errorf("Expected only secretmanager.versions.access, got %v", testResp.Permissions)
+	}
+
+	// Anonymous callers hold nothing rather than everything
+	rr = do("POST", "/v1/projects/test-project/secrets/db-password:testIamPermissions", "",
+		`{"permissions": ["secretmanager.versions.access"]}`)
+	assertError(t, rr, http.StatusUnauthorized, "UNAUTHENTICATED", models.UnauthenticatedMessage)
+
+	// Project level grants apply to every secret in the project
+	projectPolicy := `{"policy": {"bindings": [{"role": "roles/secretmanager.admin", "members": ["` + principal + `"]}]}}`
+	if rr := do("POST", "/v1/projects/test-project:setIamPolicy", admin, projectPolicy); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if rr := do("POST", "/v1/projects/test-project/secrets/db-password:addVersion", principal, `{"payload": {"data": "c2VjcmV0"}}`); rr.Code != http.StatusCreated {
+		t.Fatalf("Expected project admin to add a version, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestVersionAliases(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+
+	secret := models.NewSecret("test-project", "test-secret", nil)
+	_ = store.CreateSecret(context.Background(), "test-project", "test-secret", secret)
+	_, _ = store.AddSecretVersion(context.Background(), "test-project", "test-secret", &models.SecretPayload{Data: []byte("v1")})
+	_, _ = store.AddSecretVersion(context.Background(), "test-project", "test-secret", &models.SecretPayload{Data: []byte("v2")})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	const secretPath = "/v1/projects/test-project/secrets/test-secret"
+
+	rr := do("PATCH", secretPath+"?updateMask=versionAliases", `{"versionAliases":{"current":"2","previous":1}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var updated map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &updated); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	aliases, _ := updated["versionAliases"].(map[string]any)
+	if aliases["current"] != "2" || aliases["previous"] != "1" {
+		t.Errorf("Expected aliases encoded as strings, got %v", updated["versionAliases"])
+	}
+
+	rr = do("GET", secretPath+"/versions/previous:access", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var access models.AccessSecretVersionResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &access); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if access.Name != "projects/test-project/secrets/test-secret/versions/1" {
+		t.Errorf("Expected alias to resolve to version 1, got %s", access.Name)
+	}
+
+	rr = do("PATCH", secretPath+"?updateMask=versionAliases", `{"versionAliases":{"next":"3"}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT",
+		"Version alias [next] refers to version [3], which does not exist or is destroyed.")
+
+	rr = do("PATCH", secretPath+"?updateMask=versionAliases", `{"versionAliases":{"latest":"1"}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", `version alias "latest" is reserved`)
+
+	rr = do("PATCH", secretPath+"?updateMask=versionAliases", `{"versionAliases":{"2":"1"}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", `version alias "2" must not be a number, which would read as a version ID`)
+	if rr = do("PATCH", secretPath+"?updateMask=labels", `{"versionAliases":{"latest":"1"}}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected fields outside the mask to be ignored, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if rr = do("POST", secretPath+"/versions/previous:destroy", `{}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	got, _ := store.GetSecret(context.Background(), "test-project", "test-secret")
+	if _, ok := got.VersionAliases["previous"]; ok {
+		t.Error("Expected alias of destroyed version to be removed")
+	}
+	if got.VersionAliases["current"] != 2 {
+		t.Errorf("Expected current alias to be kept, got %v", got.VersionAliases)
+	}
+}
+
+func TestSecretAnnotations(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("POST", "/v1/projects/test-project/secrets?secretId=test-secret",
+		`{"secret_id": "test-secret", "secret": {"annotations": {"owner_team": "payments", "example.com/ticket": "OPS-1"}}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT",
+		"Annotation key [example.com/ticket] is invalid. Keys must be 1-63 characters long, begin and end with an alphanumeric character, and contain only alphanumerics, dashes, underscores and dots.")
+
+	rr = do("POST", "/v1/projects/test-project/secrets?secretId=test-secret",
+		`{"secret": {"annotations": {"owner_team": "payments", "example.com.ticket": "OPS-1"}}}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	rr = do("GET", "/v1/projects/test-project/secrets", "")
+	var list models.ListSecretsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(list.Secrets) != 1 || list.Secrets[0].Annotations["owner_team"] != "payments" {
+		t.Fatalf("Expected annotation keys to round-trip unchanged, got %+v", list.Secrets)
+	}
+
+	rr = do("PATCH", "/v1/projects/test-project/secrets/test-secret?update_mask=annotations",
+		`{"annotations": {"owner_team": "identity"}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	got, _ := store.GetSecret(context.Background(), "test-project", "test-secret")
+	if len(got.Annotations) != 1 || got.Annotations["owner_team"] != "identity" {
+		t.Errorf("Expected annotations to be replaced, got %v", got.Annotations)
+	}
+
+	large, _ := json.Marshal(map[string]any{"annotations": map[string]string{"blob": strings.Repeat("x", 16*1024)}})
+	rr = do("PATCH", "/v1/projects/test-project/secrets/test-secret?updateMask=annotations", string(large))
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT",
+		"The total size of annotations is 16388 bytes, which exceeds the limit of 16384 bytes.")
+	if rr = do("PATCH", "/v1/projects/test-project/secrets/test-secret?updateMask=labels", string(large)); rr.Code != http.StatusOK {
+		t.Fatalf("Expected fields outside the mask to be ignored, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestSecretExpiration(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("POST", "/v1/projects/test-project/secrets?secretId=preview",
+		`{"secret": {"ttl": "3600s", "expireTime": "2099-01-01T00:00:00Z"}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "Only one of expireTime and ttl may be set.")
+
+	rr = do("POST", "/v1/projects/test-project/secrets?secretId=preview", `{"secret": {"expireTime": "2000-01-01T00:00:00Z"}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "The expireTime must be in the future.")
+
+	before := time.Now()
+	rr = do("POST", "/v1/projects/test-project/secrets?secretId=preview", `{"secret": {"ttl": "3600s"}}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	var created map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if _, ok := created["ttl"]; ok {
+		t.Errorf("Expected ttl to be input only, got %v", created["ttl"])
+	}
+	expireTime, err := time.Parse(time.RFC3339Nano, created["expireTime"].(string))
+	if err != nil || expireTime.Before(before.Add(time.Hour)) {
+		t.Errorf("Expected expireTime an hour from now, got %v", created["expireTime"])
+	}
+
+	rr = do("PATCH", "/v1/projects/test-project/secrets/preview?updateMask=ttl", `{}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if got, _ := store.GetSecret(context.Background(), "test-project", "preview"); got.ExpireTime != nil {
+		t.Errorf("Expected an empty ttl to clear the expiration, got %v", got.ExpireTime)
+	}
+
+	// Secrets are hidden as soon as they expire, before the reaper runs
+	expired := models.NewSecret("test-project", "expired", nil)
+	past := time.Now().Add(-time.Minute)
+	expired.ExpireTime = &past
+	_ = store.CreateSecret(context.Background(), "test-project", "expired", expired)
+
+	rr = do("GET", "/v1/projects/test-project/secrets/expired", "")
+	assertError(t, rr, http.StatusNotFound, "NOT_FOUND", "Secret [projects/test-project/secrets/expired] not found.")
+	rr = do("POST", "/v1/projects/test-project/secrets/expired:addVersion", `{"payload": {"data": "c2VjcmV0"}}`)
+	assertError(t, rr, http.StatusNotFound, "NOT_FOUND", "Secret [projects/test-project/secrets/expired] not found.")
+}
+
+func TestSecretRotation(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	next := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	rr := do("POST", "/v1/projects/test-project/secrets?secretId=db-password",
+		`{"secret": {"rotation": {"next_rotation_time": "`+next+`", "rotation_period": "86400s"}}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "A secret with a rotation schedule must have at least one topic.")
+
+	rr = do("POST", "/v1/projects/test-project/secrets?secretId=db-password",
+		`{"secret": {"topics": [{"name": "projects/test-project/topics/rotations"}], "rotation": {"nextRotationTime": "`+next+`", "rotationPeriod": "60s"}}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "The rotation.rotationPeriod must be between 1 hour and 100 years.")
+
+	rr = do("POST", "/v1/projects/test-project/secrets?secretId=db-password",
+		`{"secret": {"topics": [{"name": "projects/test-project/topics/rotations"}], "rotation": {"rotationPeriod": "86400s"}}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "The rotation.nextRotationTime must be set when rotation.rotationPeriod is set.")
+
+	rr = do("POST", "/v1/projects/test-project/secrets?secretId=db-password",
+		`{"secret": {"topics": [{"name": "projects/test-project/topics/rotations"}], "rotation": {"nextRotationTime": "`+next+`"}}}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	rr = do("PATCH", "/v1/projects/test-project/secrets/db-password?updateMask=rotation.rotation_period",
+		`{"rotation": {"rotationPeriod": "7200s"}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var updated map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &updated); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	rotation, _ := updated["rotation"].(map[string]any)
+	if rotation["rotationPeriod"] != "7200s" || rotation["nextRotationTime"] == nil {
+		t.Errorf("Expected period to be added to the existing schedule, got %v", updated["rotation"])
+	}
+
+	rr = do("PATCH", "/v1/projects/test-project/secrets/db-password?updateMask=topics", `{}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "A secret with a rotation schedule must have at least one topic.")
+
+	// A secret read back with a rotation that is due can be sent with a mask
+	// of other fields
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	rr = do("PATCH", "/v1/projects/test-project/secrets/db-password?updateMask=labels",
+		`{"labels": {"env": "prod"}, "topics": [{"name": "projects/test-project/topics/rotations"}], "rotation": {"nextRotationTime": "`+past+`", "rotationPeriod": "7200s"}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	rr = do("PATCH", "/v1/projects/test-project/secrets/db-password?updateMask=rotation.nextRotationTime",
+		`{"rotation": {"nextRotationTime": "`+past+`"}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "The rotation.nextRotationTime must be at least 5 minutes in the future.")
+}
+
+func TestVersionDestroyTTL(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+	ctx := context.Background()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("POST", "/v1/projects/test-project/secrets?secretId=db-password", `{"secret": {"versionDestroyTtl": "60s"}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "The versionDestroyTtl must be at least 1 day.")
+
+	rr = do("POST", "/v1/projects/test-project/secrets?secretId=db-password", `{"secret": {"versionDestroyTtl": "86400s"}}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	rr = do("PATCH", "/v1/projects/test-project/secrets/db-password?updateMask=versionDestroyTtl", `{"versionDestroyTtl": "60s"}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "The versionDestroyTtl must be at least 1 day.")
+	if rr = do("PATCH", "/v1/projects/test-project/secrets/db-password?updateMask=labels", `{"versionDestroyTtl": "60s"}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected fields outside the mask to be ignored, got %d: %s", rr.Code, rr.Body.String())
+	}
+	_, _ = store.AddSecretVersion(ctx, "test-project", "db-password", &models.SecretPayload{Data: []byte("v1")})
+
+	const versionPath = "/v1/projects/test-project/secrets/db-password/versions/1"
+
+	rr = do("POST", versionPath+":destroy", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var version models.SecretVersion
+	if err := json.Unmarshal(rr.Body.Bytes(), &version); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if version.State != models.StateDisabled || version.ScheduledDestroyTime == nil {
+		t.Fatalf("Expected a disabled version with a scheduled destroy time, got %+v", version)
+	}
+	if until := time.Until(*version.ScheduledDestroyTime); until < 23*time.Hour || until > 24*time.Hour {
+		t.Errorf("Expected destruction to be scheduled a day ahead, got %v", until)
+	}
+
+	// Enabling the version before the deadline cancels the destruction
+	rr = do("POST", versionPath+":enable", "")
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "scheduledDestroyTime") {
+		t.Fatalf("Expected an enabled version without a schedule, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if destroyed, _ := store.DestroyScheduledVersions(ctx, time.Now().Add(48*time.Hour)); len(destroyed) != 0 {
+		t.Fatalf("Expected no versions to be destroyed, got %v", destroyed)
+	}
+
+	_ = do("POST", versionPath+":destroy", "")
+	destroyed, _ := store.DestroyScheduledVersions(ctx, time.Now().Add(48*time.Hour))
+	if len(destroyed) != 1 || destroyed[0].Version.State != models.StateDestroyed {
+		t.Fatalf("Expected version 1 to be destroyed, got %v", destroyed)
+	}
+
+	rr = do("GET", versionPath+":access", "")
+	assertError(t, rr, http.StatusBadRequest, "FAILED_PRECONDITION",
+		"Secret Version [projects/test-project/secrets/db-password/versions/1] is in DESTROYED state.")
+}
+
+func TestCustomerManagedEncryption(t *testing.T) {
+	const keyName = "projects/test-project/locations/global/keyRings/ring/cryptoKeys/key"
+	const keyVersion = keyName + "/cryptoKeyVersions/1"
+
+	keys := kms.NewRegistry()
+	store := storage.NewMemoryStorage()
+	store.SetKeyRegistry(keys)
+	router := routes.SetupRoutes(store, routes.KeyRegistry(keys))
+	ctx := context.Background()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("POST", "/v1/projects/test-project/secrets?secretId=db-password",
+		`{"replication": {"automatic": {"customerManagedEncryption": {"kmsKeyName": "`+keyName+`"}}}}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	const addPath = "/v1/projects/test-project/secrets/db-password:addVersion"
+	const payload = `{"payload": {"data": "c2VjcmV0"}}`
+
+	rr = do("POST", addPath, payload)
+	assertError(t, rr, http.StatusBadRequest, "FAILED_PRECONDITION",
+		"The customer-managed encryption key ["+keyName+"] was not found.")
+
+	rr = do("POST", "/kms/v1/projects/test-project/locations/global/keyRings/ring/cryptoKeys?cryptoKeyId=key", "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	rr = do("POST", addPath, payload)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	var version models.SecretVersion
+	if err := json.Unmarshal(rr.Body.Bytes(), &version); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if version.CustomerManagedEncryption == nil || version.CustomerManagedEncryption.KmsKeyVersionName != keyVersion {
+		t.Fatalf("Expected the version to record %s, got %+v", keyVersion, version.CustomerManagedEncryption)
+	}
+	stored, _ := store.GetSecretVersion(ctx, "test-project", "db-password", "1")
+	if bytes.Contains(stored.Data, []byte("secret")) {
+		t.Error("Expected the payload to be encrypted at rest")
+	}
+
+	const accessPath = "/v1/projects/test-project/secrets/db-password/versions/1:access"
+	if rr = do("GET", accessPath, ""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"c2VjcmV0"`) {
+		t.Fatalf("Expected the decrypted payload, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Revoking the key makes the payload unreadable until it is enabled again
+	if rr = do("PATCH", "/kms/v1/"+keyVersion, `{"state": "DISABLED"}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	rr = do("GET", accessPath, "")
+	assertError(t, rr, http.StatusBadRequest, "FAILED_PRECONDITION",
+		"The customer-managed encryption key version ["+keyVersion+"] is in DISABLED state.")
+	rr = do("POST", addPath, payload)
+	assertError(t, rr, http.StatusBadRequest, "FAILED_PRECONDITION",
+		"The customer-managed encryption key version ["+keyVersion+"] is in DISABLED state.")
+
+	_ = do("PATCH", "/kms/v1/"+keyVersion, `{"state": "ENABLED"}`)
+	if rr = do("GET", accessPath, ""); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	if rr = do("POST", "/kms/v1/"+keyVersion+":destroy", ""); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	rr = do("GET", accessPath, "")
+	assertError(t, rr, http.StatusBadRequest, "FAILED_PRECONDITION",
+		"The customer-managed encryption key version ["+keyVersion+"] is in DESTROYED state.")
+}
+
+func TestRequestValidation(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// fieldViolations decodes the google.rpc.BadRequest details of an error
+	fieldViolations := func(rr *httptest.ResponseRecorder) []string {
+		var resp struct {
+			Error struct {
+				Details []struct {
+					Type            string                  `json:"@type"`
+					FieldViolations []models.FieldViolation `json:"fieldViolations"`
+				} `json:"details"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		var fields []string
+		for _, detail := range resp.Error.Details {
+			if detail.Type == "type.googleapis.com/google.rpc.BadRequest" {
+				for _, violation := range detail.FieldViolations {
+					fields = append(fields, violation.Field)
+				}
+			}
+		}
+		return fields
+	}
+
+	rr := do("POST", "/v1/projects/test-project/secrets?secretId=db.password", `{}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT",
+		"The secret ID [db.password] must be 1-255 characters long and contain only letters, digits, underscores and hyphens.")
+	if fields := fieldViolations(rr); !slices.Equal(fields, []string{"secret_id"}) {
+		t.Errorf("Expected a secret_id violation, got %v", fields)
+	}
+
+	// Every violation is reported, not only the first
+	rr = do("POST", "/v1/projects/test-project/secrets?secretId=db-password",
+		`{"labels": {"Env": "prod", "team": "Platform"}, "replication": {"userManaged": {"replicas": [{"location": "us-east1"}, {"location": "us-east1"}]}}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT",
+		"Label key [Env] is invalid. Keys must be 1-63 characters long, start with a lowercase letter, and contain only lowercase letters, digits, underscores and hyphens.")
+	want := []string{"secret.labels[Env]", "secret.labels[team]", "secret.replication.user_managed.replicas[1].location"}
+	if fields := fieldViolations(rr); !slices.Equal(fields, want) {
+		t.Errorf("Expected violations %v, got %v", want, fields)
+	}
+
+	labels := make(map[string]string)
+	for i := range validation.MaxLabels + 1 {
+		labels[fmt.Sprintf("key%d", i)] = "value"
+	}
+	body, _ := json.Marshal(map[string]any{"labels": labels})
+	rr = do("POST", "/v1/projects/test-project/secrets?secretId=db-password", string(body))
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "A secret may have at most 64 labels, got 65.")
+
+	rr = do("POST", "/v1/projects/test-project/secrets?secretId=db-password", `{"replication": {"automatic": {}, "userManaged": {"replicas": [{"location": "us-east1"}]}}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "Only one of automatic and user_managed replication may be set.")
+
+	if rr = do("POST", "/v1/projects/test-project/secrets?secretId=db-password", `{"labels": {"env": "prod"}}`); rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	rr = do("PATCH", "/v1/projects/test-project/secrets/db-password?updateMask=labels", `{"labels": {"env": "Prod"}}`)
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT",
+		"Label value [Prod] is invalid. Values must be at most 63 characters long and contain only lowercase letters, digits, underscores and hyphens.")
+
+	body, _ = json.Marshal(models.AddSecretVersionRequest{Payload: &models.SecretPayload{Data: make([]byte, validation.MaxPayloadSize+1)}})
+	rr = do("POST", "/v1/projects/test-project/secrets/db-password:addVersion", string(body))
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "The payload data must be at most 65536 bytes, got 65537 bytes.")
+	if fields := fieldViolations(rr); !slices.Equal(fields, []string{"payload.data"}) {
+		t.Errorf("Expected a payload.data violation, got %v", fields)
+	}
+
+	body, _ = json.Marshal(models.AddSecretVersionRequest{Payload: &models.SecretPayload{Data: make([]byte, validation.MaxPayloadSize)}})
+	if rr = do("POST", "/v1/projects/test-project/secrets/db-password:addVersion", string(body)); rr.Code != http.StatusCreated {
+		t.Errorf("Expected a 64KiB payload to be accepted, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestListFilter(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+	ctx := context.Background()
+
+	for _, s := range []struct {
+		id  string
+		env string
+	}{{"api-key", "prod"}, {"db-password", "prod"}, {"db-replica", "dev"}} {
+		_ = store.CreateSecret(ctx, "test-project", s.id, models.NewSecret("test-project", s.id, map[string]string{"env": s.env}))
+	}
+	_, _ = store.AddSecretVersion(ctx, "test-project", "db-password", &models.SecretPayload{Data: []byte("v1")})
+	_, _ = store.AddSecretVersion(ctx, "test-project", "db-password", &models.SecretPayload{Data: []byte("v2")})
+	_, _ = store.SetSecretVersionState(ctx, "test-project", "db-password", "1", models.StateDisabled, "")
+
+	get := func(path string, query url.Values) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path+"?"+query.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The filter runs before pagination, so the first page holds the first match
+	rr := get("/v1/projects/test-project/secrets", url.Values{"filter": {"labels.env=prod AND name:db-"}, "pageSize": {"1"}})
+	var secrets models.ListSecretsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &secrets); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(secrets.Secrets) != 1 || secrets.Secrets[0].GetSecretID() != "db-password" || secrets.NextPageToken != "" {
+		t.Fatalf("Expected only db-password to match, got %+v", secrets)
+	}
+
+	rr = get("/v1/projects/test-project/secrets/db-password/versions", url.Values{"filter": {"state:ENABLED"}})
+	var versions models.ListSecretVersionsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &versions); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(versions.Versions) != 1 || versions.Versions[0].GetVersionID() != "2" {
+		t.Fatalf("Expected only version 2 to be enabled, got %+v", versions)
+	}
+
+	rr = get("/v1/projects/test-project/secrets", url.Values{"filter": {"labels.env=prod"}, "pageSize": {"1"}})
+	if err := json.Unmarshal(rr.Body.Bytes(), &secrets); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if secrets.TotalSize != 2 || secrets.NextPageToken == "" {
+		t.Fatalf("Expected totalSize to count every match, got %+v", secrets)
+	}
+	rr = get("/v1/projects/test-project/secrets", url.Values{"pageToken": {secrets.NextPageToken}})
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "Invalid page token")
+
+	rr = get("/v1/projects/test-project/secrets", url.Values{"filter": {"(labels.env=prod OR name:db-"}})
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", `Invalid filter: unexpected end of filter, expected ")".`)
+
+	rr = get("/v1/projects/test-project/secrets/db-password/versions", url.Values{"filter": {"state:ENABLED OR"}})
+	assertError(t, rr, http.StatusBadRequest, "INVALID_ARGUMENT", "Invalid filter: unexpected end of filter, expected a field or value.")
+}
+
+func TestEtagConcurrency(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := routes.SetupRoutes(store)
+	ctx := context.Background()
+
+	secret := models.NewSecret("test-project", "test-secret", nil)
+	_ = store.CreateSecret(ctx, "test-project", "test-secret", secret)
+	version, _ := store.AddSecretVersion(ctx, "test-project", "test-secret", &models.SecretPayload{Data: []byte("v1")})
+	staleSecretEtag, staleVersionEtag := secret.Etag, version.Etag
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	const secretPath = "/v1/projects/test-project/secrets/test-secret"
+	const versionPath = secretPath + "/versions/1"
+
+	rr := do("PATCH", secretPath+"?updateMask=labels", `{"labels": {"env": "a"}, "etag": `+strconv.Quote(staleSecretEtag)+`}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	// The first update changed the etag, so a second writer holding the old one loses
+	rr = do("PATCH", secretPath+"?updateMask=labels", `{"labels": {"env": "b"}, "etag": `+strconv.Quote(staleSecretEtag)+`}`)
+	assertError(t, rr, http.StatusBadRequest, "FAILED_PRECONDITION",
+		"The etag provided does not match the current etag of [projects/test-project/secrets/test-secret].")
+
+	rr = do("DELETE", secretPath+"?etag="+url.QueryEscape(staleSecretEtag), "")
+	assertError(t, rr, http.StatusBadRequest, "FAILED_PRECONDITION",
+		"The etag provided does not match the current etag of [projects/test-project/secrets/test-secret].")
+
+	if rr = do("POST", versionPath+":disable", `{"etag": `+strconv.Quote(staleVersionEtag)+`}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	rr = do("POST", versionPath+":enable", `{"etag": `+strconv.Quote(staleVersionEtag)+`}`)
+	assertError(t, rr, http.StatusBadRequest, "FAILED_PRECONDITION",
+		"The etag provided does not match the current etag of [projects/test-project/secrets/test-secret/versions/1].")
+
+	current, _ := store.GetSecret(ctx, "test-project", "test-secret")
+	if rr = do("DELETE", secretPath+"?etag="+url.QueryEscape(current.Etag), ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,124 @@
+package unit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/charlesgreen/gsm/internal/filter"
+	"github.com/charlesgreen/gsm/internal/models"
+)
+
+func TestFilter_Match(t *testing.T) {
+	secret := models.NewSecret("test-project", "db-password", map[string]string{"env": "prod", "team": "payments"})
+	secret.CreateTime = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{"", true},
+		{"labels.env=prod", true},
+		{"labels.env=dev", false},
+		{"labels.env=prod AND name:db-", true},
+		{"labels.env=prod AND name:api-", false},
+		{"name:api- OR name:db-", true},
+		{"labels.env:*", true},
+		{"labels.owner:*", false},
+		{"labels:team", true},
+		{"NOT labels.env=dev", true},
+		{"-labels.env=prod", false},
+		{"labels.env!=prod", false},
+		{`create_time>"2024-01-01"`, true},
+		{"create_time<2024-01-01T00:00:00Z", false},
+		{"createTime>=2024-06-01T12:00:00Z", true},
+		{"(name:api- OR labels.env=prod) labels.team=payments", true},
+		{"labels.env=dev OR labels.team=payments AND name:db", true},
+		{"password", true},
+	}
+
+	for _, tt := range tests {
+		f, err := filter.Parse(tt.filter, models.SecretFilterFields)
+		if err != nil {
+			t.Errorf("Parse(%q): unexpected error %v", tt.filter, err)
+			continue
+		}
+		if got := f.Match(secret); got != tt.want {
+			t.Errorf("Parse(%q).Match() = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestFilter_MatchVersion(t *testing.T) {
+	version := models.NewSecretVersion("test-project", "test-secret", "1", []byte("data"))
+
+	f, err := filter.Parse("state:ENABLED", models.VersionFilterFields)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !f.Match(version) {
+		t.Errorf("Expected enabled version to match state:ENABLED")
+	}
+
+	version.SetState(models.StateDisabled)
+	if f.Match(version) {
+		t.Errorf("Expected disabled version not to match state:ENABLED")
+	}
+}
+
+func TestFilter_SyntaxErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{"labels.env=prod AND", "unexpected end of filter, expected a field or value"},
+		{"(labels.env=prod", `unexpected end of filter, expected ")"`},
+		{"labels.env=prod)", `unexpected ")" at column 16, expected AND, OR or the end of the filter`},
+		{"labels.env= AND name:db", `unexpected "AND" at column 13, expected a value after "labels.env="`},
+		{`name:"db`, `unexpected "\"db" at column 6, expected a closing quote`},
+		{"OR name:db", `unexpected "OR" at column 1, expected a field or value`},
+	}
+
+	for _, tt := range tests {
+		_, err := filter.Parse(tt.filter, models.SecretFilterFields)
+		var syntaxErr *filter.SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Parse(%q): expected a SyntaxError, got %v", tt.filter, err)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("Parse(%q): got error %q, want %q", tt.filter, err.Error(), tt.want)
+		}
+	}
+}
+
+func TestFilter_UnknownFields(t *testing.T) {
+	tests := []struct {
+		filter string
+		fields filter.Fields
+		want   string
+	}{
+		{"lables.env=prod", models.SecretFilterFields, `unknown field "lables.env" at column 1`},
+		{"labels.env=prod AND rotation.period>0", models.SecretFilterFields, `unknown field "rotation.period" at column 21`},
+		{"name:db OR labels.env=prod", models.VersionFilterFields, `unknown field "labels.env" at column 12`},
+	}
+
+	for _, tt := range tests {
+		_, err := filter.Parse(tt.filter, tt.fields)
+		var fieldErr *filter.FieldError
+		if !errors.As(err, &fieldErr) {
+			t.Errorf("Parse(%q): expected a FieldError, got %v", tt.filter, err)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("Parse(%q): got error %q, want %q", tt.filter, err.Error(), tt.want)
+		}
+	}
+
+	// Snake case and map keys are accepted for known fields
+	for _, src := range []string{"create_time>2024-01-01", "labels.my_key:*", "version_aliases:current", "rotation.next_rotation_time<2030-01-01"} {
+		if _, err := filter.Parse(src, models.SecretFilterFields); err != nil {
+			t.Errorf("Parse(%q): unexpected error %v", src, err)
+		}
+	}
+}
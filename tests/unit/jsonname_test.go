@@ -0,0 +1,23 @@
+package unit
+
+import (
+	"testing"
+
+	"github.com/charlesgreen/gsm/internal/jsonname"
+)
+
+func TestJSONName_FromProto(t *testing.T) {
+	tests := map[string]string{
+		"labels":                      "labels",
+		"create_time":                 "createTime",
+		"version_destroy_ttl":         "versionDestroyTtl",
+		"rotation.next_rotation_time": "rotation.nextRotationTime",
+		"versionAliases":              "versionAliases",
+		"_secret__id_":                "secretId",
+	}
+	for name, want := range tests {
+		if got := jsonname.FromProto(name); got != want {
+			t.Errorf("Expected %q for %q, got %q", want, name, got)
+		}
+	}
+}
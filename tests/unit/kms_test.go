@@ -0,0 +1,141 @@
+package unit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/charlesgreen/gsm/internal/kms"
+)
+
+func TestRegistry_EncryptDecrypt(t *testing.T) {
+	const keyName = "projects/test-project/locations/global/keyRings/ring/cryptoKeys/key"
+
+	keys, err := kms.Parse(keyName)
+	if err != nil {
+		t.Fatalf("Failed to parse keys: %v", err)
+	}
+
+	ciphertext, keyVersion, err := keys.Encrypt(keyName, []byte("secret-data"))
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	if keyVersion != keyName+"/cryptoKeyVersions/1" {
+		t.Errorf("Expected the first key version, got %s", keyVersion)
+	}
+	if bytes.Contains(ciphertext, []byte("secret-data")) {
+		t.Error("Expected the ciphertext not to contain the plaintext")
+	}
+
+	// A new primary version encrypts new data while older data stays readable
+	if _, err := keys.CreateKeyVersion(keyName); err != nil {
+		t.Fatalf("Failed to create key version: %v", err)
+	}
+	if _, next, _ := keys.Encrypt(keyName, []byte("other")); next != keyName+"/cryptoKeyVersions/2" {
+		t.Errorf("Expected the new primary version, got %s", next)
+	}
+	plaintext, err := keys.Decrypt(keyVersion, ciphertext)
+	if err != nil || string(plaintext) != "secret-data" {
+		t.Fatalf("Expected to decrypt secret-data, got %q, %v", plaintext, err)
+	}
+
+	if _, err := keys.SetKeyVersionState(keyVersion, kms.Disabled); err != nil {
+		t.Fatalf("Failed to disable key version: %v", err)
+	}
+	var stateErr *kms.StateError
+	if _, err := keys.Decrypt(keyVersion, ciphertext); !errors.As(err, &stateErr) || stateErr.State != kms.Disabled {
+		t.Errorf("Expected a DISABLED state error, got %v", err)
+	}
+
+	if _, err := keys.SetKeyVersionState(keyVersion, kms.Destroyed); err != nil {
+		t.Fatalf("Failed to destroy key version: %v", err)
+	}
+	if _, err := keys.SetKeyVersionState(keyVersion, kms.Enabled); !errors.As(err, &stateErr) {
+		t.Errorf("Expected a destroyed key version to stay destroyed, got %v", err)
+	}
+
+	var notFound *kms.NotFoundError
+	if _, _, err := keys.Encrypt(keyName+"-missing", nil); !errors.As(err, &notFound) {
+		t.Errorf("Expected a not found error, got %v", err)
+	}
+	if _, err := kms.Parse("not-a-key"); !errors.Is(err, kms.ErrInvalidName) {
+		t.Errorf("Expected an invalid name error, got %v", err)
+	}
+}
+
+func TestRegistry_Open(t *testing.T) {
+	const keyName = "projects/test-project/locations/global/keyRings/ring/cryptoKeys/key"
+	path := filepath.Join(t.TempDir(), "kms.json")
+
+	keys, err := kms.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open keys: %v", err)
+	}
+	if !keys.Persistent() {
+		t.Error("Expected a registry opened from a file to be persistent")
+	}
+	if err := keys.Register(keyName); err != nil {
+		t.Fatalf("Failed to register key: %v", err)
+	}
+	ciphertext, first, _ := keys.Encrypt(keyName, []byte("secret-data"))
+	if _, err := keys.CreateKeyVersion(keyName); err != nil {
+		t.Fatalf("Failed to create key version: %v", err)
+	}
+	if _, err := keys.SetKeyVersionState(keyName+"/cryptoKeyVersions/2", kms.Disabled); err != nil {
+		t.Fatalf("Failed to disable key version: %v", err)
+	}
+
+	// Versions, their states and their material survive reopening the file
+	reopened, err := kms.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen keys: %v", err)
+	}
+	if err := reopened.Register(keyName); err != nil {
+		t.Errorf("Expected registering a saved key to succeed, got %v", err)
+	}
+	if version, err := reopened.GetKeyVersion(keyName + "/cryptoKeyVersions/2"); err != nil || version.State != kms.Disabled {
+		t.Errorf("Expected version 2 to stay disabled, got %+v, %v", version, err)
+	}
+	if plaintext, err := reopened.Decrypt(first, ciphertext); err != nil || string(plaintext) != "secret-data" {
+		t.Errorf("Expected to decrypt secret-data, got %q, %v", plaintext, err)
+	}
+
+	// The material is random rather than derived from the key name
+	for name, other := range map[string]func() (*kms.Registry, error){
+		"in memory":  func() (*kms.Registry, error) { return kms.Parse(keyName) },
+		"other file": func() (*kms.Registry, error) { return kms.Open(filepath.Join(t.TempDir(), "kms.json")) },
+	} {
+		registry, err := other()
+		if err == nil {
+			err = registry.Register(keyName)
+		}
+		if err != nil {
+			t.Fatalf("%s: failed to register key: %v", name, err)
+		}
+		if _, err := registry.Decrypt(first, ciphertext); !errors.Is(err, kms.ErrInvalidCiphertext) {
+			t.Errorf("%s: expected an invalid ciphertext error, got %v", name, err)
+		}
+	}
+	if data, _ := os.ReadFile(path); !bytes.Contains(data, []byte(`"material"`)) {
+		t.Errorf("Expected the file to hold the key material, got %s", data)
+	}
+
+	// A destroyed version loses its material
+	if _, err := reopened.SetKeyVersionState(first, kms.Destroyed); err != nil {
+		t.Fatalf("Failed to destroy key version: %v", err)
+	}
+	if reloaded, err := kms.Open(path); err != nil {
+		t.Errorf("Failed to reopen keys: %v", err)
+	} else if _, err := reloaded.Decrypt(first, ciphertext); err == nil {
+		t.Error("Expected a destroyed key version not to decrypt")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"keys":[{"name":"`+keyName+`","versions":[{"name":"`+first+`","state":"ENABLED"}]}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kms.Open(path); err == nil {
+		t.Error("Expected a key version without material to fail to load")
+	}
+}
@@ -0,0 +1,26 @@
+package unit
+
+import (
+	"testing"
+
+	"github.com/charlesgreen/gsm/internal/pagination"
+)
+
+func TestPageSize(t *testing.T) {
+	tests := []struct {
+		requested int
+		want      int
+	}{
+		{0, pagination.DefaultPageSize},
+		{-1, pagination.DefaultPageSize},
+		{25, 25},
+		{pagination.MaxPageSize, pagination.MaxPageSize},
+		{5000, pagination.MaxPageSize},
+	}
+
+	for _, tt := range tests {
+		if got := pagination.PageSize(tt.requested); got != tt.want {
+			t.Errorf("PageSize(%d) = %d, want %d", tt.requested, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/notify"
+	"github.com/charlesgreen/gsm/internal/scheduler"
+	"github.com/charlesgreen/gsm/internal/storage"
+)
+
+func TestScheduler_RotateSecrets(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	ctx := context.Background()
+
+	next := time.Now().Add(time.Hour)
+	secret := models.NewSecret("test-project", "test-secret", nil)
+	secret.Topics = []*models.Topic{{Name: "projects/test-project/topics/rotations"}}
+	secret.Rotation = &models.Rotation{NextRotationTime: &next}
+	_ = store.CreateSecret(ctx, "test-project", "test-secret", secret)
+
+	var events []notify.Event
+	sched := scheduler.New(time.Minute)
+	sched.Add("rotate secrets", scheduler.RotateSecrets(store, notify.Func(func(_ context.Context, event notify.Event) error {
+		events = append(events, event)
+		return nil
+	})))
+
+	sched.RunOnce(ctx, time.Now())
+	if len(events) != 0 {
+		t.Fatalf("Expected no events before the rotation time, got %v", events)
+	}
+
+	sched.RunOnce(ctx, next)
+	if len(events) != 1 || events[0].Type != notify.SecretRotate || events[0].Secret.Name != secret.Name {
+		t.Fatalf("Expected one SECRET_ROTATE event for %s, got %v", secret.Name, events)
+	}
+
+	sched.RunOnce(ctx, next.Add(time.Hour))
+	if len(events) != 1 {
+		t.Errorf("Expected a rotation without period to fire once, got %d events", len(events))
+	}
+}
+
+func TestScheduler_ExpireSecrets(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	ctx := context.Background()
+
+	expireTime := time.Now().Add(time.Hour)
+	secret := models.NewSecret("test-project", "test-secret", nil)
+	secret.ExpireTime = &expireTime
+	_ = store.CreateSecret(ctx, "test-project", "test-secret", secret)
+
+	var events []notify.Event
+	sched := scheduler.New(time.Minute)
+	sched.Add("expire secrets", scheduler.ExpireSecrets(store, notify.Func(func(_ context.Context, event notify.Event) error {
+		events = append(events, event)
+		return nil
+	})))
+	sched.RunOnce(ctx, expireTime)
+
+	if len(events) != 1 || events[0].Type != notify.SecretDelete {
+		t.Fatalf("Expected one SECRET_DELETE event, got %v", events)
+	}
+	purged, _ := store.PurgeExpiredSecrets(ctx, expireTime)
+	if len(purged) != 0 {
+		t.Errorf("Expected the scheduler to have purged the secret already, got %v", purged)
+	}
+}
+
+func TestScheduler_DestroyScheduledVersions(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	ctx := context.Background()
+
+	ttl := models.Duration(24 * time.Hour)
+	secret := models.NewSecret("test-project", "test-secret", nil)
+	secret.VersionDestroyTTL = &ttl
+	_ = store.CreateSecret(ctx, "test-project", "test-secret", secret)
+	_, _ = store.AddSecretVersion(ctx, "test-project", "test-secret", &models.SecretPayload{Data: []byte("v1")})
+
+	version, err := store.SetSecretVersionState(ctx, "test-project", "test-secret", "1", models.StateDestroyed, "")
+	if err != nil {
+		t.Fatalf("Failed to destroy version: %v", err)
+	}
+	deadline := *version.ScheduledDestroyTime
+
+	var events []notify.Event
+	sched := scheduler.New(time.Minute)
+	sched.Add("destroy versions", scheduler.DestroyScheduledVersions(store, notify.Func(func(_ context.Context, event notify.Event) error {
+		events = append(events, event)
+		return nil
+	})))
+
+	sched.RunOnce(ctx, deadline.Add(-time.Minute))
+	version, _ = store.GetSecretVersion(ctx, "test-project", "test-secret", "1")
+	if len(events) != 0 || version.State != models.StateDisabled {
+		t.Fatalf("Expected the version to stay disabled before its deadline, got %s and %v", version.State, events)
+	}
+
+	sched.RunOnce(ctx, deadline)
+	if len(events) != 1 || events[0].Type != notify.SecretVersionDestroy || events[0].Version.Name != version.Name {
+		t.Fatalf("Expected one SECRET_VERSION_DESTROY event for %s, got %v", version.Name, events)
+	}
+	version, _ = store.GetSecretVersion(ctx, "test-project", "test-secret", "1")
+	if version.State != models.StateDestroyed || version.ScheduledDestroyTime != nil {
+		t.Errorf("Expected a destroyed version without a schedule, got %+v", version)
+	}
+}
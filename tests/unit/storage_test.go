@@ -1,9 +1,20 @@
 package unit
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/charlesgreen/gsm/internal/filter"
+	"github.com/charlesgreen/gsm/internal/kms"
 	"github.com/charlesgreen/gsm/internal/models"
 	"github.com/charlesgreen/gsm/internal/storage"
 )
@@ -60,7 +71,7 @@ func TestMemoryStorage_ListSecrets(t *testing.T) {
 	_ = store.CreateSecret(ctx, "test-project", "secret1", secret1)
 	_ = store.CreateSecret(ctx, "test-project", "secret2", secret2)
 
-	secrets, nextToken, err := store.ListSecrets(ctx, "test-project", 10, "")
+	secrets, nextToken, _, err := store.ListSecrets(ctx, "test-project", nil, 10, "")
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -78,7 +89,7 @@ func TestMemoryStorage_AddSecretVersion(t *testing.T) {
 	store := storage.NewMemoryStorage()
 	ctx := context.Background()
 
-	_, err := store.AddSecretVersion(ctx, "test-project", "nonexistent", []byte("data"))
+	_, err := store.AddSecretVersion(ctx, "test-project", "nonexistent", &models.SecretPayload{Data: []byte("data")})
 	if err != storage.ErrSecretNotFound {
 		t.Fatalf("Expected ErrSecretNotFound, got %v", err)
 	}
@@ -86,7 +97,7 @@ func TestMemoryStorage_AddSecretVersion(t *testing.T) {
 	secret := models.NewSecret("test-project", "test-secret", nil)
 	_ = store.CreateSecret(ctx, "test-project", "test-secret", secret)
 
-	version, err := store.AddSecretVersion(ctx, "test-project", "test-secret", []byte("secret-data"))
+	version, err := store.AddSecretVersion(ctx, "test-project", "test-secret", &models.SecretPayload{Data: []byte("secret-data")})
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -95,7 +106,7 @@ func TestMemoryStorage_AddSecretVersion(t *testing.T) {
 		t.Fatalf("Expected version ID '1', got %s", version.GetVersionID())
 	}
 
-	data, err := store.AccessSecretVersion(ctx, "test-project", "test-secret", "1")
+	_, data, err := store.AccessSecretVersion(ctx, "test-project", "test-secret", "1")
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -104,3 +115,1040 @@ func TestMemoryStorage_AddSecretVersion(t *testing.T) {
 		t.Fatalf("Expected 'secret-data', got %s", string(data))
 	}
 }
+
+func TestMemoryStorage_SetSecretVersionState(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	ctx := context.Background()
+
+	secret := models.NewSecret("test-project", "test-secret", nil)
+	_ = store.CreateSecret(ctx, "test-project", "test-secret", secret)
+	_, _ = store.AddSecretVersion(ctx, "test-project", "test-secret", &models.SecretPayload{Data: []byte("secret-data")})
+
+	if _, err := store.SetSecretVersionState(ctx, "test-project", "test-secret", "1", models.StateDisabled, ""); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, _, err := store.AccessSecretVersion(ctx, "test-project", "test-secret", "1"); err != storage.ErrVersionDisabled {
+		t.Fatalf("Expected ErrVersionDisabled, got %v", err)
+	}
+
+	version, err := store.SetSecretVersionState(ctx, "test-project", "test-secret", "latest", models.StateDestroyed, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if version.Data != nil {
+		t.Fatalf("Expected destroyed version data to be wiped")
+	}
+	if _, _, err := store.AccessSecretVersion(ctx, "test-project", "test-secret", "1"); err != storage.ErrVersionDestroyed {
+		t.Fatalf("Expected ErrVersionDestroyed, got %v", err)
+	}
+	if _, err := store.SetSecretVersionState(ctx, "test-project", "test-secret", "1", models.StateEnabled, ""); err != storage.ErrVersionDestroyed {
+		t.Fatalf("Expected ErrVersionDestroyed, got %v", err)
+	}
+}
+
+func TestMemoryStorage_VersionAliases(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	ctx := context.Background()
+
+	secret := models.NewSecret("test-project", "test-secret", nil)
+	_ = store.CreateSecret(ctx, "test-project", "test-secret", secret)
+	_, _ = store.AddSecretVersion(ctx, "test-project", "test-secret", &models.SecretPayload{Data: []byte("secret-data")})
+
+	update := &models.Secret{VersionAliases: map[string]models.Int64{"current": 2}}
+	_, err := store.UpdateSecret(ctx, "test-project", "test-secret", update, []string{"versionAliases"})
+	var aliasErr *storage.VersionAliasError
+	if !errors.As(err, &aliasErr) || aliasErr.Alias != "current" {
+		t.Fatalf("Expected VersionAliasError for current, got %v", err)
+	}
+
+	update.VersionAliases["current"] = 1
+	if _, err := store.UpdateSecret(ctx, "test-project", "test-secret", update, []string{"versionAliases"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	version, err := store.GetSecretVersion(ctx, "test-project", "test-secret", "current")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if version.GetVersionID() != "1" {
+		t.Errorf("Expected alias to resolve to version 1, got %s", version.GetVersionID())
+	}
+}
+
+func TestPersistentStorage_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	store, _ := storage.NewPersistentStorage(path)
+	secret := models.NewSecret("test-project", "test-secret", map[string]string{"env": "test"})
+	secret.Annotations = map[string]string{"owner": "payments"}
+	if err := store.CreateSecret(ctx, "test-project", "test-secret", secret); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	reloaded, _ := storage.NewPersistentStorage(path)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	got, err := reloaded.GetSecret(ctx, "test-project", "test-secret")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got.Labels["env"] != "test" || got.Annotations["owner"] != "payments" {
+		t.Errorf("Expected labels and annotations to persist, got %+v", got)
+	}
+}
+
+func TestMemoryStorage_Isolation(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	ctx := context.Background()
+
+	secret := models.NewSecret("test-project", "test-secret", map[string]string{"env": "test"})
+	if err := store.CreateSecret(ctx, "test-project", "test-secret", secret); err != nil {
+		t.Fatalf("Failed to create secret: %v", err)
+	}
+	payload := &models.SecretPayload{Data: []byte("v1")}
+	added, err := store.AddSecretVersion(ctx, "test-project", "test-secret", payload)
+	if err != nil {
+		t.Fatalf("Failed to add version: %v", err)
+	}
+
+	// Changing what was passed in or handed back must not reach the store
+	secret.Labels["env"] = "created"
+	payload.Data[0] = 'x'
+	added.State = models.StateDestroyed
+	retrieved, _ := store.GetSecret(ctx, "test-project", "test-secret")
+	retrieved.Labels["env"] = "retrieved"
+	listed, _, _, _ := store.ListSecrets(ctx, "test-project", nil, 10, "")
+	listed[0].Labels["env"] = "listed"
+	version, _ := store.GetSecretVersion(ctx, "test-project", "test-secret", "1")
+	version.Data[0] = 'y'
+
+	got, _ := store.GetSecret(ctx, "test-project", "test-secret")
+	if got.Labels["env"] != "test" {
+		t.Errorf("Expected label env=test, got %v", got.Labels)
+	}
+	_, data, err := store.AccessSecretVersion(ctx, "test-project", "test-secret", "1")
+	if err != nil || string(data) != "v1" {
+		t.Errorf("Expected enabled version with data v1, got %q, %v", data, err)
+	}
+}
+
+func TestPersistentStorage_ConcurrentSave(t *testing.T) {
+	ctx := context.Background()
+	store, _ := storage.NewPersistentStorage(filepath.Join(t.TempDir(), "storage.json"))
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			secretID := fmt.Sprintf("secret-%d", i)
+			if err := store.CreateSecret(ctx, "test-project", secretID, models.NewSecret("test-project", secretID, nil)); err != nil {
+				t.Errorf("Failed to create secret: %v", err)
+				return
+			}
+			for range 5 {
+				if _, err := store.AddSecretVersion(ctx, "test-project", secretID, &models.SecretPayload{Data: []byte("data")}); err != nil {
+					t.Errorf("Failed to add version: %v", err)
+				}
+				labels := &models.Secret{Labels: map[string]string{"env": "test"}}
+				if _, err := store.UpdateSecret(ctx, "test-project", secretID, labels, []string{"labels"}); err != nil {
+					t.Errorf("Failed to update secret: %v", err)
+				}
+				_, _, _, _ = store.ListSecrets(ctx, "test-project", nil, 100, "")
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, _, total, _ := store.ListSecrets(ctx, "test-project", nil, 100, "")
+	if total != 8 {
+		t.Errorf("Expected 8 secrets, got %d", total)
+	}
+}
+
+func TestPersistentStorage_LoadLegacyFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+	legacy := `{
+  "secrets": {
+    "test-project/test-secret": {
+      "name": "projects/test-project/secrets/test-secret",
+      "createTime": "2025-08-14T00:00:00Z",
+      "labels": {"env": "test"},
+      "replication": {"automatic": {}},
+      "etag": "\"abc\""
+    }
+  },
+  "timestamp": "2025-08-14T00:00:00Z",
+  "version": "1.0.0"
+}`
+	if err := os.WriteFile(path, []byte(legacy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, _ := storage.NewPersistentStorage(path)
+	if err := store.Load(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	got, err := store.GetSecret(ctx, "test-project", "test-secret")
+	if err != nil || got.Labels["env"] != "test" || got.Replication.Automatic == nil {
+		t.Fatalf("Expected the legacy secret to load, got %+v, %v", got, err)
+	}
+
+	// Legacy files held no versions, so new ones start from the first
+	version, err := store.AddSecretVersion(ctx, "test-project", "test-secret", &models.SecretPayload{Data: []byte("v1")})
+	if err != nil || version.GetVersionID() != "1" {
+		t.Fatalf("Expected version 1, got %+v, %v", version, err)
+	}
+}
+
+func TestPersistentStorage_FlushDelay(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "storage.json")
+
+	store, _ := storage.NewPersistentStorage(path)
+	store.SetFlushDelay(time.Hour)
+	for i := range 10 {
+		secretID := fmt.Sprintf("secret-%d", i)
+		if err := store.CreateSecret(ctx, "test-project", secretID, models.NewSecret("test-project", secretID, nil)); err != nil {
+			t.Fatalf("Failed to create secret: %v", err)
+		}
+	}
+
+	// Changes wait for the flush rather than being written one by one
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected no storage file before flushing, got %v", err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	reloaded, _ := storage.NewPersistentStorage(path)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, _, total, _ := reloaded.ListSecrets(ctx, "test-project", nil, 100, ""); total != 10 {
+		t.Errorf("Expected 10 secrets after closing, got %d", total)
+	}
+
+	// Only the storage file is left behind, not the temporary files it was written through
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the storage file, got %v", entries)
+	}
+}
+
+func TestPersistentStorage_BackgroundFlush(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	store, _ := storage.NewPersistentStorage(path)
+	store.SetFlushDelay(10 * time.Millisecond)
+	if err := store.CreateSecret(ctx, "test-project", "test-secret", models.NewSecret("test-project", "test-secret", nil)); err != nil {
+		t.Fatalf("Failed to create secret: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the storage file to be written by a background flush")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := store.FlushError(); err != nil {
+		t.Errorf("Expected no flush error, got %v", err)
+	}
+}
+
+func TestPersistentStorage_FlushError(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "missing", "storage.json")
+
+	store, _ := storage.NewPersistentStorage(path)
+	store.SetFlushDelay(time.Hour)
+	if err := store.CreateSecret(ctx, "test-project", "test-secret", models.NewSecret("test-project", "test-secret", nil)); err != nil {
+		t.Fatalf("Expected the change to be accepted before flushing, got %v", err)
+	}
+	if err := store.FlushError(); err != nil {
+		t.Fatalf("Expected no flush error before flushing, got %v", err)
+	}
+
+	if err := store.Flush(); err == nil {
+		t.Fatal("Expected flushing into a missing directory to fail")
+	}
+	if err := store.FlushError(); err == nil {
+		t.Error("Expected the failed flush to be reported")
+	}
+}
+
+func TestPersistentStorage_FailedSaveRollsBack(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	store, _ := storage.NewPersistentStorage(filepath.Join(dir, "storage.json"))
+	expireTime := time.Now().Add(time.Hour)
+	expiring := models.NewSecret("test-project", "expiring", nil)
+	expiring.ExpireTime = &expireTime
+	for _, secret := range []*models.Secret{models.NewSecret("test-project", "test-secret", nil), expiring} {
+		if err := store.CreateSecret(ctx, "test-project", secret.GetSecretID(), secret); err != nil {
+			t.Fatalf("Failed to create secret: %v", err)
+		}
+	}
+	before, _ := store.GetSecret(ctx, "test-project", "test-secret")
+
+	// Every save fails while the directory is missing
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("Failed to remove directory: %v", err)
+	}
+	if _, err := store.AddSecretVersion(ctx, "test-project", "test-secret", &models.SecretPayload{Data: []byte("lost")}); err == nil {
+		t.Fatal("Expected adding a version to fail when it cannot be saved")
+	}
+	if _, err := store.UpdateSecret(ctx, "test-project", "test-secret", &models.Secret{Labels: map[string]string{"env": "prod"}}, []string{"labels"}); err == nil {
+		t.Fatal("Expected updating a secret to fail when it cannot be saved")
+	}
+	if _, err := store.SetIamPolicy(ctx, "test-project", "test-secret", &models.Policy{Bindings: []*models.Binding{{Role: "roles/owner", Members: []string{"user:a@example.com"}}}}); err == nil {
+		t.Fatal("Expected setting a policy to fail when it cannot be saved")
+	}
+	if err := store.DeleteSecret(ctx, "test-project", "test-secret", ""); err == nil {
+		t.Fatal("Expected deleting a secret to fail when it cannot be saved")
+	}
+	if purged, err := store.PurgeExpiredSecrets(ctx, expireTime); err == nil || purged != nil {
+		t.Fatalf("Expected purging to fail when it cannot be saved, got %v, %v", purged, err)
+	}
+
+	// None of the failed changes are left in memory
+	after, err := store.GetSecret(ctx, "test-project", "test-secret")
+	if err != nil {
+		t.Fatalf("Expected the secret to remain, got %v", err)
+	}
+	if after.Etag != before.Etag || after.VersionCount != 0 || len(after.Labels) != 0 {
+		t.Errorf("Expected the secret to be unchanged, got %+v", after)
+	}
+	if policy, _ := store.GetIamPolicy(ctx, "test-project", "test-secret"); len(policy.Bindings) != 0 {
+		t.Errorf("Expected no policy, got %+v", policy)
+	}
+
+	// Once saves succeed again, the next version reuses the ID of the lost one
+	// and the purge that failed is retried
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	version, err := store.AddSecretVersion(ctx, "test-project", "test-secret", &models.SecretPayload{Data: []byte("kept")})
+	if err != nil || version.GetVersionID() != "1" {
+		t.Fatalf("Expected version 1, got %+v, %v", version, err)
+	}
+	if purged, err := store.PurgeExpiredSecrets(ctx, expireTime); err != nil || len(purged) != 1 {
+		t.Errorf("Expected the expired secret to be purged, got %v, %v", purged, err)
+	}
+}
+
+func TestJournalStorage_Replay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	store, _ := storage.NewJournalStorage(path)
+	if err := store.Load(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, secretID := range []string{"kept", "deleted"} {
+		if err := store.CreateSecret(ctx, "test-project", secretID, models.NewSecret("test-project", secretID, nil)); err != nil {
+			t.Fatalf("Failed to create secret: %v", err)
+		}
+	}
+	for _, data := range []string{"v1", "v2", "v3"} {
+		if _, err := store.AddSecretVersion(ctx, "test-project", "kept", &models.SecretPayload{Data: []byte(data)}); err != nil {
+			t.Fatalf("Failed to add version: %v", err)
+		}
+	}
+	if _, err := store.SetSecretVersionState(ctx, "test-project", "kept", "1", models.StateDisabled, ""); err != nil {
+		t.Fatalf("Failed to disable version: %v", err)
+	}
+	if _, err := store.SetSecretVersionState(ctx, "test-project", "kept", "2", models.StateDestroyed, ""); err != nil {
+		t.Fatalf("Failed to destroy version: %v", err)
+	}
+	labels := &models.Secret{Labels: map[string]string{"env": "test"}}
+	if _, err := store.UpdateSecret(ctx, "test-project", "kept", labels, []string{"labels"}); err != nil {
+		t.Fatalf("Failed to update secret: %v", err)
+	}
+	policy := &models.Policy{Bindings: []*models.Binding{{Role: "roles/secretmanager.secretAccessor", Members: []string{"user:dev@example.com"}}}}
+	if _, err := store.SetIamPolicy(ctx, "test-project", "kept", policy); err != nil {
+		t.Fatalf("Failed to set policy: %v", err)
+	}
+	if err := store.DeleteSecret(ctx, "test-project", "deleted", ""); err != nil {
+		t.Fatalf("Failed to delete secret: %v", err)
+	}
+	want, _ := store.GetSecret(ctx, "test-project", "kept")
+
+	// Every change is in the journal, one line each, before any snapshot exists
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected no snapshot before compacting, got %v", err)
+	}
+	journal, err := os.ReadFile(path + ".journal")
+	if err != nil {
+		t.Fatalf("Failed to read journal: %v", err)
+	}
+	if lines := bytes.Count(journal, []byte("\n")); lines != 10 {
+		t.Errorf("Expected 10 journal records, got %d", lines)
+	}
+
+	// Replaying is repeatable, as when the journal outlives a compaction
+	for range 2 {
+		reloaded, _ := storage.NewJournalStorage(path)
+		if err := reloaded.Load(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		got, err := reloaded.GetSecret(ctx, "test-project", "kept")
+		if err != nil || got.Etag != want.Etag || got.Labels["env"] != "test" || got.VersionCount != 3 {
+			t.Fatalf("Expected %+v, got %+v, %v", want, got, err)
+		}
+		if _, err := reloaded.GetSecret(ctx, "test-project", "deleted"); err != storage.ErrSecretNotFound {
+			t.Errorf("Expected deleted secret to stay deleted, got %v", err)
+		}
+		for versionID, wantErr := range map[string]error{"1": storage.ErrVersionDisabled, "2": storage.ErrVersionDestroyed, "3": nil} {
+			if _, _, err := reloaded.AccessSecretVersion(ctx, "test-project", "kept", versionID); err != wantErr {
+				t.Errorf("Expected version %s to fail with %v, got %v", versionID, wantErr, err)
+			}
+		}
+		gotPolicy, _ := reloaded.GetIamPolicy(ctx, "test-project", "kept")
+		if len(gotPolicy.Bindings) != 1 {
+			t.Errorf("Expected the policy to be replayed, got %+v", gotPolicy)
+		}
+		if err := reloaded.Compact(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if err := os.WriteFile(path+".journal", journal, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestJournalStorage_IncompleteRecord(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	store, _ := storage.NewJournalStorage(path)
+	if err := store.CreateSecret(ctx, "test-project", "test-secret", models.NewSecret("test-project", "test-secret", nil)); err != nil {
+		t.Fatalf("Failed to create secret: %v", err)
+	}
+
+	// A crash while appending leaves part of a record at the end
+	file, err := os.OpenFile(path+".journal", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.WriteString(`{"time":"2025-08-14T00:00:00Z","op":"DeleteSec`)
+	_ = file.Close()
+
+	reloaded, _ := storage.NewJournalStorage(path)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Expected the incomplete record to be discarded, got %v", err)
+	}
+	if _, err := reloaded.GetSecret(ctx, "test-project", "test-secret"); err != nil {
+		t.Errorf("Expected the secret to survive, got %v", err)
+	}
+
+	// New records follow the last complete one
+	if _, err := reloaded.AddSecretVersion(ctx, "test-project", "test-secret", &models.SecretPayload{Data: []byte("v1")}); err != nil {
+		t.Fatalf("Failed to add version: %v", err)
+	}
+	again, _ := storage.NewJournalStorage(path)
+	if err := again.Load(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, data, err := again.AccessSecretVersion(ctx, "test-project", "test-secret", "1"); err != nil || string(data) != "v1" {
+		t.Errorf("Expected version 1 with data v1, got %q, %v", data, err)
+	}
+
+	// Corruption before the end is not a crash and is reported
+	journal, _ := os.ReadFile(path + ".journal")
+	if err := os.WriteFile(path+".journal", append([]byte("{not json\n"), journal...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	corrupt, _ := storage.NewJournalStorage(path)
+	if err := corrupt.Load(); err == nil {
+		t.Error("Expected a corrupt journal to fail to load")
+	}
+}
+
+func TestJournalStorage_FailedAppendRollsBack(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	store, _ := storage.NewJournalStorage(filepath.Join(dir, "storage.json"))
+	next := time.Now().Add(time.Hour)
+	rotating := models.NewSecret("test-project", "rotating", nil)
+	rotating.Topics = []*models.Topic{{Name: "projects/test-project/topics/rotations"}}
+	rotating.Rotation = &models.Rotation{NextRotationTime: &next}
+	for _, secret := range []*models.Secret{models.NewSecret("test-project", "test-secret", nil), rotating} {
+		if err := store.CreateSecret(ctx, "test-project", secret.GetSecretID(), secret); err != nil {
+			t.Fatalf("Failed to create secret: %v", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	before, _ := store.GetSecret(ctx, "test-project", "test-secret")
+
+	// The journal cannot be reopened while the directory is missing
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("Failed to remove directory: %v", err)
+	}
+	if _, err := store.AddSecretVersion(ctx, "test-project", "test-secret", &models.SecretPayload{Data: []byte("lost")}); err == nil {
+		t.Fatal("Expected adding a version to fail when it cannot be recorded")
+	}
+	if _, err := store.UpdateSecret(ctx, "test-project", "test-secret", &models.Secret{Labels: map[string]string{"env": "prod"}}, []string{"labels"}); err == nil {
+		t.Fatal("Expected updating a secret to fail when it cannot be recorded")
+	}
+	if err := store.DeleteSecret(ctx, "test-project", "test-secret", ""); err == nil {
+		t.Fatal("Expected deleting a secret to fail when it cannot be recorded")
+	}
+	if rotated, err := store.RotateSecrets(ctx, next); err == nil || rotated != nil {
+		t.Fatalf("Expected rotating to fail when it cannot be recorded, got %v, %v", rotated, err)
+	}
+
+	// None of the failed changes are left in memory
+	after, err := store.GetSecret(ctx, "test-project", "test-secret")
+	if err != nil {
+		t.Fatalf("Expected the secret to remain, got %v", err)
+	}
+	if after.Etag != before.Etag || after.VersionCount != 0 || len(after.Labels) != 0 {
+		t.Errorf("Expected the secret to be unchanged, got %+v", after)
+	}
+
+	// Once records can be appended again, the rotation that failed is retried
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if rotated, err := store.RotateSecrets(ctx, next); err != nil || len(rotated) != 1 {
+		t.Errorf("Expected the due secret to rotate, got %v, %v", rotated, err)
+	}
+	version, err := store.AddSecretVersion(ctx, "test-project", "test-secret", &models.SecretPayload{Data: []byte("kept")})
+	if err != nil || version.GetVersionID() != "1" {
+		t.Fatalf("Expected version 1, got %+v, %v", version, err)
+	}
+}
+
+func TestJournalStorage_Compaction(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	store, _ := storage.NewJournalStorage(path)
+	store.SetCompactThreshold(5)
+	if err := store.Load(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for i := range 12 {
+		secretID := fmt.Sprintf("secret-%d", i)
+		if err := store.CreateSecret(ctx, "test-project", secretID, models.NewSecret("test-project", secretID, nil)); err != nil {
+			t.Fatalf("Failed to create secret: %v", err)
+		}
+	}
+
+	// Two compactions moved ten records into the snapshot, leaving two
+	journal, _ := os.ReadFile(path + ".journal")
+	if lines := bytes.Count(journal, []byte("\n")); lines != 2 {
+		t.Errorf("Expected 2 journal records after compacting, got %d", lines)
+	}
+	snapshot, _ := storage.NewPersistentStorage(path)
+	if err := snapshot.Load(); err != nil {
+		t.Fatalf("Expected the snapshot to be a storage file, got %v", err)
+	}
+	if _, _, total, _ := snapshot.ListSecrets(ctx, "test-project", nil, 100, ""); total != 10 {
+		t.Errorf("Expected 10 secrets in the snapshot, got %d", total)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if info, err := os.Stat(path + ".journal"); err != nil || info.Size() != 0 {
+		t.Errorf("Expected an empty journal after closing, got %v, %v", info, err)
+	}
+	reloaded, _ := storage.NewJournalStorage(path)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, _, total, _ := reloaded.ListSecrets(ctx, "test-project", nil, 100, ""); total != 12 {
+		t.Errorf("Expected 12 secrets, got %d", total)
+	}
+}
+
+// writeStorageKey writes a key file of 32 bytes b and returns its configuration.
+func writeStorageKey(t *testing.T, b byte) storage.KeyConfig {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "storage.key")
+	if err := os.WriteFile(path, bytes.Repeat([]byte{b}, 32), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return storage.KeyConfig{KeyFile: path}
+}
+
+func TestPersistentStorage_Encryption(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+	keys := kms.NewRegistry()
+	key, err := writeStorageKey(t, 1).Key(keys)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	store, _ := storage.NewPersistentStorage(path)
+	store.SetEncryptionKey(key)
+	if err := store.CreateSecret(ctx, "test-project", "test-secret", models.NewSecret("test-project", "test-secret", nil)); err != nil {
+		t.Fatalf("Failed to create secret: %v", err)
+	}
+	if data, _ := os.ReadFile(path); bytes.Contains(data, []byte("test-secret")) {
+		t.Errorf("Expected the storage file to be encrypted, got %s", data)
+	}
+
+	otherKey, _ := writeStorageKey(t, 2).Key(keys)
+	passphrase, _ := storage.KeyConfig{Passphrase: "passphrase"}.Key(keys)
+	for name, test := range map[string]struct {
+		key  storage.EncryptionKey
+		want error
+	}{
+		"same key":   {key, nil},
+		"no key":     {nil, storage.ErrEncrypted},
+		"other key":  {otherKey, storage.ErrWrongKey},
+		"passphrase": {passphrase, storage.ErrWrongKey},
+	} {
+		reloaded, _ := storage.NewPersistentStorage(path)
+		reloaded.SetEncryptionKey(test.key)
+		if err := reloaded.Load(); !errors.Is(err, test.want) {
+			t.Errorf("%s: expected %v, got %v", name, test.want, err)
+		}
+	}
+}
+
+func TestStorage_Rekey(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+	kmsConfig := storage.KeyConfig{KMSKey: "projects/p/locations/global/keyRings/r/cryptoKeys/storage"}
+
+	// Keys of a registry that is not kept in a file have no material of their own
+	if _, err := kmsConfig.Key(kms.NewRegistry()); err == nil {
+		t.Error("Expected a KMS key to need its registry kept in a file")
+	}
+
+	keys, err := kms.Open(filepath.Join(t.TempDir(), "kms.json"))
+	if err != nil {
+		t.Fatalf("Failed to open KMS keys: %v", err)
+	}
+	keyFile, _ := writeStorageKey(t, 1).Key(keys)
+	kmsKey, err := kmsConfig.Key(keys)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// A plaintext snapshot and journal, as a store that predates encryption
+	store, _ := storage.NewJournalStorage(path)
+	_ = store.CreateSecret(ctx, "test-project", "compacted", models.NewSecret("test-project", "compacted", nil))
+	_ = store.Compact()
+	_ = store.CreateSecret(ctx, "test-project", "journaled", models.NewSecret("test-project", "journaled", nil))
+
+	load := func(key storage.EncryptionKey) error {
+		reloaded, _ := storage.NewJournalStorage(path)
+		reloaded.SetKeyRegistry(keys)
+		reloaded.SetEncryptionKey(key)
+		if err := reloaded.Load(); err != nil {
+			return err
+		}
+		if _, _, total, _ := reloaded.ListSecrets(ctx, "test-project", nil, 100, ""); total != 2 {
+			t.Errorf("Expected 2 secrets, got %d", total)
+		}
+		return nil
+	}
+
+	for _, step := range []struct{ from, to storage.EncryptionKey }{
+		{nil, keyFile},
+		{keyFile, kmsKey},
+		{keyFile, kmsKey}, // rerunning an interrupted rekey
+		{kmsKey, nil},
+	} {
+		if err := storage.Rekey(path, step.from, step.to); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if err := load(step.to); err != nil {
+			t.Fatalf("Expected the rekeyed store to load, got %v", err)
+		}
+		if step.to == nil {
+			continue
+		}
+		for _, file := range []string{path, path + ".journal"} {
+			if data, _ := os.ReadFile(file); bytes.Contains(data, []byte("test-project")) {
+				t.Errorf("Expected %s to be encrypted, got %s", file, data)
+			}
+		}
+		if err := load(step.from); err == nil {
+			t.Error("Expected the old key to no longer load the store")
+		}
+	}
+
+	// Revoking the KMS key makes a store encrypted with it unreadable
+	if err := storage.Rekey(path, nil, kmsKey); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, _ = keys.SetKeyVersionState("projects/p/locations/global/keyRings/r/cryptoKeys/storage/cryptoKeyVersions/1", kms.Disabled)
+	var stateErr *kms.StateError
+	if err := load(kmsKey); !errors.As(err, &stateErr) {
+		t.Errorf("Expected a key state error, got %v", err)
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestStorageSchema_Migrations loads a fixture of every schema version the
+// storage file has had. Older ones must be backed up and upgraded to match
+// their golden file; rerun with -update after changing a migration on purpose.
+func TestStorageSchema_Migrations(t *testing.T) {
+	ctx := context.Background()
+	checks := map[string]func(t *testing.T, store *storage.PersistentStorage){
+		"1.0.0": func(t *testing.T, store *storage.PersistentStorage) {
+			secret, err := store.GetSecret(ctx, "test-project", "api-key")
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if secret.Labels["env"] != "prod" || secret.Annotations["owner"] != "payments" ||
+				secret.Replication.Automatic.CustomerManagedEncryption.KmsKeyName != "projects/test-project/locations/global/keyRings/ring/cryptoKeys/key" ||
+				len(secret.Topics) != 1 || time.Duration(*secret.Rotation.RotationPeriod) != 24*time.Hour ||
+				secret.ExpireTime == nil || time.Duration(*secret.VersionDestroyTTL) != time.Hour {
+				t.Errorf("Expected the secret's settings to survive the upgrade, got %+v", secret)
+			}
+			// 1.0.0 kept no versions, so aliases to them are dropped
+			if len(secret.VersionAliases) != 0 {
+				t.Errorf("Expected no version aliases, got %v", secret.VersionAliases)
+			}
+
+			replicated, err := store.GetSecret(ctx, "test-project", "replicated")
+			if err != nil || len(replicated.Replication.UserManaged.Replicas) != 2 ||
+				replicated.Replication.UserManaged.Replicas[1].CustomerManagedEncryption == nil {
+				t.Errorf("Expected two user-managed replicas, got %+v, %v", replicated, err)
+			}
+			regional, err := store.GetSecret(ctx, "test-project/locations/us-central1", "regional")
+			if err != nil || regional.Replication.Automatic != nil || regional.Replication.UserManaged != nil {
+				t.Errorf("Expected a regional secret without replication, got %+v, %v", regional, err)
+			}
+
+			policy, err := store.GetIamPolicy(ctx, "test-project", "")
+			if err != nil || len(policy.Bindings) != 1 || policy.Etag != "BwYAAAAAAAE=" {
+				t.Errorf("Expected the project policy, got %+v, %v", policy, err)
+			}
+
+			version, err := store.AddSecretVersion(ctx, "test-project/locations/us-central1", "regional", &models.SecretPayload{Data: []byte("v1")})
+			if err != nil || version.GetVersionID() != "1" {
+				t.Errorf("Expected version 1, got %+v, %v", version, err)
+			}
+		},
+		// The file the first release wrote, before 1.0.0 gained policies and
+		// the newer secret fields
+		"1.0.0-baseline": func(t *testing.T, store *storage.PersistentStorage) {
+			secret, err := store.GetSecret(ctx, "test-project", "api-key")
+			if err != nil || secret.Labels["env"] != "prod" || secret.Replication.Automatic == nil ||
+				secret.Etag != `"1755163800000000000"` || !secret.CreateTime.Equal(time.Date(2025, 8, 14, 9, 30, 0, 0, time.UTC)) {
+				t.Errorf("Expected the secret to survive the upgrade, got %+v, %v", secret, err)
+			}
+			replicated, err := store.GetSecret(ctx, "test-project", "replicated")
+			if err != nil || len(replicated.Replication.UserManaged.Replicas) != 2 ||
+				replicated.Replication.UserManaged.Replicas[1].CustomerManagedEncryption == nil {
+				t.Errorf("Expected two user-managed replicas, got %+v, %v", replicated, err)
+			}
+			if policy, err := store.GetIamPolicy(ctx, "test-project", ""); err != nil || len(policy.Bindings) != 0 {
+				t.Errorf("Expected no project policy, got %+v, %v", policy, err)
+			}
+
+			version, err := store.AddSecretVersion(ctx, "test-project", "api-key", &models.SecretPayload{Data: []byte("v1")})
+			if err != nil || version.GetVersionID() != "1" {
+				t.Errorf("Expected version 1, got %+v, %v", version, err)
+			}
+		},
+		"2.0.0": func(t *testing.T, store *storage.PersistentStorage) {
+			_, data, err := store.AccessSecretVersion(ctx, "test-project", "db-password", "current")
+			if err != nil || string(data) != "hunter2" {
+				t.Errorf("Expected the aliased payload, got %q, %v", data, err)
+			}
+			if _, _, err := store.AccessSecretVersion(ctx, "test-project", "db-password", "2"); !errors.Is(err, storage.ErrVersionDisabled) {
+				t.Errorf("Expected version 2 to be disabled, got %v", err)
+			}
+			if _, _, err := store.AccessSecretVersion(ctx, "test-project", "db-password", "3"); !errors.Is(err, storage.ErrVersionDestroyed) {
+				t.Errorf("Expected version 3 to be destroyed, got %v", err)
+			}
+			_, data, err = store.AccessSecretVersion(ctx, "test-project/locations/us-central1", "regional", "latest")
+			if err != nil || string(data) != "us-central1-token" {
+				t.Errorf("Expected the regional payload, got %q, %v", data, err)
+			}
+
+			version, err := store.AddSecretVersion(ctx, "test-project", "db-password", &models.SecretPayload{Data: []byte("v4")})
+			if err != nil || version.GetVersionID() != "4" {
+				t.Errorf("Expected version 4, got %+v, %v", version, err)
+			}
+		},
+	}
+
+	for name, check := range checks {
+		t.Run(name, func(t *testing.T) {
+			// Fixtures are named for their schema version, with a suffix when
+			// one version has several shapes
+			version, _, _ := strings.Cut(name, "-")
+			fixture, err := os.ReadFile(filepath.Join("testdata", "storage", "v"+name+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "storage.json")
+			if err := os.WriteFile(path, fixture, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			store, _ := storage.NewPersistentStorage(path)
+			if err := store.Load(); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			written, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backup, backupErr := os.ReadFile(path + ".v" + version + ".bak")
+
+			if version == storage.SchemaVersion {
+				if !bytes.Equal(written, fixture) || !os.IsNotExist(backupErr) {
+					t.Errorf("Expected a current file to be left alone, backup error %v", backupErr)
+				}
+			} else {
+				if !bytes.Equal(backup, fixture) {
+					t.Errorf("Expected a backup of the original file, got %v", backupErr)
+				}
+				golden := filepath.Join("testdata", "storage", "v"+name+".upgraded.json")
+				if *update {
+					if err := os.WriteFile(golden, written, 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(written, want) {
+					t.Errorf("Expected the upgraded file to match %s, got\n%s", golden, written)
+				}
+			}
+			check(t, store)
+		})
+	}
+}
+
+func TestStorageSchema_NewerVersion(t *testing.T) {
+	newer := []byte(`{"secrets": {}, "timestamp": "2030-01-01T00:00:00Z", "version": "3.0.0"}`)
+	backends := map[string]func(path string) interface{ Load() error }{
+		"file": func(path string) interface{ Load() error } {
+			store, _ := storage.NewPersistentStorage(path)
+			return store
+		},
+		"journal": func(path string) interface{ Load() error } {
+			store, _ := storage.NewJournalStorage(path)
+			return store
+		},
+	}
+
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "storage.json")
+			if err := os.WriteFile(path, newer, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			err := open(path).Load()
+			var versionErr *storage.SchemaVersionError
+			if !errors.As(err, &versionErr) || versionErr.Version != "3.0.0" {
+				t.Fatalf("Expected a schema version error, got %v", err)
+			}
+			if !strings.Contains(err.Error(), "upgrade the emulator") {
+				t.Errorf("Expected the error to suggest upgrading, got %v", err)
+			}
+
+			// A file the emulator cannot read is never rewritten
+			if data, _ := os.ReadFile(path); !bytes.Equal(data, newer) {
+				t.Errorf("Expected the file to be untouched, got %s", data)
+			}
+			if matches, _ := filepath.Glob(path + ".v*.bak"); len(matches) != 0 {
+				t.Errorf("Expected no backup, got %v", matches)
+			}
+		})
+	}
+}
+
+func TestStorageSchema_JournalRecords(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	// Records from before they carried a schema version are in 2.0.0
+	legacy := `{"time":"2025-08-14T00:00:00Z","op":"CreateSecret","key":"test-project/legacy","secret":{"name":"projects/test-project/secrets/legacy","createTime":"2025-08-14T00:00:00Z","etag":"\"1\"","replication":{"automatic":true},"versionCount":0}}` + "\n"
+	if err := os.WriteFile(path+".journal", []byte(legacy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, _ := storage.NewJournalStorage(path)
+	if err := store.Load(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := store.GetSecret(ctx, "test-project", "legacy"); err != nil {
+		t.Errorf("Expected the legacy record to replay, got %v", err)
+	}
+	if err := store.CreateSecret(ctx, "test-project", "current", models.NewSecret("test-project", "current", nil)); err != nil {
+		t.Fatalf("Failed to create secret: %v", err)
+	}
+	journal, _ := os.ReadFile(path + ".journal")
+	if !bytes.Contains(journal, []byte(`"schema":"`+storage.SchemaVersion+`"`)) {
+		t.Errorf("Expected new records to carry the schema version, got %s", journal)
+	}
+
+	// A record a newer release wrote is refused rather than misread
+	newer := strings.Replace(legacy, `{"time"`, `{"schema":"3.0.0","time"`, 1)
+	if err := os.WriteFile(path+".journal", append(journal, newer...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, _ := storage.NewJournalStorage(path)
+	err := reloaded.Load()
+	var versionErr *storage.SchemaVersionError
+	if !errors.As(err, &versionErr) || versionErr.Version != "3.0.0" {
+		t.Fatalf("Expected a schema version error, got %v", err)
+	}
+	if !storage.IsFatalLoadError(err, nil) {
+		t.Errorf("Expected a newer schema to be fatal, got %v", err)
+	}
+}
+
+func TestStorage_IsFatalLoadError(t *testing.T) {
+	key, err := storage.KeyConfig{Passphrase: "correct horse"}.Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		err   error
+		key   storage.EncryptionKey
+		fatal bool
+	}{
+		{err: errors.New("failed to parse storage file"), fatal: false},
+		{err: fmt.Errorf("failed to decrypt storage file: %w", storage.ErrEncrypted), fatal: true},
+		{err: &storage.SchemaVersionError{Version: "3.0.0"}, fatal: true},
+		{err: errors.New("failed to parse storage file"), key: key, fatal: true},
+	}
+	for _, tt := range tests {
+		if fatal := storage.IsFatalLoadError(tt.err, tt.key); fatal != tt.fatal {
+			t.Errorf("Expected IsFatalLoadError(%v, key set %t) to be %t", tt.err, tt.key != nil, tt.fatal)
+		}
+	}
+}
+
+func TestMemoryStorage_PurgeExpiredSecrets(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	ctx := context.Background()
+
+	expireTime := time.Now().Add(time.Hour)
+	expiring := models.NewSecret("test-project", "expiring", nil)
+	expiring.ExpireTime = &expireTime
+	_ = store.CreateSecret(ctx, "test-project", "expiring", expiring)
+	_ = store.CreateSecret(ctx, "test-project", "permanent", models.NewSecret("test-project", "permanent", nil))
+
+	purged, err := store.PurgeExpiredSecrets(ctx, time.Now())
+	if err != nil || len(purged) != 0 {
+		t.Fatalf("Expected nothing purged before expiration, got %v, %v", purged, err)
+	}
+
+	purged, err = store.PurgeExpiredSecrets(ctx, expireTime)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(purged) != 1 || purged[0].Name != expiring.Name {
+		t.Fatalf("Expected only the expiring secret to be purged, got %v", purged)
+	}
+	if _, err := store.GetSecret(ctx, "test-project", "permanent"); err != nil {
+		t.Errorf("Expected permanent secret to remain, got %v", err)
+	}
+}
+
+func TestMemoryStorage_RotateSecrets(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	ctx := context.Background()
+
+	next := time.Now().Add(time.Hour)
+	period := models.Duration(24 * time.Hour)
+	secret := models.NewSecret("test-project", "test-secret", nil)
+	secret.Topics = []*models.Topic{{Name: "projects/test-project/topics/rotations"}}
+	secret.Rotation = &models.Rotation{NextRotationTime: &next, RotationPeriod: &period}
+	_ = store.CreateSecret(ctx, "test-project", "test-secret", secret)
+
+	once := next.Add(-time.Minute)
+	oneShot := models.NewSecret("test-project", "one-shot", nil)
+	oneShot.Topics = secret.Topics
+	oneShot.Rotation = &models.Rotation{NextRotationTime: &once}
+	_ = store.CreateSecret(ctx, "test-project", "one-shot", oneShot)
+
+	rotated, err := store.RotateSecrets(ctx, time.Now())
+	if err != nil || len(rotated) != 0 {
+		t.Fatalf("Expected nothing to rotate yet, got %v, %v", rotated, err)
+	}
+
+	rotated, err = store.RotateSecrets(ctx, next.Add(25*time.Hour))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("Expected both secrets to rotate, got %d", len(rotated))
+	}
+
+	got, _ := store.GetSecret(ctx, "test-project", "test-secret")
+	if want := next.Add(48 * time.Hour); !got.Rotation.NextRotationTime.Equal(want) {
+		t.Errorf("Expected next rotation at %v, got %v", want, got.Rotation.NextRotationTime)
+	}
+	got, _ = store.GetSecret(ctx, "test-project", "one-shot")
+	if got.Rotation.NextRotationTime != nil {
+		t.Errorf("Expected a rotation without period to fire once, got %v", got.Rotation.NextRotationTime)
+	}
+}
+
+func TestMemoryStorage_ListSecretsPagination(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	ctx := context.Background()
+
+	for _, id := range []string{"b", "c", "d"} {
+		_ = store.CreateSecret(ctx, "test-project", id, models.NewSecret("test-project", id, nil))
+	}
+
+	page, token, total, err := store.ListSecrets(ctx, "test-project", nil, 2, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(page) != 2 || total != 3 || token == "" {
+		t.Fatalf("Expected 2 of 3 secrets and a token, got %d of %d, token %q", len(page), total, token)
+	}
+
+	// A secret sorting before the last page must not shift the next one
+	_ = store.CreateSecret(ctx, "test-project", "a", models.NewSecret("test-project", "a", nil))
+
+	page, token, total, err = store.ListSecrets(ctx, "test-project", nil, 2, token)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(page) != 1 || page[0].GetSecretID() != "d" || token != "" || total != 4 {
+		t.Fatalf("Expected only d on the last page of 4, got %v, token %q, total %d", page, token, total)
+	}
+
+	if _, _, _, err := store.ListSecrets(ctx, "test-project", nil, 2, "2"); err != storage.ErrInvalidPageToken {
+		t.Errorf("Expected ErrInvalidPageToken for a malformed token, got %v", err)
+	}
+
+	_, token, _, _ = store.ListSecrets(ctx, "test-project", nil, 1, "")
+	match, _ := filter.Parse("name:b", models.SecretFilterFields)
+	if _, _, _, err := store.ListSecrets(ctx, "test-project", match, 1, token); err != storage.ErrInvalidPageToken {
+		t.Errorf("Expected ErrInvalidPageToken for a token from another query, got %v", err)
+	}
+}
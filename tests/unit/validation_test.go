@@ -0,0 +1,124 @@
+package unit
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charlesgreen/gsm/internal/models"
+	"github.com/charlesgreen/gsm/internal/validation"
+)
+
+func TestValidation_SecretID(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"db-password":            true,
+		"DB_PASSWORD_2":          true,
+		strings.Repeat("a", 255): true,
+		strings.Repeat("a", 256): false,
+		"":                       false,
+		"db.password":            false,
+		"db password":            false,
+	} {
+		if got := len(validation.SecretID(id)) == 0; got != valid {
+			t.Errorf("SecretID(%q) valid = %v, want %v", id, got, valid)
+		}
+	}
+}
+
+func TestValidation_Labels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		fields []string
+	}{
+		{"valid", map[string]string{"env": "prod", "team-1": "", "ñandú": "sí"}, nil},
+		{"uppercase key", map[string]string{"Env": "prod"}, []string{"labels[Env]"}},
+		{"key starting with digit", map[string]string{"1env": "prod"}, []string{"labels[1env]"}},
+		{"uppercase value", map[string]string{"env": "Prod"}, []string{"labels[env]"}},
+		{"long value", map[string]string{"env": strings.Repeat("a", 64)}, []string{"labels[env]"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fields []string
+			for _, violation := range validation.Labels("labels", tt.labels) {
+				fields = append(fields, violation.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+				t.Errorf("Expected violations %v, got %v", tt.fields, fields)
+			}
+		})
+	}
+}
+
+func TestValidation_Replication(t *testing.T) {
+	replicas := func(locations ...string) *models.Replication {
+		userManaged := &models.UserManagedReplication{}
+		for _, location := range locations {
+			userManaged.Replicas = append(userManaged.Replicas, &models.Replica{Location: location})
+		}
+		return &models.Replication{UserManaged: userManaged}
+	}
+
+	tests := []struct {
+		name        string
+		replication *models.Replication
+		fields      []string
+	}{
+		{"none", nil, nil},
+		{"automatic", &models.Replication{Automatic: &models.AutomaticReplication{}}, nil},
+		{"user managed", replicas("us-east1", "us-west1"), nil},
+		{"no replicas", replicas(), []string{"replication.user_managed.replicas"}},
+		{"duplicate", replicas("us-east1", "us-east1"), []string{"replication.user_managed.replicas[1].location"}},
+		{"missing location", replicas(""), []string{"replication.user_managed.replicas[0].location"}},
+		{"both", &models.Replication{Automatic: &models.AutomaticReplication{}, UserManaged: replicas("us-east1").UserManaged}, []string{"replication"}},
+		{"bad key", &models.Replication{Automatic: &models.AutomaticReplication{
+			CustomerManagedEncryption: &models.CustomerManagedEncryption{KmsKeyName: "my-key"},
+		}}, []string{"replication.automatic.customer_managed_encryption.kms_key_name"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fields []string
+			for _, violation := range validation.Replication("replication", tt.replication) {
+				fields = append(fields, violation.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+				t.Errorf("Expected violations %v, got %v", tt.fields, fields)
+			}
+		})
+	}
+}
+
+func TestValidation_SecretUpdate(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	period := models.Duration(time.Minute)
+	secret := func() *models.Secret {
+		return &models.Secret{
+			Labels:         map[string]string{"env": "prod"},
+			Annotations:    map[string]string{"example.com/ticket": "OPS-1"},
+			VersionAliases: map[string]models.Int64{"latest": 1},
+			Topics:         []*models.Topic{{Name: "rotations"}},
+			Rotation:       &models.Rotation{NextRotationTime: &past, RotationPeriod: &period},
+		}
+	}
+
+	tests := []struct {
+		mask   []string
+		fields []string
+	}{
+		{[]string{"labels"}, nil},
+		{[]string{"annotations"}, []string{"secret.annotations[example.com/ticket]"}},
+		{[]string{"versionAliases"}, []string{"secret.version_aliases[latest]"}},
+		{[]string{"topics"}, []string{"secret.topics[0].name"}},
+		{[]string{"rotation.rotationPeriod"}, []string{"secret.rotation.rotation_period"}},
+		{[]string{"rotation.nextRotationTime"}, []string{"secret.rotation.next_rotation_time"}},
+	}
+	for _, tt := range tests {
+		var fields []string
+		for _, violation := range validation.SecretUpdate(tt.mask, secret(), time.Now()) {
+			fields = append(fields, violation.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+			t.Errorf("SecretUpdate(%v): expected violations %v, got %v", tt.mask, tt.fields, fields)
+		}
+	}
+}